@@ -0,0 +1,140 @@
+/*
+Driver location service for Zombie test.
+
+*/
+
+package main
+
+import (
+	"log"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+)
+
+//BatchOptions describes how the location messages are grouped before being written to Redis
+type BatchOptions struct {
+	Size          int `yaml:"size,omitempty"`           //Maximum number of locations written by a single pipeline
+	FlushInterval int `yaml:"flush-interval,omitempty"` //Maximum time (in ms) a location waits for its batch to be written
+}
+
+//DefaultBatchSize Default maximum number of locations written by a single pipeline
+const DefaultBatchSize = 100
+
+//DefaultBatchFlushInterval Default maximum time (in ms) a location waits for its batch to be written
+const DefaultBatchFlushInterval = 50
+
+//pendingLocation A valid location message waiting for its batch to be written
+type pendingLocation struct {
+	m       *nsq.Message           //NSQ message, finished once the location has been written
+	message map[string]interface{} //Decoded message, with its timestamp
+}
+
+//batchWriter Groups the location messages in batches bounded by size and time, and writes every batch with a single pipeline
+type batchWriter struct {
+	opts      BatchOptions
+	locations chan pendingLocation
+}
+
+//writer Writer of the location batches (nil if the locations are written one at a time, e.g. in tests)
+var writer *batchWriter
+
+//batchSettings Returns opts with default values for the missing settings
+func batchSettings(opts BatchOptions) BatchOptions {
+	if opts.Size <= 0 {
+		opts.Size = DefaultBatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultBatchFlushInterval
+	}
+	return opts
+}
+
+//newBatchWriter Creates a batch writer. Batches are written by run
+func newBatchWriter(opts BatchOptions) *batchWriter {
+	opts = batchSettings(opts)
+	return &batchWriter{
+		opts:      opts,
+		locations: make(chan pendingLocation, opts.Size),
+	}
+}
+
+//add Queues the location of message m. m is finished (or requeued) when its batch has been written
+func (w *batchWriter) add(m *nsq.Message, message map[string]interface{}) {
+	m.DisableAutoResponse()
+	w.locations <- pendingLocation{m, message}
+}
+
+//run Writes a batch when it is full or when its first location has waited for the flush interval, until the writer is closed
+func (w *batchWriter) run() {
+	batch := make([]pendingLocation, 0, w.opts.Size)
+	var flush <-chan time.Time
+	for {
+		select {
+		case location, isOpen := <-w.locations:
+			if !isOpen {
+				w.write(batch)
+				return
+			}
+			batch = append(batch, location)
+			if len(batch) == 1 {
+				flush = time.After(time.Duration(w.opts.FlushInterval) * time.Millisecond)
+			}
+			if len(batch) < w.opts.Size {
+				continue
+			}
+		case <-flush:
+		}
+		w.write(batch)
+		batch = batch[:0]
+		flush = nil
+	}
+}
+
+//close Stops run once the queued locations have been written
+func (w *batchWriter) close() {
+	close(w.locations)
+}
+
+//write Writes a batch with a single pipeline. Then it finishes the messages that have been persisted and requeues the others
+func (w *batchWriter) write(batch []pendingLocation) {
+	if len(batch) == 0 {
+		return
+	}
+	if pool == nil {
+		//Pool not initialized (e.g. in tests). Create a new pool
+		pool = newPool(Config.Redis.Host)
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	messages := make([]map[string]interface{}, len(batch))
+	for i, location := range batch {
+		messages[i] = location.message
+	}
+	var errs []error
+	if err := conn.Err(); err != nil {
+		log.Printf("Error in connecting to Redis: %v", err)
+		errs = make([]error, len(batch))
+		for i := range errs {
+			errs[i] = err
+		}
+	} else {
+		errs = persistLocations(conn, messages)
+	}
+	batchLocations.Observe(float64(len(batch)))
+	opts := nsqSettings(Config.Nsq)
+	failed := 0
+	for i, location := range batch {
+		if errs[i] == nil {
+			nsqMessages.WithLabelValues(ResultPersisted).Inc()
+			location.m.Finish()
+			continue
+		}
+		failed++
+		if requeueMessage(location.m, errs[i], opts) == nil {
+			//Given up: kept as a dead letter
+			location.m.Finish()
+		}
+	}
+	log.Printf("Batch of %v locations written to Redis (%v failed)", len(batch), failed)
+}
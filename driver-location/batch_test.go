@@ -0,0 +1,169 @@
+/*
+Driver location service for Zombie test.
+
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	nsq "github.com/nsqio/go-nsq"
+	"github.com/stretchr/testify/assert"
+)
+
+//batchDelegate Keeps the response to NSQ of a message written by a batch writer
+type batchDelegate struct {
+	done     *sync.WaitGroup
+	finished bool
+	requeued bool
+}
+
+func (d *batchDelegate) OnFinish(m *nsq.Message) {
+	d.finished = true
+	d.done.Done()
+}
+func (d *batchDelegate) OnRequeue(m *nsq.Message, delay time.Duration, backoff bool) {
+	d.requeued = true
+	d.done.Done()
+}
+func (d *batchDelegate) OnTouch(m *nsq.Message) {}
+
+//testMessage Returns the NSQ message of a location of driver id recorded at timestamp (Unix time in ms)
+func testMessage(id string, timestamp int64) *nsq.Message {
+	var messageID nsq.MessageID
+	copy(messageID[:], fmt.Sprintf("%016d", timestamp))
+	body := fmt.Sprintf(`{"driverId": "%v", "latitude": 48.864193, "longitude": 2.364988, "recordedAt": %v}`, id, timestamp)
+	m := nsq.NewMessage(messageID, []byte(body))
+	m.Timestamp = timestamp * 1e6
+	return m
+}
+
+func TestBatchWriter(t *testing.T) {
+	pool = newPool(Config.Redis.Host)
+	conn := pool.Get()
+	defer conn.Close()
+	tests := []struct {
+		name             string
+		opts             BatchOptions
+		redis            string
+		messages         int
+		expectedFinished bool
+	}{
+		//Test cases
+		{"Full batch", BatchOptions{Size: 3, FlushInterval: 60e3}, Config.Redis.Host, 3, true},
+		{"Flush interval", BatchOptions{Size: 100, FlushInterval: 10}, Config.Redis.Host, 2, true},
+		{"Redis is down", BatchOptions{Size: 2, FlushInterval: 10}, "127.0.0.1:1", 2, false},
+	}
+	for i, tt := range tests {
+		id := fmt.Sprintf("batch00%v", i)
+		conn.Do("DEL", "driver:"+id+":log", "driver:"+id+":timeline", rejectedKey(id))
+		pool = newPool(tt.redis)
+		writer = newBatchWriter(tt.opts)
+		go writer.run()
+		var done sync.WaitGroup
+		delegates := make([]*batchDelegate, tt.messages)
+		now := time.Now().UnixNano() / 1e6
+		for j := range delegates {
+			delegates[j] = &batchDelegate{done: &done}
+			m := testMessage(id, now-int64(tt.messages-j)*1e3)
+			m.Delegate = delegates[j]
+			done.Add(1)
+			assert.Nil(t, handleMessage(m), "Testing "+tt.name)
+			//The message is finished by the writer
+			assert.True(t, m.IsAutoResponseDisabled(), "Testing "+tt.name)
+		}
+		done.Wait()
+		writer.close()
+		writer = nil
+		pool = newPool(Config.Redis.Host)
+		for _, delegate := range delegates {
+			assert.Equal(t, tt.expectedFinished, delegate.finished, "Testing "+tt.name)
+			assert.Equal(t, !tt.expectedFinished, delegate.requeued, "Testing "+tt.name)
+		}
+		count, _ := redis.Int(conn.Do("ZCARD", "driver:"+id+":timeline"))
+		if tt.expectedFinished {
+			assert.Equal(t, tt.messages, count, "Testing "+tt.name)
+		} else {
+			assert.Equal(t, 0, count, "Testing "+tt.name)
+		}
+	}
+}
+
+func Test_persistLocations(t *testing.T) {
+	pool = newPool(Config.Redis.Host)
+	conn := pool.Get()
+	defer conn.Close()
+	conn.Do("DEL", "driver:batch010:log", "driver:batch010:timeline", rejectedKey("batch010"))
+	conn.Do("SET", "driver:batch011:timeline", "not a sorted set")
+	defer conn.Do("DEL", "driver:batch011:timeline")
+	//Redis has lost its script cache
+	conn.Do("SCRIPT", "FLUSH")
+	now := time.Now().UnixNano() / 1e6
+	messages := []map[string]interface{}{
+		{"driverId": "batch010", "latitude": 48.864193, "longitude": 2.364988, "timestamp": now - 2e3},
+		{"driverId": "batch011", "latitude": 48.864193, "longitude": 2.364988, "timestamp": now - 1e3},
+		{"driverId": "batch010", "latitude": 48.864193, "longitude": 2.365088, "timestamp": now},
+	}
+	errs := persistLocations(conn, messages)
+	assert.Nil(t, errs[0])
+	assert.NotNil(t, errs[1])
+	assert.Nil(t, errs[2])
+	count, _ := redis.Int(conn.Do("ZCARD", "driver:batch010:timeline"))
+	assert.Equal(t, 2, count)
+}
+
+//benchmarkHandleMessage Handles b.N location messages of 100 drivers with num-publishers concurrent handlers and reports the messages per second
+func benchmarkHandleMessage(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	var done sync.WaitGroup
+	var sent int64
+	var sentMtx sync.Mutex
+	now := time.Now().UnixNano() / 1e6
+	start := time.Now()
+	//As many handlers as num-publishers
+	b.SetParallelism(Config.Nsq.NumPublishers/runtime.GOMAXPROCS(0) + 1)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			sentMtx.Lock()
+			sent++
+			timestamp := now - sent
+			sentMtx.Unlock()
+			m := testMessage(fmt.Sprintf("bench%03d", timestamp%100), timestamp)
+			m.Delegate = &batchDelegate{done: &done}
+			done.Add(1)
+			handleMessage(m)
+			if !m.IsAutoResponseDisabled() {
+				//Finished by the consumer
+				done.Done()
+			}
+		}
+	})
+	done.Wait()
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "msgs/s")
+}
+
+func BenchmarkHandleMessage(b *testing.B) {
+	pool = newPool(Config.Redis.Host)
+	b.Run("one at a time", func(b *testing.B) {
+		benchmarkHandleMessage(b)
+	})
+	b.Run("batched", func(b *testing.B) {
+		writer = newBatchWriter(Config.Batch)
+		go writer.run()
+		defer func() {
+			writer.close()
+			writer = nil
+		}()
+		benchmarkHandleMessage(b)
+	})
+}
@@ -0,0 +1,253 @@
+/*
+Driver location service for Zombie test.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gomodule/redigo/redis"
+	nsq "github.com/nsqio/go-nsq"
+)
+
+//DeadLetterOptions describes where the rejected location messages are kept
+type DeadLetterOptions struct {
+	NsqdHost  string `yaml:"nsqd-host,omitempty"`  //nsqd host:port that listens to native clients. Dead letters are not published if empty
+	Topic     string `yaml:"topic,omitempty"`      //Topic of the dead letters
+	MaxLength int    `yaml:"max-length,omitempty"` //Maximum number of dead letters kept in Redis
+}
+
+//DeadLetter is the envelope of a rejected location message
+type DeadLetter struct {
+	Body       string `json:"body"`           //Original message body
+	Reason     string `json:"reason"`         //Why the message has been rejected
+	Rule       string `json:"rule,omitempty"` //Validation rule that failed (validation reason)
+	Error      string `json:"error"`          //Detailed error
+	MessageID  string `json:"messageId"`      //NSQ message ID
+	Attempts   uint16 `json:"attempts"`       //NSQ delivery attempts
+	EnqueuedAt int64  `json:"enqueuedAt"`     //NSQ enqueue time (Unix time in ms)
+	RejectedAt int64  `json:"rejectedAt"`     //Unix time in ms
+}
+
+//Reasons of a rejection
+const (
+	//ReasonInvalidJSON The body is not a JSON object
+	ReasonInvalidJSON = "invalid_json"
+	//ReasonValidation The message doesn't follow a validation rule
+	ReasonValidation = "validation"
+	//ReasonTimestamp The recorded time is out of the tolerated range and the fallback rule is reject
+	ReasonTimestamp = "timestamp_out_of_range"
+	//ReasonPersistence The message couldn't be persisted to Redis after max-attempts deliveries
+	ReasonPersistence = "persistence_failed"
+)
+
+//DeadLettersKey Redis list of the last dead letters (newest first)
+const DeadLettersKey = "dead-letters"
+
+//DefaultDeadLetterTopic Default topic of the dead letters
+const DefaultDeadLetterTopic = "locations-dead-letter"
+
+//DefaultDeadLetterMaxLength Default maximum number of dead letters kept in Redis
+const DefaultDeadLetterMaxLength = 1000
+
+//DefaultRedriveLimit Default maximum number of dead letters re-driven by a request
+const DefaultRedriveLimit = 100
+
+//messagePublisher publishes messages to a topic (a go-nsq producer)
+type messagePublisher interface {
+	Publish(topic string, body []byte) error
+}
+
+//deadLetters Publisher of the dead letters and of the re-driven messages (nil if there is no nsqd host)
+var deadLetters messagePublisher
+
+//newDeadLetterPublisher Creates the publisher of the dead letters. It returns nil if there is no nsqd host
+func newDeadLetterPublisher(opts DeadLetterOptions) messagePublisher {
+	if opts.NsqdHost == "" {
+		log.Println("No nsqd host. Dead letters will only be kept in Redis")
+		return nil
+	}
+	cfg := nsq.NewConfig()
+	cfg.UserAgent = fmt.Sprintf("driver-location/%s go-nsq/%s", "0.1", nsq.VERSION)
+	producer, err := nsq.NewProducer(opts.NsqdHost, cfg)
+	if err != nil {
+		log.Printf("A problem occurred in initializing NSQ Producer: %v", err)
+		return nil
+	}
+	producer.SetLogger(log.New(os.Stderr, "", log.Flags()), nsq.LogLevelWarning)
+	return producer
+}
+
+//deadLetterSettings Returns opts with default values for the missing settings
+func deadLetterSettings(opts DeadLetterOptions) DeadLetterOptions {
+	if opts.Topic == "" {
+		opts.Topic = DefaultDeadLetterTopic
+	}
+	if opts.MaxLength <= 0 {
+		opts.MaxLength = DefaultDeadLetterMaxLength
+	}
+	return opts
+}
+
+//newDeadLetter Builds the envelope of message m rejected for reason. The rule is the one of a validation error
+func newDeadLetter(m *nsq.Message, reason string, err error) DeadLetter {
+	letter := DeadLetter{
+		Body:       string(m.Body),
+		Reason:     reason,
+		Error:      err.Error(),
+		MessageID:  string(m.ID[:]),
+		Attempts:   m.Attempts,
+		EnqueuedAt: m.Timestamp / 1e6,
+		RejectedAt: time.Now().UnixNano() / 1e6,
+	}
+	if validationErr, ok := err.(*ValidationError); ok {
+		letter.Rule = validationErr.Rule
+	}
+	return letter
+}
+
+//deadLetter Keeps a rejected message in Redis and publishes it to the dead-letter topic
+func deadLetter(m *nsq.Message, reason string, err error) {
+	opts := deadLetterSettings(Config.DeadLetter)
+	letter := newDeadLetter(m, reason, err)
+	nsqMessages.WithLabelValues(ResultDeadLetter).Inc()
+	deadLettersTotal.WithLabelValues(reason).Inc()
+	value, _ := json.Marshal(letter)
+	if pool == nil {
+		//Pool not initialized (e.g. in tests). Create a new pool
+		pool = newPool(Config.Redis.Host)
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	conn.Send("LPUSH", DeadLettersKey, value)
+	conn.Send("LTRIM", DeadLettersKey, 0, opts.MaxLength-1)
+	if _, err := conn.Do(""); err != nil {
+		log.Printf("Error in keeping dead letter %v: %v", letter.MessageID, err)
+	}
+	if deadLetters != nil {
+		if err := deadLetters.Publish(opts.Topic, value); err != nil {
+			nsqPublished.WithLabelValues(opts.Topic, "error").Inc()
+			log.Printf("Error in publishing dead letter %v: %v", letter.MessageID, err)
+		} else {
+			nsqPublished.WithLabelValues(opts.Topic, "ok").Inc()
+		}
+	}
+}
+
+//getDeadLetters Replies with the last dead letters kept in Redis (newest first)
+func getDeadLetters(c *gin.Context) {
+	limit := DefaultRedriveLimit
+	if value, isThere := c.GetQuery("limit"); isThere {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			badRequestReply := map[string]string{
+				"message": "limit must be a positive integer",
+			}
+			c.IndentedJSON(http.StatusBadRequest, badRequestReply)
+			return
+		}
+	}
+	if pool == nil {
+		//Pool not initialized (e.g. in unit tests). Provide a pool initialization
+		pool = newPool(Config.Redis.Host)
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	conn.Send("LLEN", DeadLettersKey)
+	conn.Send("LRANGE", DeadLettersKey, 0, limit-1)
+	if err := conn.Flush(); err != nil {
+		log.Printf("Error in reading the dead letters: %v", err)
+		c.String(http.StatusInternalServerError, "Ooops. Something went wrong on our side.")
+		return
+	}
+	total, err := redis.Int(conn.Receive())
+	values, err2 := redis.ByteSlices(conn.Receive())
+	if err != nil || err2 != nil {
+		log.Printf("Error in reading the dead letters: %v %v", err, err2)
+		c.String(http.StatusInternalServerError, "Ooops. Something went wrong on our side.")
+		return
+	}
+	letters := make([]DeadLetter, 0, len(values))
+	for _, value := range values {
+		var letter DeadLetter
+		if err := json.Unmarshal(value, &letter); err == nil {
+			letters = append(letters, letter)
+		}
+	}
+	c.IndentedJSON(http.StatusOK, map[string]interface{}{
+		"total":       total,
+		"deadLetters": letters,
+	})
+}
+
+//redriveDeadLetters Publishes the oldest dead letters (or the one of a given message ID) to the locations topic again.
+//Re-driven dead letters are removed from Redis
+func redriveDeadLetters(c *gin.Context) {
+	limit := DefaultRedriveLimit
+	if value, isThere := c.GetQuery("limit"); isThere {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			badRequestReply := map[string]string{
+				"message": "limit must be a positive integer",
+			}
+			c.IndentedJSON(http.StatusBadRequest, badRequestReply)
+			return
+		}
+	}
+	messageID := c.Query("id")
+	if deadLetters == nil {
+		unavailableReply := map[string]string{
+			"message": "No nsqd host to re-drive dead letters",
+		}
+		c.IndentedJSON(http.StatusServiceUnavailable, unavailableReply)
+		return
+	}
+	if pool == nil {
+		//Pool not initialized (e.g. in unit tests). Provide a pool initialization
+		pool = newPool(Config.Redis.Host)
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	values, err := redis.ByteSlices(conn.Do("LRANGE", DeadLettersKey, 0, -1))
+	if err != nil {
+		log.Printf("Error in reading the dead letters: %v", err)
+		c.String(http.StatusInternalServerError, "Ooops. Something went wrong on our side.")
+		return
+	}
+	redriven, failed := 0, 0
+	//From the oldest to the newest
+	for i := len(values) - 1; i >= 0 && redriven+failed < limit; i-- {
+		var letter DeadLetter
+		if err := json.Unmarshal(values[i], &letter); err != nil {
+			continue
+		}
+		if messageID != "" && letter.MessageID != messageID {
+			continue
+		}
+		if err := deadLetters.Publish(Config.Nsq.Topic, []byte(letter.Body)); err != nil {
+			nsqPublished.WithLabelValues(Config.Nsq.Topic, "error").Inc()
+			log.Printf("Error in re-driving dead letter %v: %v", letter.MessageID, err)
+			failed++
+			continue
+		}
+		nsqPublished.WithLabelValues(Config.Nsq.Topic, "ok").Inc()
+		conn.Do("LREM", DeadLettersKey, 1, values[i])
+		redriven++
+	}
+	log.Printf("Re-driven %v dead letters to topic %v (%v failed)", redriven, Config.Nsq.Topic, failed)
+	c.IndentedJSON(http.StatusOK, map[string]int{
+		"redriven": redriven,
+		"failed":   failed,
+	})
+}
@@ -0,0 +1,181 @@
+/*
+Driver location service for Zombie test.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	nsq "github.com/nsqio/go-nsq"
+	"github.com/stretchr/testify/assert"
+)
+
+//recordingPublisher Keeps the published messages. It fails when err is set
+type recordingPublisher struct {
+	topics   []string
+	messages [][]byte
+	err      error
+}
+
+func (p *recordingPublisher) Publish(topic string, body []byte) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.topics = append(p.topics, topic)
+	p.messages = append(p.messages, body)
+	return nil
+}
+
+func Test_validateMessage(t *testing.T) {
+	tests := []struct {
+		name         string
+		input        map[string]interface{}
+		expectedRule string
+	}{
+		//Test cases
+		{"Correct input", map[string]interface{}{"driverId": "aaaa", "latitude": 22.000, "longitude": 23.444}, ""},
+		{"Missing fields", map[string]interface{}{"driverId": "aaaa", "longitude": 23.444}, RuleMissingFields},
+		{"Nil ID", map[string]interface{}{"driverId": nil, "latitude": 22.000, "longitude": 23.444}, RuleNilValues},
+		{"String latitude", map[string]interface{}{"driverId": "aaaa", "latitude": "22.000", "longitude": 23.444}, RuleCoordinateType},
+		{"Boolean ID", map[string]interface{}{"driverId": true, "latitude": 22.000, "longitude": 23.444}, RuleIDType},
+		{"String recordedAt", map[string]interface{}{"driverId": "aaaa", "latitude": 22.000, "longitude": 23.444, "recordedAt": "yesterday"}, RuleRecordedAt},
+		{"Latitude out of range", map[string]interface{}{"driverId": "aaaa", "latitude": 89.00, "longitude": 23.444}, RuleCoordinateRange},
+		{"Empty ID", map[string]interface{}{"driverId": "", "latitude": 22.000, "longitude": 23.444}, RuleEmptyID},
+	}
+	for _, tt := range tests {
+		err := validateMessage(tt.input)
+		if tt.expectedRule == "" {
+			assert.Nil(t, err, "Testing "+tt.name)
+			continue
+		}
+		if validationErr, ok := err.(*ValidationError); assert.True(t, ok, "Testing "+tt.name) {
+			assert.Equal(t, tt.expectedRule, validationErr.Rule, "Testing "+tt.name)
+		}
+	}
+}
+
+func Test_handleMessageDeadLetter(t *testing.T) {
+	pool = newPool(Config.Redis.Host)
+	conn := pool.Get()
+	defer conn.Close()
+	conn.Do("DEL", DeadLettersKey)
+	publisher := &recordingPublisher{}
+	deadLetters = publisher
+	defer func() { deadLetters = nil }()
+	timestamps := Config.Timestamps
+	Config.Timestamps = TimestampOptions{Fallback: FallbackReject}
+	defer func() { Config.Timestamps = timestamps }()
+	now := time.Now()
+	tests := []struct {
+		name           string
+		body           string
+		expectedReason string
+		expectedRule   string
+	}{
+		//Test cases
+		{"Invalid JSON", `{"driverId": "dead001", "latitude": 48.864193,`, ReasonInvalidJSON, ""},
+		{"Missing longitude", `{"driverId": "dead001", "latitude": 48.864193}`, ReasonValidation, RuleMissingFields},
+		{"Latitude out of range", `{"driverId": "dead001", "latitude": 89, "longitude": 2.364988}`, ReasonValidation, RuleCoordinateRange},
+		{"Recorded time out of range", `{"driverId": "dead001", "latitude": 48.864193, "longitude": 2.364988, "recordedAt": 1000}`, ReasonTimestamp, ""},
+		{"Valid message", `{"driverId": "dead001", "latitude": 48.864193, "longitude": 2.364988}`, "", ""},
+	}
+	for i, tt := range tests {
+		var id nsq.MessageID
+		copy(id[:], "0a1b2c3d4e5f6a7b")
+		id[15] = byte('0' + i)
+		m := nsq.NewMessage(id, []byte(tt.body))
+		m.Attempts = 2
+		m.Timestamp = now.UnixNano()
+		publisher.messages = nil
+		assert.Nil(t, handleMessage(m), "Testing "+tt.name)
+		if tt.expectedReason == "" {
+			assert.Equal(t, 0, len(publisher.messages), "Testing "+tt.name)
+			continue
+		}
+		if !assert.Equal(t, 1, len(publisher.messages), "Testing "+tt.name) {
+			continue
+		}
+		var letter DeadLetter
+		json.Unmarshal(publisher.messages[0], &letter)
+		assert.Equal(t, DefaultDeadLetterTopic, publisher.topics[len(publisher.topics)-1], "Testing "+tt.name)
+		assert.Equal(t, tt.body, letter.Body, "Testing "+tt.name)
+		assert.Equal(t, tt.expectedReason, letter.Reason, "Testing "+tt.name)
+		assert.Equal(t, tt.expectedRule, letter.Rule, "Testing "+tt.name)
+		assert.Equal(t, string(id[:]), letter.MessageID, "Testing "+tt.name)
+		assert.Equal(t, uint16(2), letter.Attempts, "Testing "+tt.name)
+		assert.Equal(t, now.UnixNano()/1e6, letter.EnqueuedAt, "Testing "+tt.name)
+	}
+	//Dead letters are kept in Redis, newest first
+	count, _ := redis.Int(conn.Do("LLEN", DeadLettersKey))
+	assert.Equal(t, 4, count)
+}
+
+func TestDeadLettersRoutes(t *testing.T) {
+	pool = newPool(Config.Redis.Host)
+	conn := pool.Get()
+	defer conn.Close()
+	conn.Do("DEL", DeadLettersKey)
+	for _, letter := range []DeadLetter{
+		{Body: `{"driverId": "dead002", "latitude": 89, "longitude": 2.36}`, Reason: ReasonValidation, Rule: RuleCoordinateRange, MessageID: "0000000000000001"},
+		{Body: `{"driverId": "dead002"}`, Reason: ReasonValidation, Rule: RuleMissingFields, MessageID: "0000000000000002"},
+		{Body: `{"driverId": "dead002", "latitude": 48.86, "longitude": 2.36}`, Reason: ReasonTimestamp, MessageID: "0000000000000003"},
+	} {
+		value, _ := json.Marshal(letter)
+		conn.Do("LPUSH", DeadLettersKey, value)
+	}
+	router := setupRouter()
+	//Inspection
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", AdminPathPrefix+"/dead-letters?limit=2", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var reply struct {
+		Total       int          `json:"total"`
+		DeadLetters []DeadLetter `json:"deadLetters"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &reply)
+	assert.Equal(t, 3, reply.Total)
+	if assert.Equal(t, 2, len(reply.DeadLetters)) {
+		assert.Equal(t, "0000000000000003", reply.DeadLetters[0].MessageID)
+		assert.Equal(t, RuleMissingFields, reply.DeadLetters[1].Rule)
+	}
+	//No nsqd host
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", AdminPathPrefix+"/dead-letters/redrive", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	publisher := &recordingPublisher{}
+	deadLetters = publisher
+	defer func() { deadLetters = nil }()
+	//Re-drive of a single message
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", AdminPathPrefix+"/dead-letters/redrive?id=0000000000000003", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "\"redriven\": 1")
+	assert.Equal(t, []string{Config.Nsq.Topic}, publisher.topics)
+	assert.Equal(t, `{"driverId": "dead002", "latitude": 48.86, "longitude": 2.36}`, string(publisher.messages[0]))
+	//NSQ is down: dead letters are kept
+	publisher.err = errors.New("nsqd is down")
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", AdminPathPrefix+"/dead-letters/redrive", nil)
+	router.ServeHTTP(w, req)
+	assert.Contains(t, w.Body.String(), "\"failed\": 2")
+	//Re-drive of the oldest one
+	publisher.err = nil
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", AdminPathPrefix+"/dead-letters/redrive?limit=1", nil)
+	router.ServeHTTP(w, req)
+	assert.Contains(t, w.Body.String(), "\"redriven\": 1")
+	assert.Equal(t, `{"driverId": "dead002", "latitude": 89, "longitude": 2.36}`, string(publisher.messages[1]))
+	count, _ := redis.Int(conn.Do("LLEN", DeadLettersKey))
+	assert.Equal(t, 1, count)
+}
@@ -5,7 +5,9 @@ Driver location service for Zombie test.
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -13,6 +15,7 @@ import (
 	"net/http"
 	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -24,24 +27,51 @@ import (
 
 //IniConfig describes the data structure found config.yml file
 type IniConfig struct {
-	Port  int                 `yaml:"port,omitempty"`  //Gateway listening port
-	Redis RedisServiceOptions `yaml:"redis,omitempty"` //Redis options
-	Nsq   NsqServiceOptions   `yaml:"nsq,omitempty"`   //Nsq options
+	Port       int                 `yaml:"port,omitempty"`        //Gateway listening port
+	Redis      RedisServiceOptions `yaml:"redis,omitempty"`       //Redis options
+	Nsq        NsqServiceOptions   `yaml:"nsq,omitempty"`         //Nsq options
+	Timestamps TimestampOptions    `yaml:"timestamps,omitempty"`  //Rules to accept the time recorded by devices
+	Retention  RetentionOptions    `yaml:"retention,omitempty"`   //How long the driver data is kept in Redis
+	Queries    QueryOptions        `yaml:"queries,omitempty"`     //Limits of the location queries
+	Nearby     NearbyOptions       `yaml:"nearby,omitempty"`      //Options of the nearby drivers query
+	Presence   PresenceOptions     `yaml:"presence,omitempty"`    //When a driver is considered online
+	Filter     FilterOptions       `yaml:"filter,omitempty"`      //GPS outlier rejection and smoothing
+	DeadLetter DeadLetterOptions   `yaml:"dead-letter,omitempty"` //Where the rejected location messages are kept
+	Batch      BatchOptions        `yaml:"batch,omitempty"`       //How the locations are grouped before being written to Redis
 }
 
 //RedisServiceOptions describes the options for Redis service
 type RedisServiceOptions struct {
 	Host     string `yaml:"host,omitempty"`     //host:port to connect Redis clients
 	Password string `yaml:"password,omitempty"` //Password for AUTH command
+	MaxIdle  int    `yaml:"max-idle,omitempty"` //Maximum number of idle connections in the pool
 }
 
 //NsqServiceOptions describes the options for the driver-location service to interact with NSQ messaging service
 type NsqServiceOptions struct {
-	NsqlookupdHost string `yaml:"nsqlookupd-host,omitempty"` //nsqlookupd host:port that listens to native clients
-	Topic          string `yaml:"topic,omitempty"`           //Topic to look for messages
-	ChannelName    string `yaml:"channel,omitempty"`         //Channel name assigned to service's consumer
-	MaxInflight    int    `yaml:"max-inflight,omitempty"`    //Maximum number of messages to allow in flight (concurrency knob)
-	NumPublishers  int    `yaml:"num-publishers,omitempty"`  //number of concurrent publishers
+	NsqlookupdHost  string `yaml:"nsqlookupd-host,omitempty"`   //nsqlookupd host:port that listens to native clients
+	Topic           string `yaml:"topic,omitempty"`             //Topic to look for messages
+	ChannelName     string `yaml:"channel,omitempty"`           //Channel name assigned to service's consumer
+	MaxInflight     int    `yaml:"max-inflight,omitempty"`      //Maximum number of messages to allow in flight (concurrency knob)
+	NumPublishers   int    `yaml:"num-publishers,omitempty"`    //number of concurrent publishers
+	MaxAttempts     int    `yaml:"max-attempts,omitempty"`      //Number of deliveries of a message that can't be persisted before it is kept as a dead letter
+	RequeueDelay    int    `yaml:"requeue-delay,omitempty"`     //Seconds before the first redelivery of a message that can't be persisted. It doubles at every attempt
+	MaxRequeueDelay int    `yaml:"max-requeue-delay,omitempty"` //Maximum number of seconds before a redelivery
+}
+
+//TimestampOptions describes how the time recorded by a device is checked against the NSQ enqueue time
+type TimestampOptions struct {
+	MaxFutureSkew int    `yaml:"max-future-skew,omitempty"` //Seconds a recorded time can be ahead of the enqueue time
+	MaxAge        int    `yaml:"max-age,omitempty"`         //Seconds a recorded time can be behind the enqueue time
+	Fallback      string `yaml:"fallback,omitempty"`        //What to do with an out of range recorded time: enqueue, clamp or reject
+}
+
+//QueryOptions describes the limits of the location queries
+type QueryOptions struct {
+	MaxWindow int `yaml:"max-window,omitempty"` //Maximum length (in minutes) of the requested window
+	MaxLimit  int `yaml:"max-limit,omitempty"`  //Maximum number of locations in a page
+	//Speed (in m/s) at or below which a driver is stationary in the stats of getLocations
+	StationarySpeed float64 `yaml:"stationary-speed,omitempty"`
 }
 
 //GLOBAL CONSTANTS
@@ -52,9 +82,66 @@ const ConfigFileName string = "./config.yaml"
 //DefaultMins Default minutes given by getLocations
 const DefaultMins float64 = 5
 
+//DefaultMaxWindow Default maximum length (in minutes) of the window requested to getLocations
+const DefaultMaxWindow = 1440
+
+//DefaultMaxLimit Default maximum number of locations in a page of getLocations
+const DefaultMaxLimit = 1000
+
+//NextCursorHeader Response header with the cursor of the next page of locations
+const NextCursorHeader = "X-Next-Cursor"
+
+//DefaultMaxFutureSkew Default number of seconds a device recorded time can be ahead of the NSQ enqueue time
+const DefaultMaxFutureSkew = 30
+
+//DefaultMaxAge Default number of seconds a device recorded time can be behind the NSQ enqueue time
+const DefaultMaxAge = 86400
+
+//Fallback rules for out of range recorded times
+const (
+	//FallbackEnqueue Uses the NSQ enqueue time (default)
+	FallbackEnqueue = "enqueue"
+	//FallbackClamp Uses the nearest time of the tolerated range
+	FallbackClamp = "clamp"
+	//FallbackReject Discards the location
+	FallbackReject = "reject"
+)
+
+//Sources of a location timestamp
+const (
+	//TimestampDevice Time recorded by the device
+	TimestampDevice = "device"
+	//TimestampEnqueue NSQ enqueue time
+	TimestampEnqueue = "enqueue"
+	//TimestampClamped Time recorded by the device, clamped to the tolerated range
+	TimestampClamped = "clamped"
+	//TimestampRejected Time recorded by the device is out of range and the location is discarded
+	TimestampRejected = "rejected"
+)
+
+//DefaultRedisMaxIdle Default maximum number of idle connections in the Redis pool
+const DefaultRedisMaxIdle = 10
+
+//AdminPathPrefix Prefix of the maintenance endpoints
+const AdminPathPrefix = "/_admin"
+
 //ChannelName Default NSQ channel name
 const ChannelName = "driver-location-service"
 
+//LegacySecondsThreshold Stored timestamps lower than this value are Unix times in seconds (legacy data), the others in milliseconds
+const LegacySecondsThreshold int64 = 1e11
+
+//MigrationBatchSize Number of legacy timestamps moved to a driver timeline for each SSCAN call
+const MigrationBatchSize = 1000
+
+//Formats of the location times returned by getLocations
+const (
+	//TimeFormatRFC3339Nano RFC3339 with sub-second precision (default)
+	TimeFormatRFC3339Nano = "rfc3339nano"
+	//TimeFormatEpochMs Unix time in milliseconds
+	TimeFormatEpochMs = "epoch_ms"
+)
+
 //MaxReturnedElements Specifies how many elements can be returned in a Redis SORT request
 //DEPRECATED - Evaluated dynamically according to the requested time length
 //const MaxReturnedElements = 100
@@ -78,6 +165,11 @@ func init() {
 	//Updates Config global variable
 	Config = yamlConfig
 	//TODO: Checks for minimal informations in config file and provide default values
+	switch Config.Timestamps.Fallback {
+	case "", FallbackEnqueue, FallbackClamp, FallbackReject:
+	default:
+		log.Printf("Unknown timestamps fallback rule %v. Using %v", Config.Timestamps.Fallback, FallbackEnqueue)
+	}
 
 }
 
@@ -96,17 +188,30 @@ func (conf IniConfig) getConfFromYaml(fileName string) (result IniConfig, err er
 	return conf, nil
 }
 
+//toMillis Converts a stored timestamp to Unix time in milliseconds.
+//Data stored before millisecond precision was introduced uses Unix time in seconds
+func toMillis(ts int64) int64 {
+	if ts < LegacySecondsThreshold {
+		return ts * 1e3
+	}
+	return ts
+}
+
+//timestampAsISO Formats a stored timestamp (Unix time in ms, or in seconds for legacy data) as RFC3339 with sub-second precision
 func timestampAsISO(ts int64) (ISOstring string) {
-	t := time.Unix(ts, 0)
-	JavascriptISOString := "2006-01-02T15:04:05Z07:00" //same as time.RFC3339
-	ISOstring = t.UTC().Format(JavascriptISOString)
+	t := time.Unix(0, toMillis(ts)*1e6)
+	ISOstring = t.UTC().Format(time.RFC3339Nano)
 	return ISOstring
 }
 
 //newPool Creates a new Redis connection pool
 func newPool(addr string) *redis.Pool {
+	maxIdle := Config.Redis.MaxIdle
+	if maxIdle <= 0 {
+		maxIdle = DefaultRedisMaxIdle
+	}
 	p := &redis.Pool{
-		MaxIdle:     3,
+		MaxIdle:     maxIdle,
 		IdleTimeout: 240 * time.Second,
 		Dial: func() (redis.Conn, error) {
 			/*c, err := redis.Dial("tcp", addr)
@@ -117,7 +222,12 @@ func newPool(addr string) *redis.Pool {
 			log.Printf("Connected!")
 			return c, nil
 			*/
-			return redis.Dial("tcp", addr)
+			c, err := redis.Dial("tcp", addr)
+			if err != nil {
+				return nil, err
+			}
+			//Measures the latency of the commands
+			return &instrumentedConn{Conn: c}, nil
 		},
 	}
 	return p
@@ -125,27 +235,23 @@ func newPool(addr string) *redis.Pool {
 
 //getLocations Replies with an array of driver locations in the requested timespan
 func getLocations(c *gin.Context) {
-	//Reads minutes from querystring
-	var minutes string
-	minutes = c.DefaultQuery("minutes", "5")
-	min, err := strconv.ParseFloat(minutes, 64)
+	//Evaluate Now() timestamp (Unix time in ms)
+	now := time.Now().UnixNano() / 1e6
+	//Reads the requested window, page and format from the querystring
+	query, err := parseLocationsQuery(c, now, Config.Queries)
 	if err != nil {
-		//Sets the default values in case of erroneous input
-		min = DefaultMins
-	}
-	//Reads the distance flag from the querystring
-	var distanceReq string
-	wantsDistance := false //By default the distance computation is not required
-	distanceReq = c.DefaultQuery("distance", "false")
-	if distanceReq == "true" {
-		wantsDistance = true
+		badRequestReply := map[string]string{
+			"message": err.Error(),
+		}
+		c.IndentedJSON(http.StatusBadRequest, badRequestReply)
+		return
 	}
+	//Speeds and stats need the distances between locations
+	wantsDistance := query.wantsDistance || query.wantsSpeed || query.wantsStats
+	timeFormat := query.timeFormat
 	//Reads driverId from the path params
 	id := c.Param("id")
 	//Retrieves the eligible timestamps info from REDIS
-	//Evaluate Now() timestamp (Unix time)
-	now := time.Now().Unix()
-	//Gets a list of recorded timestamps for driver:id
 	if pool == nil {
 		//Pool not initialized (e.g. in unit tests). Provide a pool initialization
 		log.Println("Redis pool not initialized. Proceed with initialization")
@@ -153,79 +259,357 @@ func getLocations(c *gin.Context) {
 	}
 	conn := pool.Get()
 	defer conn.Close()
-	reply, err := redis.Int64s(conn.Do("SORT", fmt.Sprintf("driver:%v:timestamps", id), "LIMIT", 0, min*60, "DESC"))
+	//Moves the driver history stored by previous versions to its timeline (no-op when already done)
+	if _, err := migrateDriverTimeline(conn, id); err != nil {
+		log.Printf("Error in migrating the legacy timestamps of driver %v. %v", id, err)
+	}
+	//Gets the list of recorded timestamps for driver:id in the requested timespan, ordered by ASC
+	args := redis.Args{}.Add(fmt.Sprintf("driver:%v:timeline", id), query.min(), query.max())
+	if query.limit > 0 {
+		//One more timestamp tells if there is a next page
+		args = args.Add("LIMIT", 0, query.limit+1)
+	}
+	eligibleTimestamps, err := redis.Int64s(conn.Do("ZRANGEBYSCORE", args...))
 	if err != nil {
-		log.Printf("Error in processing SORT request. %v", err)
+		log.Printf("Error in processing ZRANGEBYSCORE request. %v", err)
 		c.String(http.StatusInternalServerError, "Ooops. Something went wrong on our side.")
 		return
 	}
-	log.Printf("Got timestamp list. %v", reply)
-	//Empty timestamp list? --> driver doesn't exist. Reply with 404 error
-	if len(reply) == 0 {
-		notFoundReply := map[string]string{
-			"message": "Driver not found",
+	log.Printf("Got timestamp list. %v", eligibleTimestamps)
+	if query.limit > 0 && len(eligibleTimestamps) > query.limit {
+		//There are more locations in the window. The cursor of the next page is the time of the last returned location
+		eligibleTimestamps = eligibleTimestamps[:query.limit]
+		c.Header(NextCursorHeader, encodeCursor(toMillis(eligibleTimestamps[query.limit-1])))
+	}
+	if len(eligibleTimestamps) == 0 {
+		//Empty timeline? --> driver doesn't exist. Reply with 404 error
+		count, err := redis.Int(conn.Do("ZCARD", fmt.Sprintf("driver:%v:timeline", id)))
+		if err != nil {
+			log.Printf("Error in processing ZCARD request. %v", err)
+			c.String(http.StatusInternalServerError, "Ooops. Something went wrong on our side.")
+			return
+		}
+		if count == 0 {
+			notFoundReply := map[string]string{
+				"message": "Driver not found",
+			}
+			c.IndentedJSON(http.StatusNotFound, notFoundReply)
+			return
 		}
-		c.IndentedJSON(http.StatusNotFound, notFoundReply)
-		return
 	}
-	eligibleTimestamps := make([]int64, 0)
-	for i := 0; i < len(reply); i++ {
-		timestamp := reply[i]
-		if float64(timestamp) >= float64(now)-(min*60) {
-			eligibleTimestamps = append(eligibleTimestamps, reply[i])
-		} else {
-			//Sorted array. There are no more interesting timestamps. Ends for cycle
-			i = len(reply)
+	//Reads the locations flagged as outliers at ingestion
+	rejected, err := readRejected(conn, id, eligibleTimestamps)
+	if err != nil {
+		log.Printf("Error in reading the rejected locations of driver %v. %v", id, err)
+	}
+	filtered := query.filter || query.smooth
+	for _, isRejected := range rejected {
+		filtered = filtered || isRejected
+	}
+	//Retrieves positions and deltas with a single pipeline (one round trip whatever the size of the timespan).
+	//Distances of filtered locations are computed from the accepted (and smoothed) positions instead
+	positions, deltas := readPositions(conn, id, eligibleTimestamps, wantsDistance && !filtered)
+	if filtered {
+		opts := filterSettings(Config.Filter)
+		times := make([]int64, len(eligibleTimestamps))
+		for i, ts := range eligibleTimestamps {
+			times[i] = toMillis(ts)
+		}
+		if query.filter {
+			rejectOutliers(positions, times, rejected, opts.MaxSpeed)
+		}
+		if query.smooth {
+			positions = smoothPositions(positions, times, rejected, opts.Accuracy, opts.ProcessNoise)
+		}
+		if wantsDistance {
+			deltas = filteredDeltas(positions, rejected)
 		}
 	}
+	var (
+		speeds    []float64
+		bearings  []*float64
+		elapsed   []float64
+		distances []float64
+	)
+	if query.wantsSpeed || query.wantsStats {
+		times := make([]int64, len(eligibleTimestamps))
+		for i, ts := range eligibleTimestamps {
+			times[i] = toMillis(ts)
+		}
+		speeds, bearings, elapsed, distances = segments(positions, times, rejected, deltas)
+	}
 	//Builds the response
 	response := make([]map[string]interface{}, 0)
-	var total float64 //total Holds the total distance that a driver made during "minutes"
+	var total float64 //total Holds the total distance that a driver made during the window (in the page)
 	total = 0
 	for i := 0; i < len(eligibleTimestamps); i++ {
-		//Since eligibleTimestamps is ordered by DESC and the response is ordered by ASC we use a decreasing cursor
-		j := len(eligibleTimestamps) - 1 - i
-		timestamp := eligibleTimestamps[j]
-		reply, err := redis.Positions(conn.Do("GEOPOS", fmt.Sprintf("driver:%v:log", id), timestamp))
-		if err != nil {
-			//Error in executing GEOPOS. Go on with next i
-			log.Printf("Error in processing GEOPOS request. %v", err)
-			log.Println("Going on to retrieve GEOPOS for other eligible timestamps")
+		timestamp := eligibleTimestamps[i]
+		if positions[i] == nil {
+			//No position for this timestamp. Go on with next i
+			log.Printf("No position found for timestamp %v", timestamp)
+			continue
+		}
+		//Position contains long and lat. Add them to response and round to 6 digits precision
+		newElement := make(map[string]interface{})
+		newElement["latitude"] = math.Floor(positions[i][1]*1e6) / 1e6
+		newElement["longitude"] = math.Floor(positions[i][0]*1e6) / 1e6
+		if timeFormat == TimeFormatEpochMs {
+			newElement["updated_at"] = toMillis(timestamp)
 		} else {
-			//Reply contains long and lat. Add them to response and round to 6 digits precision
-			newElement := make(map[string]interface{})
-			newElement["latitude"] = math.Floor(reply[0][1]*1e6) / 1e6
-			newElement["longitude"] = math.Floor(reply[0][0]*1e6) / 1e6
 			newElement["updated_at"] = timestampAsISO(timestamp)
-			//Check if it has to add distance and delta in the response
-			if wantsDistance {
-				//Evaluates the distance between eligibleTimestamps[j] and eligibleTimestamps[j-1]
-				var delta float64
-				if i == 0 {
-					//The first element is the start for evaluating deltas
-					delta = 0
-				} else {
-					//Retrieves delta
-					delta, err = redis.Float64(conn.Do("GEODIST", fmt.Sprintf("driver:%v:log", id), eligibleTimestamps[j], eligibleTimestamps[j+1], "m"))
-				}
-				//Updates total (if GEODIST calls gives an error, delta = 0)
-				total = total + delta
-				//Adds delta and total to the response
-				newElement["elapsedDistance"] = math.Floor(delta*1e3) / 1e3
-				newElement["cumulativeDistance"] = math.Floor(total*1e3) / 1e3
+		}
+		if rejected[i] {
+			//Outlier. Kept in the response but not used in distances
+			newElement["rejected"] = true
+		}
+		//Check if it has to add distance and delta in the response
+		if query.wantsDistance {
+			//deltas[i] is the distance between eligibleTimestamps[i] and eligibleTimestamps[i-1] (0 for the first element)
+			delta := deltas[i]
+			//Updates total (if GEODIST calls gives an error, delta = 0)
+			total = total + delta
+			//Adds delta and total to the response
+			newElement["elapsedDistance"] = math.Floor(delta*1e3) / 1e3
+			newElement["cumulativeDistance"] = math.Floor(total*1e3) / 1e3
+		}
+		//Check if it has to add the speed and the bearing from the previous location
+		if query.wantsSpeed {
+			newElement["speed"] = math.Floor(speeds[i]*1e3) / 1e3
+			newElement["speedKmh"] = math.Floor(speeds[i]*3.6*1e3) / 1e3
+			if bearings[i] != nil {
+				newElement["bearing"] = math.Floor(*bearings[i]*10) / 10
+			} else {
+				newElement["bearing"] = nil
 			}
-			//Updates response slice
-			response = append(response, newElement)
 		}
+		//Updates response slice
+		response = append(response, newElement)
+	}
+	if query.wantsStats {
+		//Wraps the locations with their stats
+		stationarySpeed := Config.Queries.StationarySpeed
+		if stationarySpeed <= 0 {
+			stationarySpeed = DefaultStationarySpeed
+		}
+		c.IndentedJSON(http.StatusOK, map[string]interface{}{
+			"locations": response,
+			"stats":     summarise(speeds, elapsed, distances, stationarySpeed),
+		})
+		return
 	}
 	//Sends the response
 	c.IndentedJSON(http.StatusOK, response)
 	return
 }
 
+//readPositions Retrieves the positions of driver id at the given timestamps with a single GEOPOS request and,
+//if wantsDistance, the distances between consecutive timestamps, pipelining the GEODIST requests in the same round trip.
+//positions[i] is nil when there is no position for timestamps[i]. deltas[i] is the distance (m) between timestamps[i-1]
+//and timestamps[i] (deltas[0] = 0, and 0 if GEODIST fails)
+func readPositions(conn redis.Conn, id string, timestamps []int64, wantsDistance bool) (positions []*[2]float64, deltas []float64) {
+	positions = make([]*[2]float64, len(timestamps))
+	deltas = make([]float64, len(timestamps))
+	if len(timestamps) == 0 {
+		return positions, deltas
+	}
+	logKey := fmt.Sprintf("driver:%v:log", id)
+	conn.Send("GEOPOS", redis.Args{}.Add(logKey).AddFlat(timestamps)...)
+	if wantsDistance {
+		for i := 1; i < len(timestamps); i++ {
+			conn.Send("GEODIST", logKey, timestamps[i], timestamps[i-1], "m")
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		log.Printf("Error in sending GEOPOS/GEODIST requests. %v", err)
+		return positions, deltas
+	}
+	reply, err := redis.Positions(conn.Receive())
+	if err != nil {
+		log.Printf("Error in processing GEOPOS request. %v", err)
+	} else {
+		copy(positions, reply)
+	}
+	if wantsDistance {
+		for i := 1; i < len(timestamps); i++ {
+			deltas[i], _ = redis.Float64(conn.Receive())
+		}
+	}
+	return positions, deltas
+}
+
+//locationsQuery describes the locations requested to getLocations
+type locationsQuery struct {
+	from          int64  //Start of the window (Unix time in ms, included)
+	to            int64  //End of the window (Unix time in ms, included). 0 means no upper bound
+	after         int64  //Cursor: time (Unix time in ms, excluded) of the last location of the previous page. 0 means first page
+	limit         int    //Maximum number of locations in the reply. 0 means no limit
+	wantsDistance bool   //Adds elapsed and cumulative distances to the reply
+	wantsSpeed    bool   //Adds speed and bearing to the reply
+	wantsStats    bool   //Wraps the reply with the stats of the locations
+	filter        bool   //Rejects the GPS outliers
+	smooth        bool   //Smooths the positions
+	timeFormat    string //Format of updated_at
+}
+
+//min Returns the lower bound of the window for ZRANGEBYSCORE. A cursor can't move it before from
+func (q locationsQuery) min() string {
+	if q.after >= q.from {
+		return "(" + strconv.FormatInt(q.after, 10)
+	}
+	return strconv.FormatInt(q.from, 10)
+}
+
+//max Returns the upper bound of the window for ZRANGEBYSCORE
+func (q locationsQuery) max() string {
+	if q.to > 0 {
+		return strconv.FormatInt(q.to, 10)
+	}
+	return "+inf"
+}
+
+//parseTime Parses a time given as a RFC3339 string or as a Unix time in ms
+func parseTime(value string) (int64, error) {
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil && ms >= 0 {
+		return ms, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return 0, err
+	}
+	return t.UnixNano() / 1e6, nil
+}
+
+//encodeCursor Encodes the time (Unix time in ms) of the last location of a page as an opaque cursor
+func encodeCursor(ts int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(ts, 10)))
+}
+
+//decodeCursor Returns the time (Unix time in ms) encoded in cursor
+func decodeCursor(cursor string) (int64, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+	ts, err := strconv.ParseInt(string(decoded), 10, 64)
+	if err != nil || ts <= 0 {
+		return 0, errors.New("cursor is not valid")
+	}
+	return ts, nil
+}
+
+//parseLocationsQuery Reads the querystring of getLocations. The window is given either relative to now (Unix time in ms)
+//with minutes, or with absolute from/to times. It can't be longer than opts.MaxWindow minutes.
+//The returned error explains which parameter is invalid
+func parseLocationsQuery(c *gin.Context, now int64, opts QueryOptions) (query locationsQuery, err error) {
+	maxWindow := opts.MaxWindow
+	if maxWindow <= 0 {
+		maxWindow = DefaultMaxWindow
+	}
+	maxLimit := opts.MaxLimit
+	if maxLimit <= 0 {
+		maxLimit = DefaultMaxLimit
+	}
+	minutes, isThereMinutes := c.GetQuery("minutes")
+	from, isThereFrom := c.GetQuery("from")
+	to, isThereTo := c.GetQuery("to")
+	//Window
+	switch {
+	case isThereMinutes && (isThereFrom || isThereTo):
+		return query, errors.New("minutes can't be used with from and to")
+	case isThereFrom:
+		if query.from, err = parseTime(from); err != nil {
+			return query, errors.New("from must be a RFC3339 time or a Unix time in ms")
+		}
+		if isThereTo {
+			if query.to, err = parseTime(to); err != nil {
+				return query, errors.New("to must be a RFC3339 time or a Unix time in ms")
+			}
+			if query.to < query.from {
+				return query, errors.New("from must be before to")
+			}
+		}
+	case isThereTo:
+		return query, errors.New("from is required with to")
+	default:
+		min := DefaultMins
+		if isThereMinutes {
+			min, err = strconv.ParseFloat(minutes, 64)
+			if err != nil || min <= 0 || math.IsInf(min, 0) {
+				return query, errors.New("minutes must be a positive number")
+			}
+		}
+		query.from = now - int64(min*60e3)
+	}
+	end := query.to
+	if end == 0 {
+		end = now
+	}
+	if end-query.from > int64(maxWindow)*60e3 {
+		return query, fmt.Errorf("the requested window is longer than %v minutes", maxWindow)
+	}
+	//Page
+	if limit, isThere := c.GetQuery("limit"); isThere {
+		query.limit, err = strconv.Atoi(limit)
+		if err != nil || query.limit < 1 || query.limit > maxLimit {
+			return query, fmt.Errorf("limit must be an integer between 1 and %v", maxLimit)
+		}
+	}
+	if cursor, isThere := c.GetQuery("cursor"); isThere {
+		if query.after, err = decodeCursor(cursor); err != nil {
+			return query, errors.New("cursor is not valid")
+		}
+	}
+	//Reads the distance flag from the querystring. By default the distance computation is not required
+	query.wantsDistance = c.DefaultQuery("distance", "false") == "true"
+	//Reads the speed and stats flags from the querystring
+	query.wantsSpeed = c.DefaultQuery("speed", "false") == "true"
+	query.wantsStats = c.DefaultQuery("stats", "false") == "true"
+	//Reads the outlier rejection and smoothing flags. By default they are the ones of the config file
+	query.filter = c.DefaultQuery("filter", strconv.FormatBool(Config.Filter.Query)) == "true"
+	query.smooth = c.DefaultQuery("smooth", strconv.FormatBool(Config.Filter.Smoothing)) == "true"
+	//Reads the format of the location times from the querystring
+	query.timeFormat = c.DefaultQuery("time_format", TimeFormatRFC3339Nano)
+	if query.timeFormat != TimeFormatRFC3339Nano && query.timeFormat != TimeFormatEpochMs {
+		return query, fmt.Errorf("time_format must be %v or %v", TimeFormatRFC3339Nano, TimeFormatEpochMs)
+	}
+	return query, nil
+}
+
+//Validation rules of a location message
+const (
+	//RuleMissingFields driverId, latitude and longitude are required
+	RuleMissingFields = "missing_fields"
+	//RuleNilValues driverId, latitude and longitude can't be null
+	RuleNilValues = "nil_values"
+	//RuleCoordinateType latitude and longitude are numbers
+	RuleCoordinateType = "coordinate_type"
+	//RuleIDType driverId is a string or a number
+	RuleIDType = "id_type"
+	//RuleRecordedAt recordedAt (optional) is a positive Unix time in ms
+	RuleRecordedAt = "recorded_at"
+	//RuleCoordinateRange latitude and longitude are in the range accepted by Redis GEOADD
+	RuleCoordinateRange = "coordinate_range"
+	//RuleEmptyID driverId can't be empty
+	RuleEmptyID = "empty_id"
+)
+
+//ValidationError tells which validation rule a location message doesn't follow
+type ValidationError struct {
+	Rule    string //Validation rule
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Rule, e.Message)
+}
+
+//validateInput Tells if a location message is valid
 func validateInput(input map[string]interface{}) bool {
-	//At the beginning the return value isValidated is set to "true"
-	isValidated := true
+	return validateMessage(input) == nil
+}
+
+//validateMessage Checks a location message. The returned *ValidationError tells the first rule that failed
+func validateMessage(input map[string]interface{}) error {
 	//1. Are there the necessary fields?
 	longitude, isThereLongitude := input["longitude"]
 	latitude, isThereLatitude := input["latitude"]
@@ -233,45 +617,160 @@ func validateInput(input map[string]interface{}) bool {
 	if !isThereLongitude || !isThereLatitude || !isThereID {
 		//Missing fields
 		log.Println("Missing fields")
-		isValidated = false
 		//Returns immediately to avoid missing fields parsing attempts
-		return isValidated
+		return &ValidationError{RuleMissingFields, "driverId, latitude and longitude are required"}
 	}
 	//2. Checks if the fields are ther with nil values
 	if id == nil || latitude == nil || longitude == nil {
 		log.Println("Some nil values")
-		isValidated = false
 		//Returns immediately to avoid nil fields parsing attempts
-		return isValidated
+		return &ValidationError{RuleNilValues, "driverId, latitude and longitude can't be null"}
 	}
 	//3. Fields are there. Check if they are correctly typed
 	//long/lat
 	if reflect.TypeOf(longitude).String() != "float64" || reflect.TypeOf(latitude).String() != "float64" {
 		log.Println("Wrong numeric type")
 		log.Printf("long: %v, lat: %v", reflect.TypeOf(longitude).String(), reflect.TypeOf(latitude).String())
-		isValidated = false
-		return isValidated
+		return &ValidationError{RuleCoordinateType, fmt.Sprintf("latitude and longitude must be numbers (got %v and %v)", reflect.TypeOf(latitude), reflect.TypeOf(longitude))}
 	}
 	//id
 	if !(reflect.TypeOf(id).String() == "string" || reflect.TypeOf(id).String() == "float64" || reflect.TypeOf(id).String() == "int") {
 		//for our use, id could be a string or a number  -> json.unmarshall parse numbers as float64. Int is kept for future possibilities
 		log.Println("Wrong id type")
-		isValidated = false
-		return isValidated
+		return &ValidationError{RuleIDType, fmt.Sprintf("driverId must be a string or a number (got %v)", reflect.TypeOf(id))}
 	}
-	//4. Check the emptyness/in range values only if the validation is true so far
-	if isValidated {
-		//Checks if the fields are not empty or have invalid values
-		if longitude.(float64) > 180 || longitude.(float64) < -180 || latitude.(float64) > 85.05112878 || latitude.(float64) < -85.05112878 || id == "" {
-			log.Println("Invalid value")
-			isValidated = false
-			return isValidated
+	//recordedAt (optional) is the Unix time (ms) when the device recorded the location
+	recordedAt, isThereRecordedAt := input["recordedAt"]
+	if isThereRecordedAt {
+		ts, ok := recordedAt.(float64)
+		if !ok || ts < 0 {
+			log.Println("Wrong recordedAt value")
+			return &ValidationError{RuleRecordedAt, fmt.Sprintf("recordedAt must be a positive Unix time in ms (got %v)", recordedAt)}
 		}
 	}
-	return isValidated
+	//4. Checks if the fields are not empty or have invalid values
+	if longitude.(float64) > 180 || longitude.(float64) < -180 || latitude.(float64) > 85.05112878 || latitude.(float64) < -85.05112878 {
+		log.Println("Invalid value")
+		return &ValidationError{RuleCoordinateRange, fmt.Sprintf("latitude %v or longitude %v is out of range", latitude, longitude)}
+	}
+	if id == "" {
+		log.Println("Invalid value")
+		return &ValidationError{RuleEmptyID, "driverId can't be empty"}
+	}
+	return nil
 }
 
-//persistMessageToRedis Saves a valid message to an appropriate set of key-values in Redis
+//persistScript Writes a location atomically: readers never see a timestamp without its position.
+//KEYS: on-course, driver:<id>:log, driver:<id>:timeline, drivers:last-seen, on-course:last-seen, driver:<id>:rejected.
+//ARGV: longitude, latitude, driver id, timestamp (Unix time in ms), last seen time (Unix time in ms),
+//speed (m/s) above which the location is a GPS outlier (0 doesn't look for outliers), number of previous locations read to find the last one that isn't an outlier.
+//An outlier is flagged instead of updating on-course, as well as a location older than the last one of the driver (redelivered or late message).
+//Redis doesn't roll back a failing script: the key types are checked before any write, and the driver log is written first
+//(invalid coordinates make the first write fail). It returns 1 if the location is an outlier, 0 otherwise
+var persistScript = redis.NewScript(6, fmt.Sprintf(`
+for _, key in ipairs(KEYS) do
+	local keyType = redis.call("TYPE", key)["ok"]
+	if keyType ~= "zset" and keyType ~= "none" then
+		return redis.error_reply("WRONGTYPE " .. key .. " is not a sorted set")
+	end
+end
+local longitude, latitude, timestamp, maxSpeed = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[4]), tonumber(ARGV[6])
+local outlier = 0
+if maxSpeed > 0 then
+	--Last location that isn't an outlier among the previous ones
+	local previous = redis.call("ZREVRANGEBYSCORE", KEYS[3], "(" .. ARGV[4], "-inf", "LIMIT", 0, ARGV[7])
+	local positions = {}
+	if #previous > 0 then
+		positions = redis.call("GEOPOS", KEYS[2], unpack(previous))
+	end
+	for i, member in ipairs(previous) do
+		if positions[i] and not redis.call("ZSCORE", KEYS[6], member) then
+			local previousTime = tonumber(member)
+			if previousTime < %[1]v then
+				previousTime = previousTime * 1000
+			end
+			--Haversine distance (same as GEODIST)
+			local rad = math.pi / 180
+			local lat1, lat2 = tonumber(positions[i][2]) * rad, latitude * rad
+			local dLat, dLon = lat2 - lat1, (longitude - tonumber(positions[i][1])) * rad
+			local h = math.sin(dLat / 2) ^ 2 + math.cos(lat1) * math.cos(lat2) * math.sin(dLon / 2) ^ 2
+			local distance = 2 * %[2]v * math.asin(math.sqrt(h))
+			local elapsed = math.abs(timestamp - previousTime) / 1000
+			if (elapsed == 0 and distance > maxSpeed) or (elapsed > 0 and distance / elapsed > maxSpeed) then
+				outlier = 1
+			end
+			break
+		end
+	end
+end
+redis.call("GEOADD", KEYS[2], ARGV[1], ARGV[2], ARGV[4])
+if outlier == 1 then
+	redis.call("ZADD", KEYS[6], ARGV[4], ARGV[4])
+elseif #redis.call("ZRANGEBYSCORE", KEYS[3], "(" .. ARGV[4], "+inf", "LIMIT", 0, 1) == 0 then
+	redis.call("GEOADD", KEYS[1], ARGV[1], ARGV[2], ARGV[3])
+end
+redis.call("ZADD", KEYS[3], ARGV[4], ARGV[4])
+redis.call("ZADD", KEYS[4], ARGV[5], ARGV[3])
+redis.call("ZADD", KEYS[5], ARGV[5], ARGV[3])
+return outlier
+`, LegacySecondsThreshold, EarthRadius))
+
+//persistArgs Returns the keys and arguments of persistScript for a valid message
+func persistArgs(message map[string]interface{}, lastSeen int64) redis.Args {
+	id := message["driverId"]
+	//Flags the location if it can't be reached from the previous one (GPS outlier). It is saved but not used as current position
+	maxSpeed := 0.0
+	if Config.Filter.Ingestion {
+		maxSpeed = filterSettings(Config.Filter).MaxSpeed
+	}
+	return redis.Args{}.Add("on-course", fmt.Sprintf("driver:%v:log", id), fmt.Sprintf("driver:%v:timeline", id), LastSeenKey, OnCourseLastSeenKey, rejectedKey(id)).
+		Add(message["longitude"], message["latitude"], id, message["timestamp"], lastSeen, maxSpeed, FilterLookback)
+}
+
+//persistLocations Saves a batch of valid messages to Redis with a single pipeline (one persistScript call per message, in order).
+//It returns the error of every message (nil if it has been persisted)
+func persistLocations(conn redis.Conn, messages []map[string]interface{}) []error {
+	errs := make([]error, len(messages))
+	//The last seen time is the time the driver has been seen for the last time
+	//(used to tell if the driver is online and to evict offline drivers from on-course)
+	lastSeen := time.Now().UnixNano() / 1e6
+	for retry := 0; retry < 2; retry++ {
+		for _, message := range messages {
+			persistScript.SendHash(conn, persistArgs(message, lastSeen)...)
+		}
+		if err := conn.Flush(); err != nil {
+			log.Printf("Error in saving a batch of %v locations: %v", len(messages), err)
+			for i := range errs {
+				errs[i] = err
+			}
+			return errs
+		}
+		missingScript := false
+		for i, message := range messages {
+			outlier, err := redis.Int(conn.Receive())
+			if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+				missingScript = true
+			} else if err != nil {
+				log.Printf("Error in saving the location of driver %v: %v", message["driverId"], err)
+			} else if outlier == 1 {
+				log.Printf("Location of driver %v at %v is an outlier", message["driverId"], message["timestamp"])
+			}
+			errs[i] = err
+		}
+		if !missingScript {
+			break
+		}
+		//Script not cached by Redis yet (e.g. after a restart). Writes are idempotent: the batch is sent again
+		if err := persistScript.Load(conn); err != nil {
+			log.Printf("Error in loading the location script: %v", err)
+			break
+		}
+	}
+	return errs
+}
+
+//persistMessageToRedis Saves a valid message to an appropriate set of key-values in Redis, with a single atomic script.
+//Writes are idempotent (members are the location timestamps): a redelivered message can be saved again without duplicates
 func persistMessageToRedis(message map[string]interface{}) error {
 	//Gets a connection from the Pool
 	if pool == nil {
@@ -285,76 +784,188 @@ func persistMessageToRedis(message map[string]interface{}) error {
 		log.Printf("Error in connecting to Redis: %v", conn.Err())
 		return conn.Err()
 	}
-	//Saves the instant position
-	writeErrors := make([]error, 0)
-	timestamp := message["timestamp"].(int64) //timestamp in Unix time
-	latitude := message["latitude"].(float64)
-	longitude := message["longitude"].(float64)
-	id := message["driverId"]
-	//On-course key. Adds the position of driver id
-	_, err := conn.Do("GEOADD", "on-course", longitude, latitude, id)
-	if err != nil {
-		writeErrors = append(writeErrors, err)
-		log.Printf("Error in saving on-course data with GEOADD: %v", err)
-	}
-	//driver:id:log key. Adds postion & timestamp
-	_, err = conn.Do("GEOADD", fmt.Sprintf("driver:%v:log", id), longitude, latitude, timestamp)
-	if err != nil {
-		writeErrors = append(writeErrors, err)
-		log.Printf("Error in saving driver log data with GEOADD: %v", err)
-	}
-	//dirver:id:timestamps. Adds the recorded timestamp to a list connected to driver:id
-	_, err = conn.Do("SADD", fmt.Sprintf("driver:%v:timestamps", id), timestamp)
-	if err != nil {
-		writeErrors = append(writeErrors, err)
-		log.Printf("Error in saving driver timestamp data with SADD: %v", err)
-	}
-	//Check if there have been errors in redis writes
-	if len(writeErrors) > 0 {
-		finalError := fmt.Errorf("There have been errors in redis writes: %v", writeErrors)
-		return finalError
+	if err := persistLocations(conn, []map[string]interface{}{message})[0]; err != nil {
+		return fmt.Errorf("There have been errors in redis writes: %v", err)
 	}
 	//Exits the method with no errors
 	log.Println("Message have been persisted successfully to Redis")
 	return nil
 }
 
+//migrateDriverTimeline Moves the timestamps of a driver from the legacy set driver:id:timestamps (SADD) to the
+//sorted set driver:id:timeline, scored by time (Unix time in ms). The legacy set is read in batches and deleted at the end.
+//Members are unchanged (they are the members of driver:id:log) so it is safe to run it more than once
+func migrateDriverTimeline(conn redis.Conn, id string) (migrated int, err error) {
+	legacyKey := fmt.Sprintf("driver:%v:timestamps", id)
+	exists, err := redis.Bool(conn.Do("EXISTS", legacyKey))
+	if err != nil || !exists {
+		return 0, err
+	}
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SSCAN", legacyKey, cursor, "COUNT", MigrationBatchSize))
+		if err != nil {
+			return migrated, err
+		}
+		var members []int64
+		if _, err = redis.Scan(values, &cursor, &members); err != nil {
+			return migrated, err
+		}
+		if len(members) > 0 {
+			args := redis.Args{}.Add(fmt.Sprintf("driver:%v:timeline", id))
+			for _, member := range members {
+				args = args.Add(toMillis(member), member)
+			}
+			if _, err = conn.Do("ZADD", args...); err != nil {
+				return migrated, err
+			}
+			migrated += len(members)
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	_, err = conn.Do("DEL", legacyKey)
+	return migrated, err
+}
+
+//migrateLegacyTimelines Looks for drivers whose history is stored with the legacy layout and migrates them
+func migrateLegacyTimelines() {
+	conn := pool.Get()
+	defer conn.Close()
+	drivers, timestamps := 0, 0
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", "driver:*:timestamps", "COUNT", MigrationBatchSize))
+		if err != nil {
+			log.Printf("Error in looking for legacy driver timestamps: %v", err)
+			return
+		}
+		var keys []string
+		if _, err = redis.Scan(values, &cursor, &keys); err != nil {
+			log.Printf("Error in looking for legacy driver timestamps: %v", err)
+			return
+		}
+		for _, key := range keys {
+			id := strings.TrimSuffix(strings.TrimPrefix(key, "driver:"), ":timestamps")
+			migrated, err := migrateDriverTimeline(conn, id)
+			if err != nil {
+				log.Printf("Error in migrating the legacy timestamps of driver %v: %v", id, err)
+				continue
+			}
+			drivers++
+			timestamps += migrated
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	if drivers > 0 {
+		log.Printf("Migrated %v timestamps of %v drivers to driver timelines", timestamps, drivers)
+	}
+}
+
 //handleMessage Handles what to do when a message from NSQ topic/channel is received
 func handleMessage(m *nsq.Message) error {
+	nsqMessagesReceived.Inc()
+	nsqHandlersInFlight.Inc()
+	defer nsqHandlersInFlight.Dec()
 	//log.Printf("Message received: %+v", *m)
 	log.Printf("Message body: %v", string(m.Body))
-	//Extracts the timestamp in Unix format
-	timestamp := m.Timestamp / 1e9
+	//Extracts the enqueue timestamp in Unix format (ms)
+	enqueuedAt := m.Timestamp / 1e6
 	//JSON is already validated by downstream service (Gateway). Unmarshal it in a generic map
 	var parsedMessage map[string]interface{}
 	err := json.Unmarshal(m.Body, &parsedMessage)
 	if err != nil {
-		//Wrong JSON decoding. Return nil to avoid requeuing.
+		//Wrong JSON decoding. Return nil to avoid requeuing, and keep it as a dead letter
 		log.Printf("Something went wrong while decoding the JSON message payload. %v", err)
+		deadLetter(m, ReasonInvalidJSON, err)
 		return nil
 	}
 	//Validate the input (message)
-	if !validateInput(parsedMessage) {
-		//Message hasn't valid format. Return nil to avoid requeuing.
-		log.Println("Message has not a valid structure and won't be persisted")
+	if err = validateMessage(parsedMessage); err != nil {
+		//Message hasn't valid format. Return nil to avoid requeuing, and keep it as a dead letter
+		log.Printf("Message has not a valid structure and won't be persisted: %v", err)
+		deadLetter(m, ReasonValidation, err)
+		return nil
+	}
+	//Input is validated. Add timestamp (device recorded time if provided and plausible) and send it to Redis
+	var recordedAt *int64
+	if v, isThere := parsedMessage["recordedAt"]; isThere {
+		ts := int64(v.(float64))
+		recordedAt = &ts
+	}
+	timestamp, source := resolveTimestamp(recordedAt, enqueuedAt, Config.Timestamps)
+	if source == TimestampRejected {
+		//Recorded time is out of the tolerated range and the fallback rule is "reject". Return nil to avoid requeuing.
+		log.Printf("Recorded time %v is out of the tolerated range (enqueued at %v). Message won't be persisted", *recordedAt, enqueuedAt)
+		deadLetter(m, ReasonTimestamp, fmt.Errorf("recorded time %v is out of the tolerated range (enqueued at %v)", *recordedAt, enqueuedAt))
 		return nil
 	}
-	//Input is validated. Add timestamp and send it to Redis
+	log.Printf("Location timestamp %v (source: %v)", timestamp, source)
 	parsedMessage["timestamp"] = timestamp
+	if writer != nil {
+		//The message is finished (or requeued) once its batch has been written
+		writer.add(m, parsedMessage)
+		return nil
+	}
 	err = persistMessageToRedis(parsedMessage)
 	if err != nil {
-		//Logs the error but doesn't return an error to the handler (fails silently and avoid requeing)
+		//Storage errors are transient (Redis down, timeout): the message is requeued with an exponential backoff.
+		//Persistence is idempotent, so a redelivered message doesn't create duplicates
 		log.Printf("An error occured while calling persistMessageToRedis: %v", err)
+		return requeueMessage(m, err, nsqSettings(Config.Nsq))
 	}
+	nsqMessages.WithLabelValues(ResultPersisted).Inc()
 	return nil
 }
 
+//resolveTimestamp Chooses the time (Unix time in ms) of a location. The device recorded time is used when it is
+//in the tolerated range around the NSQ enqueue time, otherwise the fallback rule of opts is applied.
+//source tells which time has been used (TimestampDevice, TimestampEnqueue, TimestampClamped or TimestampRejected)
+func resolveTimestamp(recordedAt *int64, enqueuedAt int64, opts TimestampOptions) (timestamp int64, source string) {
+	if recordedAt == nil {
+		//No device time. Use the NSQ enqueue time
+		return enqueuedAt, TimestampEnqueue
+	}
+	maxFutureSkew := opts.MaxFutureSkew
+	if maxFutureSkew <= 0 {
+		maxFutureSkew = DefaultMaxFutureSkew
+	}
+	maxAge := opts.MaxAge
+	if maxAge <= 0 {
+		maxAge = DefaultMaxAge
+	}
+	latest := enqueuedAt + int64(maxFutureSkew)*1e3
+	earliest := enqueuedAt - int64(maxAge)*1e3
+	if *recordedAt <= latest && *recordedAt >= earliest {
+		return *recordedAt, TimestampDevice
+	}
+	//Device time is out of range (e.g. wrong device clock)
+	switch opts.Fallback {
+	case FallbackReject:
+		return 0, TimestampRejected
+	case FallbackClamp:
+		if *recordedAt > latest {
+			return latest, TimestampClamped
+		}
+		return earliest, TimestampClamped
+	default:
+		return enqueuedAt, TimestampEnqueue
+	}
+}
+
 //poolNSQForMessages Pools messages from NSQ service
 func poolNSQForMessages() {
 	cfg := nsq.NewConfig()
 	cfg.DialTimeout = 10 * time.Second
 	cfg.UserAgent = fmt.Sprintf("driver-location/%s go-nsq/%s", "0.1", nsq.VERSION)
 	cfg.MaxInFlight = Config.Nsq.MaxInflight
+	//Messages are kept as dead letters by handleMessage after max-attempts deliveries. It is only a safety net
+	opts := nsqSettings(Config.Nsq)
+	cfg.MaxAttempts = uint16(opts.MaxAttempts)
+	cfg.MaxRequeueDelay = time.Duration(opts.MaxRequeueDelay) * time.Second
 	consumer, err := nsq.NewConsumer(Config.Nsq.Topic, Config.Nsq.ChannelName, cfg)
 	if err != nil {
 		log.Fatalf("A problem occurred in initializing NSQ Consumer: %v", err)
@@ -374,7 +985,16 @@ func poolNSQForMessages() {
 //setupRouter Defines the routes exposed by driver-location service
 func setupRouter() *gin.Engine {
 	router := gin.Default()
+	//Counts the requests and measures their latency
+	router.Use(metricsMiddleware)
+	router.GET("/drivers/nearby", getNearbyDrivers)
+	router.GET("/drivers/active", getActiveDrivers)
+	router.GET("/drivers/:id/status", getDriverStatus)
 	router.GET("/drivers/:id/locations", getLocations)
+	router.GET(AdminPathPrefix+"/retention", retentionStatsHandler)
+	router.GET(AdminPathPrefix+"/dead-letters", getDeadLetters)
+	router.POST(AdminPathPrefix+"/dead-letters/redrive", redriveDeadLetters)
+	router.GET(MetricsPath, metricsHandler)
 	return router
 }
 
@@ -395,6 +1015,15 @@ func main() {
 	//Creates a Redis pool and sets it to a module wide variable
 	pool = newPool(Config.Redis.Host)
 	log.Printf("Redis pool stats: %v", pool.Stats())
+	//Migrates the driver histories stored with the legacy layout
+	go migrateLegacyTimelines()
+	//Applies the retention policy in background
+	go retentionLoop(Config.Retention, Config.Presence)
+	//Creates the publisher of the rejected messages
+	deadLetters = newDeadLetterPublisher(Config.DeadLetter)
+	//Writes the locations in batches
+	writer = newBatchWriter(Config.Batch)
+	go writer.run()
 	//Starts to pool NSQ for location messages
 	poolNSQForMessages()
 	//Sets up the Gin framework router in a separate goroutine
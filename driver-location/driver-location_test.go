@@ -12,7 +12,10 @@ import (
 	"net/http/httptest"
 	"strconv"
 	"testing"
+	"time"
 
+	"github.com/gin-gonic/gin"
+	"github.com/gomodule/redigo/redis"
 	nsq "github.com/nsqio/go-nsq"
 	"github.com/stretchr/testify/assert"
 )
@@ -46,6 +49,9 @@ func Test_validateInput(t *testing.T) {
 		{"Wrong input with lat/long out of scale - long-", args{map[string]interface{}{"driverId": "aaa", "latitude": 78.00, "longitude": -181.001}}, false},
 		{"Wrong input with lat/long out of scale - lat&long +", args{map[string]interface{}{"driverId": "aaa", "latitude": 91.00, "longitude": 185.001}}, false},
 		{"Correct input with negative lat/long", args{map[string]interface{}{"driverId": "aaa", "latitude": -78.00, "longitude": 23.444}}, true},
+		{"Correct input with recordedAt", args{map[string]interface{}{"driverId": "aaa", "latitude": 22.000, "longitude": 23.444, "recordedAt": 1539850371000.0}}, true},
+		{"Wrong input with string recordedAt", args{map[string]interface{}{"driverId": "aaa", "latitude": 22.000, "longitude": 23.444, "recordedAt": "2018-10-18T08:12:51Z"}}, false},
+		{"Wrong input with negative recordedAt", args{map[string]interface{}{"driverId": "aaa", "latitude": 22.000, "longitude": 23.444, "recordedAt": -1.0}}, false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -67,6 +73,8 @@ func Test_timestampAsISO(t *testing.T) {
 	}{
 		//Test cases
 		{"Timestamp in Unix = 1539850371", args{1539850371}, "2018-10-18T08:12:51Z"},
+		{"Timestamp in Unix ms = 1539850371250", args{1539850371250}, "2018-10-18T08:12:51.25Z"},
+		{"Timestamp in Unix ms = 1539850371000", args{1539850371000}, "2018-10-18T08:12:51Z"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -77,6 +85,38 @@ func Test_timestampAsISO(t *testing.T) {
 	}
 }
 
+func Test_resolveTimestamp(t *testing.T) {
+	enqueuedAt := int64(1539850371000)
+	ts := func(v int64) *int64 { return &v }
+	opts := TimestampOptions{MaxFutureSkew: 10, MaxAge: 60}
+	tests := []struct {
+		name       string
+		recordedAt *int64
+		fallback   string
+		want       int64
+		wantSource string
+	}{
+		//Test cases
+		{"No recorded time", nil, "", enqueuedAt, TimestampEnqueue},
+		{"Recorded time in range", ts(enqueuedAt - 5000), "", enqueuedAt - 5000, TimestampDevice},
+		{"Recorded time slightly ahead", ts(enqueuedAt + 10000), "", enqueuedAt + 10000, TimestampDevice},
+		{"Recorded time in the future - enqueue", ts(enqueuedAt + 10001), FallbackEnqueue, enqueuedAt, TimestampEnqueue},
+		{"Recorded time too old - default", ts(enqueuedAt - 61000), "", enqueuedAt, TimestampEnqueue},
+		{"Recorded time in the future - clamp", ts(enqueuedAt + 50000), FallbackClamp, enqueuedAt + 10000, TimestampClamped},
+		{"Recorded time too old - clamp", ts(enqueuedAt - 3600000), FallbackClamp, enqueuedAt - 60000, TimestampClamped},
+		{"Recorded time too old - reject", ts(enqueuedAt - 3600000), FallbackReject, 0, TimestampRejected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts.Fallback = tt.fallback
+			got, source := resolveTimestamp(tt.recordedAt, enqueuedAt, opts)
+			if got != tt.want || source != tt.wantSource {
+				t.Errorf("resolveTimestamp() = %v, %v, want %v, %v", got, source, tt.want, tt.wantSource)
+			}
+		})
+	}
+}
+
 func Test_handleMessage(t *testing.T) {
 	var emptyBody []byte
 	var messageID nsq.MessageID
@@ -91,6 +131,7 @@ func Test_handleMessage(t *testing.T) {
 	}{
 		// Test cases.
 		{"Regular entry for test001", map[string]interface{}{"longitude": 2.364988, "latitude": 48.864193, "driverId": "test001"}, args{nsq.NewMessage(messageID, emptyBody)}, false},
+		{"Batched entry for test001", map[string]interface{}{"longitude": 2.364988, "latitude": 48.864193, "driverId": "test001", "recordedAt": time.Now().UnixNano() / 1e6}, args{nsq.NewMessage(messageID, emptyBody)}, false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -103,6 +144,29 @@ func Test_handleMessage(t *testing.T) {
 	}
 }
 
+func Test_persistMessageToRedisAtomic(t *testing.T) {
+	pool = newPool(Config.Redis.Host)
+	conn := pool.Get()
+	defer conn.Close()
+	conn.Do("DEL", "driver:atomic001:log", rejectedKey("atomic001"))
+	conn.Do("ZREM", "on-course", "atomic001")
+	conn.Do("ZREM", LastSeenKey, "atomic001")
+	//The timeline can't be written
+	conn.Do("SET", "driver:atomic001:timeline", "not a sorted set")
+	defer conn.Do("DEL", "driver:atomic001:timeline")
+	message := map[string]interface{}{"driverId": "atomic001", "latitude": 48.864193, "longitude": 2.364988, "timestamp": time.Now().UnixNano() / 1e6}
+	assert.NotNil(t, persistMessageToRedis(message))
+	//Nothing has been written
+	for _, key := range []string{"driver:atomic001:log", "on-course", LastSeenKey} {
+		member := "atomic001"
+		if key == "driver:atomic001:log" {
+			member = fmt.Sprint(message["timestamp"])
+		}
+		_, err := redis.Float64(conn.Do("ZSCORE", key, member))
+		assert.Equal(t, redis.ErrNil, err, "Testing "+key)
+	}
+}
+
 func TestGetLocationsRoute(t *testing.T) {
 	tests := []struct {
 		name             string
@@ -115,7 +179,7 @@ func TestGetLocationsRoute(t *testing.T) {
 		//Test Cases
 		{"5 mins and no distance", false, "6", "test001", http.StatusOK, "[]"},
 		{"5 mins and distance", true, "6", "test001", http.StatusOK, "[]"},
-		{"aaaa mins (defaults to 5) and distance", true, "aaaa", "test001", http.StatusOK, "[]"},
+		{"aaaa mins", false, "aaaa", "test001", http.StatusBadRequest, "[]"},
 		{"Not existing driverID", false, "6", "IDONTEXIST", http.StatusNotFound, "[]"},
 	}
 	for _, tt := range tests {
@@ -136,3 +200,218 @@ func TestGetLocationsRoute(t *testing.T) {
 		}
 	}
 }
+
+func TestGetLocationsRouteTimeFormat(t *testing.T) {
+	tests := []struct {
+		name         string
+		timeFormat   string
+		expectedCode int
+		expectedBody string
+	}{
+		//Test Cases
+		{"RFC3339 with sub-second precision", "rfc3339nano", http.StatusOK, "\"updated_at\": \""},
+		{"Unix time in ms", "epoch_ms", http.StatusOK, "\"updated_at\": 1"},
+		{"Unknown format", "unix", http.StatusBadRequest, "\"message\": \"time_format must be rfc3339nano or epoch_ms\""},
+	}
+	for _, tt := range tests {
+		router := setupRouter()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/drivers/test001/locations?minutes=6&time_format="+tt.timeFormat, nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, tt.expectedCode, w.Code, "Testing "+tt.name)
+		assert.Contains(t, w.Body.String(), tt.expectedBody, "Testing "+tt.name)
+	}
+}
+
+func Test_migrateDriverTimeline(t *testing.T) {
+	//Prepares the history of driver test002 with the legacy layout (timestamps in seconds in a set)
+	pool = newPool(Config.Redis.Host)
+	conn := pool.Get()
+	defer conn.Close()
+	now := time.Now().Unix()
+	conn.Do("DEL", "driver:test002:log", "driver:test002:timeline", "driver:test002:timestamps")
+	for i, ts := range []int64{now - 30, now - 20, now - 10} {
+		conn.Do("GEOADD", "driver:test002:log", 2.364988+float64(i)*1e-3, 48.864193, ts)
+		conn.Do("SADD", "driver:test002:timestamps", ts)
+	}
+	//Locations are returned as before, from the oldest to the newest
+	router := setupRouter()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/drivers/test002/locations?minutes=1&time_format=epoch_ms", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var locations []map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &locations)
+	if assert.Equal(t, 3, len(locations)) {
+		assert.Equal(t, float64((now-30)*1e3), locations[0]["updated_at"])
+		assert.Equal(t, float64((now-10)*1e3), locations[2]["updated_at"])
+	}
+	//History has been moved to the timeline
+	exists, _ := redis.Bool(conn.Do("EXISTS", "driver:test002:timestamps"))
+	assert.False(t, exists)
+	count, _ := redis.Int(conn.Do("ZCARD", "driver:test002:timeline"))
+	assert.Equal(t, 3, count)
+	//Migrating twice is harmless
+	migrated, err := migrateDriverTimeline(conn, "test002")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, migrated)
+}
+
+//saveTestHistory Saves n locations of driver id, one every 5 seconds up to now, and returns their timestamps (ms)
+func saveTestHistory(conn redis.Conn, id string, n int) []int64 {
+	conn.Do("DEL", fmt.Sprintf("driver:%v:log", id), fmt.Sprintf("driver:%v:timeline", id))
+	now := time.Now().UnixNano() / 1e6
+	timestamps := make([]int64, n)
+	for i := 0; i < n; i++ {
+		ts := now - int64(n-i)*5e3
+		conn.Do("GEOADD", fmt.Sprintf("driver:%v:log", id), 2.364988+float64(i)*1e-4, 48.864193, ts)
+		conn.Do("ZADD", fmt.Sprintf("driver:%v:timeline", id), ts, ts)
+		timestamps[i] = ts
+	}
+	return timestamps
+}
+
+//readPositionsSequential Retrieves positions and deltas with one round trip per request (as before pipelining),
+//to be compared with readPositions
+func readPositionsSequential(conn redis.Conn, id string, timestamps []int64, wantsDistance bool) (positions []*[2]float64, deltas []float64) {
+	positions = make([]*[2]float64, len(timestamps))
+	deltas = make([]float64, len(timestamps))
+	for i, ts := range timestamps {
+		reply, err := redis.Positions(conn.Do("GEOPOS", fmt.Sprintf("driver:%v:log", id), ts))
+		if err == nil {
+			positions[i] = reply[0]
+		}
+		if wantsDistance && i > 0 {
+			deltas[i], _ = redis.Float64(conn.Do("GEODIST", fmt.Sprintf("driver:%v:log", id), ts, timestamps[i-1], "m"))
+		}
+	}
+	return positions, deltas
+}
+
+func Test_readPositions(t *testing.T) {
+	pool = newPool(Config.Redis.Host)
+	conn := pool.Get()
+	defer conn.Close()
+	timestamps := saveTestHistory(conn, "test003", 10)
+	//Adds a timestamp without position
+	timestamps = append(timestamps, timestamps[9]+1)
+	positions, deltas := readPositions(conn, "test003", timestamps, true)
+	wantPositions, wantDeltas := readPositionsSequential(conn, "test003", timestamps, true)
+	assert.Equal(t, wantPositions, positions)
+	assert.Equal(t, wantDeltas, deltas)
+	assert.Nil(t, positions[10])
+	assert.True(t, deltas[1] > 0)
+	//No distance required
+	_, deltas = readPositions(conn, "test003", timestamps, false)
+	assert.Equal(t, make([]float64, len(timestamps)), deltas)
+}
+
+func BenchmarkReadPositions(b *testing.B) {
+	pool = newPool(Config.Redis.Host)
+	conn := pool.Get()
+	defer conn.Close()
+	//5 minutes at 5 seconds reporting
+	timestamps := saveTestHistory(conn, "test004", 60)
+	b.Run("pipelined", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			readPositions(conn, "test004", timestamps, true)
+		}
+	})
+	b.Run("sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			readPositionsSequential(conn, "test004", timestamps, true)
+		}
+	})
+}
+
+func Test_parseLocationsQuery(t *testing.T) {
+	now := int64(1540389600000) //2018-10-24T14:00:00Z
+	opts := QueryOptions{MaxWindow: 60, MaxLimit: 100}
+	//No outlier rejection nor smoothing by default
+	filter := Config.Filter
+	Config.Filter = FilterOptions{}
+	defer func() { Config.Filter = filter }()
+	tests := []struct {
+		name        string
+		querystring string
+		want        locationsQuery
+		wantErr     string
+	}{
+		//Test cases
+		{"Default window", "", locationsQuery{from: now - 5*60e3, timeFormat: TimeFormatRFC3339Nano}, ""},
+		{"Minutes and distance", "minutes=10&distance=true", locationsQuery{from: now - 10*60e3, wantsDistance: true, timeFormat: TimeFormatRFC3339Nano}, ""},
+		{"RFC3339 range", "from=2018-10-24T13:30:00Z&to=2018-10-24T13:45:00.5Z", locationsQuery{from: now - 30*60e3, to: now - 15*60e3 + 500, timeFormat: TimeFormatRFC3339Nano}, ""},
+		{"Unix ms range", "from=1540387800000&to=1540388700000", locationsQuery{from: now - 30*60e3, to: now - 15*60e3, timeFormat: TimeFormatRFC3339Nano}, ""},
+		{"From up to now", "from=2018-10-24T13:30:00Z", locationsQuery{from: now - 30*60e3, timeFormat: TimeFormatRFC3339Nano}, ""},
+		{"Page", "minutes=10&limit=20&cursor=" + encodeCursor(now-60e3), locationsQuery{from: now - 10*60e3, after: now - 60e3, limit: 20, timeFormat: TimeFormatRFC3339Nano}, ""},
+		{"Not a number", "minutes=aaaa", locationsQuery{}, "minutes must be a positive number"},
+		{"Negative minutes", "minutes=-5", locationsQuery{}, "minutes must be a positive number"},
+		{"Minutes and range", "minutes=5&from=2018-10-24T13:30:00Z", locationsQuery{}, "minutes can't be used with from and to"},
+		{"Invalid from", "from=yesterday", locationsQuery{}, "from must be a RFC3339 time or a Unix time in ms"},
+		{"Invalid to", "from=2018-10-24T13:30:00Z&to=now", locationsQuery{}, "to must be a RFC3339 time or a Unix time in ms"},
+		{"To without from", "to=2018-10-24T13:30:00Z", locationsQuery{}, "from is required with to"},
+		{"Reversed range", "from=2018-10-24T13:45:00Z&to=2018-10-24T13:30:00Z", locationsQuery{}, "from must be before to"},
+		{"Window too long", "minutes=61", locationsQuery{}, "the requested window is longer than 60 minutes"},
+		{"Range too long", "from=2018-10-23T13:30:00Z&to=2018-10-23T15:30:00Z", locationsQuery{}, "the requested window is longer than 60 minutes"},
+		{"Limit too high", "limit=101", locationsQuery{}, "limit must be an integer between 1 and 100"},
+		{"Limit not a number", "limit=ten", locationsQuery{}, "limit must be an integer between 1 and 100"},
+		{"Invalid cursor", "limit=10&cursor=1234", locationsQuery{}, "cursor is not valid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request, _ = http.NewRequest("GET", "/drivers/test001/locations?"+tt.querystring, nil)
+			got, err := parseLocationsQuery(c, now, opts)
+			if tt.wantErr != "" {
+				if assert.NotNil(t, err) {
+					assert.Equal(t, tt.wantErr, err.Error())
+				}
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestGetLocationsRoutePages(t *testing.T) {
+	pool = newPool(Config.Redis.Host)
+	conn := pool.Get()
+	timestamps := saveTestHistory(conn, "test007", 25)
+	conn.Close()
+	router := setupRouter()
+	//Walks the history 10 locations at a time
+	got := make([]int64, 0)
+	cursor := ""
+	for page := 0; page < 5; page++ {
+		w := httptest.NewRecorder()
+		querystring := fmt.Sprintf("from=%v&limit=10&time_format=epoch_ms", timestamps[0])
+		if cursor != "" {
+			querystring += "&cursor=" + cursor
+		}
+		req, _ := http.NewRequest("GET", "/drivers/test007/locations?"+querystring, nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var locations []map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &locations)
+		for _, location := range locations {
+			got = append(got, int64(location["updated_at"].(float64)))
+		}
+		cursor = w.Header().Get(NextCursorHeader)
+		if cursor == "" {
+			break
+		}
+	}
+	assert.Equal(t, timestamps, got)
+	//A cursor older than the window doesn't give the locations before from
+	w := httptest.NewRecorder()
+	querystring := fmt.Sprintf("from=%v&limit=10&time_format=epoch_ms&cursor=%v", timestamps[20], encodeCursor(1))
+	req, _ := http.NewRequest("GET", "/drivers/test007/locations?"+querystring, nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var locations []map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &locations)
+	if assert.Equal(t, 5, len(locations)) {
+		assert.Equal(t, float64(timestamps[20]), locations[0]["updated_at"])
+	}
+}
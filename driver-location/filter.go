@@ -0,0 +1,181 @@
+/*
+Driver location service for Zombie test.
+
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+//FilterOptions describes how GPS outliers are rejected and how locations are smoothed
+type FilterOptions struct {
+	Ingestion    bool    `yaml:"ingestion,omitempty"`     //Flags the outliers when the locations are received
+	Query        bool    `yaml:"query,omitempty"`         //Rejects the outliers in getLocations by default (filter querystring parameter)
+	Smoothing    bool    `yaml:"smoothing,omitempty"`     //Smooths the locations in getLocations by default (smooth querystring parameter)
+	MaxSpeed     float64 `yaml:"max-speed,omitempty"`     //Speed (in m/s) above which a location is an outlier
+	Accuracy     float64 `yaml:"accuracy,omitempty"`      //Kalman filter: accuracy (in meters) of the GPS fixes
+	ProcessNoise float64 `yaml:"process-noise,omitempty"` //Kalman filter: how fast (in m/s) the actual position is expected to drift from the estimate
+}
+
+//DefaultFilterMaxSpeed Default speed (in m/s, 252 km/h) above which a location is an outlier
+const DefaultFilterMaxSpeed = 70
+
+//DefaultFilterAccuracy Default accuracy (in meters) of the GPS fixes
+const DefaultFilterAccuracy = 10
+
+//DefaultFilterProcessNoise Default drift (in m/s) of the actual position from the Kalman estimate
+const DefaultFilterProcessNoise = 3
+
+//FilterLookback Number of previous locations read at ingestion (persistScript) to find the last location that isn't an outlier
+const FilterLookback = 5
+
+//EarthRadius Earth radius (in meters) used by the haversine formula. It is the one used by Redis GEODIST
+const EarthRadius = 6372797.560856
+
+//filterSettings Returns opts with default values for the missing settings
+func filterSettings(opts FilterOptions) FilterOptions {
+	if opts.MaxSpeed <= 0 {
+		opts.MaxSpeed = DefaultFilterMaxSpeed
+	}
+	if opts.Accuracy <= 0 {
+		opts.Accuracy = DefaultFilterAccuracy
+	}
+	if opts.ProcessNoise <= 0 {
+		opts.ProcessNoise = DefaultFilterProcessNoise
+	}
+	return opts
+}
+
+//rejectedKey Returns the key of the sorted set of the locations of driver id flagged as outliers at ingestion (member and score: timestamp)
+func rejectedKey(id interface{}) string {
+	return fmt.Sprintf("driver:%v:rejected", id)
+}
+
+//haversine Returns the distance (in meters) between two positions (longitude, latitude)
+func haversine(a, b [2]float64) float64 {
+	lat1 := a[1] * math.Pi / 180
+	lat2 := b[1] * math.Pi / 180
+	dLat := lat2 - lat1
+	dLon := (b[0] - a[0]) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * EarthRadius * math.Asin(math.Sqrt(h))
+}
+
+//isSpeedJump Tells if going from a (at time ta, Unix time in ms) to b (at time tb) needs a speed higher than maxSpeed (m/s)
+func isSpeedJump(a [2]float64, ta int64, b [2]float64, tb int64, maxSpeed float64) bool {
+	distance := haversine(a, b)
+	elapsed := math.Abs(float64(tb-ta)) / 1e3
+	if elapsed == 0 {
+		//Two places at the same time. A few meters are GPS noise
+		return distance > maxSpeed
+	}
+	return distance/elapsed > maxSpeed
+}
+
+//rejectOutliers Flags the positions that can't be reached from the previous accepted one without going faster than maxSpeed (m/s).
+//positions are ordered by time (timestamps, Unix time in ms). Positions already flagged (e.g. at ingestion) and missing positions (nil)
+//are skipped. The first position is flagged when it disagrees with the next one and the next one agrees with the following one
+func rejectOutliers(positions []*[2]float64, timestamps []int64, rejected []bool, maxSpeed float64) {
+	accepted := make([]int, 0, len(positions))
+	for i, position := range positions {
+		if position != nil && !rejected[i] {
+			accepted = append(accepted, i)
+		}
+	}
+	if len(accepted) >= 3 {
+		first, second, third := accepted[0], accepted[1], accepted[2]
+		if isSpeedJump(*positions[first], timestamps[first], *positions[second], timestamps[second], maxSpeed) &&
+			!isSpeedJump(*positions[second], timestamps[second], *positions[third], timestamps[third], maxSpeed) {
+			rejected[first] = true
+			accepted = accepted[1:]
+		}
+	}
+	if len(accepted) == 0 {
+		return
+	}
+	last := accepted[0]
+	for _, i := range accepted[1:] {
+		if isSpeedJump(*positions[last], timestamps[last], *positions[i], timestamps[i], maxSpeed) {
+			rejected[i] = true
+			continue
+		}
+		last = i
+	}
+}
+
+//smoothPositions Applies a Kalman filter to the accepted positions (ordered by time, timestamps in Unix time in ms) and returns
+//the smoothed positions. accuracy is the accuracy (m) of the fixes, processNoise how fast (m/s) the position drifts from the estimate
+func smoothPositions(positions []*[2]float64, timestamps []int64, rejected []bool, accuracy, processNoise float64) []*[2]float64 {
+	smoothed := make([]*[2]float64, len(positions))
+	var (
+		estimate [2]float64
+		variance float64 //Variance (m²) of the estimate. A negative value means no estimate yet
+		lastTime int64
+	)
+	variance = -1
+	for i, position := range positions {
+		if position == nil || rejected[i] {
+			smoothed[i] = position
+			continue
+		}
+		if variance < 0 {
+			estimate = *position
+			variance = accuracy * accuracy
+		} else {
+			//Prediction: the position may have drifted since the last fix
+			if elapsed := float64(timestamps[i]-lastTime) / 1e3; elapsed > 0 {
+				variance += elapsed * processNoise * processNoise
+			}
+			//Correction
+			gain := variance / (variance + accuracy*accuracy)
+			estimate[0] += gain * (position[0] - estimate[0])
+			estimate[1] += gain * (position[1] - estimate[1])
+			variance = (1 - gain) * variance
+		}
+		lastTime = timestamps[i]
+		value := estimate
+		smoothed[i] = &value
+	}
+	return smoothed
+}
+
+//filteredDeltas Returns the distances (m) between each accepted position and the previous accepted one (0 for the rejected and missing ones)
+func filteredDeltas(positions []*[2]float64, rejected []bool) []float64 {
+	deltas := make([]float64, len(positions))
+	var last *[2]float64
+	for i, position := range positions {
+		if position == nil || rejected[i] {
+			continue
+		}
+		if last != nil {
+			deltas[i] = haversine(*last, *position)
+		}
+		last = position
+	}
+	return deltas
+}
+
+//readRejected Returns which timestamps of driver id have been flagged as outliers at ingestion
+func readRejected(conn redis.Conn, id string, timestamps []int64) ([]bool, error) {
+	rejected := make([]bool, len(timestamps))
+	if len(timestamps) == 0 {
+		return rejected, nil
+	}
+	flagged, err := redis.Int64s(conn.Do("ZRANGEBYSCORE", rejectedKey(id), toMillis(timestamps[0]), toMillis(timestamps[len(timestamps)-1])))
+	if err != nil {
+		return rejected, err
+	}
+	isFlagged := make(map[int64]bool, len(flagged))
+	for _, ts := range flagged {
+		isFlagged[ts] = true
+	}
+	for i, ts := range timestamps {
+		rejected[i] = isFlagged[ts]
+	}
+	return rejected, nil
+}
@@ -0,0 +1,185 @@
+/*
+Driver location service for Zombie test.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+//testPositions Returns positions (one every 5 seconds from Unix time 1540389600000 ms) moving east by ~7 meters at a time.
+//The positions at the indexes of jumps are moved ~5 km north
+func testPositions(n int, jumps ...int) (positions []*[2]float64, timestamps []int64) {
+	positions = make([]*[2]float64, n)
+	timestamps = make([]int64, n)
+	for i := 0; i < n; i++ {
+		positions[i] = &[2]float64{2.364988 + float64(i)*1e-4, 48.864193}
+		timestamps[i] = 1540389600000 + int64(i)*5e3
+	}
+	for _, i := range jumps {
+		positions[i][1] += 0.045
+	}
+	return positions, timestamps
+}
+
+func Test_rejectOutliers(t *testing.T) {
+	tests := []struct {
+		name     string
+		n        int
+		jumps    []int
+		missing  []int
+		flagged  []int
+		expected []bool
+	}{
+		//Test cases
+		{"No outlier", 4, nil, nil, nil, []bool{false, false, false, false}},
+		{"Single jump", 5, []int{2}, nil, nil, []bool{false, false, true, false, false}},
+		{"Two jumps in a row", 5, []int{2, 3}, nil, nil, []bool{false, false, true, true, false}},
+		{"First location is an outlier", 4, []int{0}, nil, nil, []bool{true, false, false, false}},
+		{"Last location is an outlier", 4, []int{3}, nil, nil, []bool{false, false, false, true}},
+		{"Missing position", 4, []int{2}, []int{1}, nil, []bool{false, false, true, false}},
+		{"Flagged at ingestion", 4, []int{2}, nil, []int{2}, []bool{false, false, true, false}},
+	}
+	for _, tt := range tests {
+		positions, timestamps := testPositions(tt.n, tt.jumps...)
+		for _, i := range tt.missing {
+			positions[i] = nil
+		}
+		rejected := make([]bool, tt.n)
+		for _, i := range tt.flagged {
+			rejected[i] = true
+		}
+		rejectOutliers(positions, timestamps, rejected, DefaultFilterMaxSpeed)
+		assert.Equal(t, tt.expected, rejected, "Testing "+tt.name)
+	}
+}
+
+func Test_smoothPositions(t *testing.T) {
+	//Parked driver with a GPS jitter of ~10 meters
+	positions, timestamps := testPositions(20)
+	for i, position := range positions {
+		position[0] = 2.364988 + float64(i%2)*1.4e-4
+	}
+	rejected := make([]bool, len(positions))
+	smoothed := smoothPositions(positions, timestamps, rejected, DefaultFilterAccuracy, DefaultFilterProcessNoise)
+	assert.Equal(t, *positions[0], *smoothed[0])
+	rawDistance, smoothedDistance := 0.0, 0.0
+	for _, delta := range filteredDeltas(positions, rejected) {
+		rawDistance += delta
+	}
+	for _, delta := range filteredDeltas(smoothed, rejected) {
+		smoothedDistance += delta
+	}
+	assert.InDelta(t, 19*10.3, rawDistance, 2)
+	assert.True(t, smoothedDistance < rawDistance/2, "Smoothed distance %v, raw distance %v", smoothedDistance, rawDistance)
+	//Rejected positions are not smoothed and don't move the estimate
+	rejected[5] = true
+	positions[5][1] += 0.045
+	smoothed = smoothPositions(positions, timestamps, rejected, DefaultFilterAccuracy, DefaultFilterProcessNoise)
+	assert.Equal(t, positions[5], smoothed[5])
+	assert.InDelta(t, 48.864193, smoothed[6][1], 1e-6)
+}
+
+func Test_haversine(t *testing.T) {
+	pool = newPool(Config.Redis.Host)
+	conn := pool.Get()
+	defer conn.Close()
+	//Same distance as GEODIST
+	conn.Do("GEOADD", "test:haversine", 2.363717, 48.867465, "republique", 2.369068, 48.853196, "bastille")
+	expected, _ := redis.Float64(conn.Do("GEODIST", "test:haversine", "republique", "bastille", "m"))
+	conn.Do("DEL", "test:haversine")
+	assert.InDelta(t, expected, haversine([2]float64{2.363717, 48.867465}, [2]float64{2.369068, 48.853196}), 1)
+}
+
+func TestGetLocationsRouteFilter(t *testing.T) {
+	pool = newPool(Config.Redis.Host)
+	conn := pool.Get()
+	defer conn.Close()
+	timestamps := saveTestHistory(conn, "filter001", 6)
+	conn.Do("DEL", rejectedKey("filter001"))
+	//GPS jump of ~5 km
+	conn.Do("GEOADD", "driver:filter001:log", 2.364988+3e-4, 48.864193+0.045, timestamps[3])
+	router := setupRouter()
+	tests := []struct {
+		name             string
+		querystring      string
+		expectedRejected []bool
+		maxDistance      float64
+		minDistance      float64
+	}{
+		//Test cases
+		{"Raw locations", "&filter=false", []bool{false, false, false, false, false, false}, 20000, 9000},
+		{"Filtered locations", "&filter=true", []bool{false, false, false, true, false, false}, 40, 30},
+		{"Filtered and smoothed locations", "&filter=true&smooth=true", []bool{false, false, false, true, false, false}, 40, 10},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", fmt.Sprintf("/drivers/filter001/locations?from=%v&distance=true%v", timestamps[0], tt.querystring), nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code, "Testing "+tt.name)
+		var locations []map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &locations)
+		if !assert.Equal(t, len(tt.expectedRejected), len(locations), "Testing "+tt.name) {
+			continue
+		}
+		for i, location := range locations {
+			_, isThere := location["rejected"]
+			assert.Equal(t, tt.expectedRejected[i], isThere, "Testing %v, location %v", tt.name, i)
+		}
+		distance := locations[len(locations)-1]["cumulativeDistance"].(float64)
+		assert.True(t, distance >= tt.minDistance && distance <= tt.maxDistance, "Testing %v: distance %v", tt.name, distance)
+	}
+}
+
+func Test_persistMessageToRedisFilter(t *testing.T) {
+	pool = newPool(Config.Redis.Host)
+	conn := pool.Get()
+	defer conn.Close()
+	filter := Config.Filter
+	Config.Filter = FilterOptions{Ingestion: true}
+	defer func() { Config.Filter = filter }()
+	conn.Do("DEL", "driver:filter002:log", "driver:filter002:timeline", rejectedKey("filter002"))
+	conn.Do("ZREM", "on-course", "filter002")
+	now := time.Now().UnixNano() / 1e6
+	positions, _ := testPositions(4, 2)
+	for i, position := range positions {
+		message := map[string]interface{}{
+			"driverId":  "filter002",
+			"longitude": position[0],
+			"latitude":  position[1],
+			"timestamp": now - int64(4-i)*5e3,
+		}
+		assert.Nil(t, persistMessageToRedis(message))
+	}
+	//The outlier is saved and flagged
+	count, _ := redis.Int(conn.Do("ZCARD", "driver:filter002:timeline"))
+	assert.Equal(t, 4, count)
+	flagged, _ := redis.Int64s(conn.Do("ZRANGE", rejectedKey("filter002"), 0, -1))
+	assert.Equal(t, []int64{now - 2*5e3}, flagged)
+	//The current position is the last location that isn't an outlier
+	current, _ := redis.Positions(conn.Do("GEOPOS", "on-course", "filter002"))
+	if assert.NotNil(t, current[0]) {
+		assert.InDelta(t, positions[3][1], current[0][1], 1e-5)
+	}
+	//The flag is returned by getLocations, even without query time filtering
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/drivers/filter002/locations?from=%v&distance=true", now-30e3), nil)
+	setupRouter().ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var locations []map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &locations)
+	if assert.Equal(t, 4, len(locations)) {
+		assert.Equal(t, true, locations[2]["rejected"])
+		assert.Equal(t, 0.0, locations[2]["elapsedDistance"])
+	}
+}
@@ -0,0 +1,100 @@
+/*
+Driver location service for Zombie test.
+
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"testing"
+
+	nsq "github.com/nsqio/go-nsq"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+//scrapeMetrics Returns the metrics exposed by router
+func scrapeMetrics(router http.Handler) string {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", MetricsPath, nil)
+	router.ServeHTTP(w, req)
+	return w.Body.String()
+}
+
+//metricValue Returns the value of a sample (name with labels) in the scraped metrics, -1 if it isn't there
+func metricValue(metrics, sample string) float64 {
+	match := regexp.MustCompile("(?m)^" + regexp.QuoteMeta(sample) + " (.+)$").FindStringSubmatch(metrics)
+	if match == nil {
+		return -1
+	}
+	value, _ := strconv.ParseFloat(match[1], 64)
+	return value
+}
+
+func TestMetricsRoute(t *testing.T) {
+	pool = newPool(Config.Redis.Host)
+	router := setupRouter()
+	before := scrapeMetrics(router)
+	//Commands sent one at a time and pipelined
+	conn := pool.Get()
+	_, err := conn.Do("PING")
+	assert.Nil(t, err)
+	conn.Send("ECHO", "a")
+	conn.Send("ECHO", "b")
+	conn.Flush()
+	conn.Receive()
+	conn.Receive()
+	conn.Do("NOTACOMMAND")
+	conn.Close()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/drivers/metrics001/locations?minutes=abc", nil)
+	router.ServeHTTP(w, req)
+	after := scrapeMetrics(router)
+	tests := []struct {
+		name     string
+		sample   string
+		expected float64
+	}{
+		//Test cases
+		{"Redis command", `driver_location_redis_command_duration_seconds_count{command="PING"}`, 1},
+		{"Pipelined Redis commands", `driver_location_redis_command_duration_seconds_count{command="ECHO"}`, 2},
+		{"Redis error", `driver_location_redis_command_errors_total{command="NOTACOMMAND"}`, 1},
+		{"HTTP request", `driver_location_http_requests_total{method="GET",route="/drivers/:id/locations",status="400"}`, 1},
+		{"HTTP latency", `driver_location_http_request_duration_seconds_count{method="GET",route="/drivers/:id/locations"}`, 1},
+	}
+	for _, tt := range tests {
+		previous := metricValue(before, tt.sample)
+		if previous < 0 {
+			previous = 0
+		}
+		assert.Equal(t, tt.expected, metricValue(after, tt.sample)-previous, "Testing "+tt.name)
+	}
+	//Pool stats
+	assert.True(t, metricValue(after, "driver_location_redis_pool_idle_connections") >= 1)
+	assert.True(t, metricValue(after, "driver_location_redis_pool_active_connections") >= 1)
+}
+
+func TestNsqMessagesMetrics(t *testing.T) {
+	pool = newPool(Config.Redis.Host)
+	conn := pool.Get()
+	defer conn.Close()
+	received := testutil.ToFloat64(nsqMessagesReceived)
+	deadLetters := testutil.ToFloat64(nsqMessages.WithLabelValues(ResultDeadLetter))
+	invalidJSON := testutil.ToFloat64(deadLettersTotal.WithLabelValues(ReasonInvalidJSON))
+	persisted := testutil.ToFloat64(nsqMessages.WithLabelValues(ResultPersisted))
+	var id nsq.MessageID
+	for _, body := range []string{`{"driverId": "metrics002",`, `{"driverId": "metrics002", "latitude": 48.864193, "longitude": 2.364988}`} {
+		handleMessage(nsq.NewMessage(id, []byte(body)))
+	}
+	assert.Equal(t, received+2, testutil.ToFloat64(nsqMessagesReceived))
+	assert.Equal(t, deadLetters+1, testutil.ToFloat64(nsqMessages.WithLabelValues(ResultDeadLetter)))
+	assert.Equal(t, invalidJSON+1, testutil.ToFloat64(deadLettersTotal.WithLabelValues(ReasonInvalidJSON)))
+	assert.Equal(t, persisted+1, testutil.ToFloat64(nsqMessages.WithLabelValues(ResultPersisted)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(nsqHandlersInFlight))
+	conn.Do("DEL", "driver:metrics002:log", "driver:metrics002:timeline")
+	conn.Do("ZREM", "on-course", "metrics002")
+}
@@ -0,0 +1,98 @@
+/*
+Driver location service for Zombie test.
+
+*/
+
+package main
+
+import (
+	"math"
+)
+
+//LocationStats summarises the moves of a driver over the returned locations
+type LocationStats struct {
+	Distance       float64 `json:"distance"`       //Distance (in meters) travelled from the first to the last location, segment by segment (as cumulativeDistance)
+	MaxSpeed       float64 `json:"maxSpeed"`       //m/s
+	MaxSpeedKmh    float64 `json:"maxSpeedKmh"`    //km/h
+	AvgSpeed       float64 `json:"avgSpeed"`       //Distance / time between the first and the last location (m/s)
+	AvgSpeedKmh    float64 `json:"avgSpeedKmh"`    //km/h
+	MovingTime     float64 `json:"movingTime"`     //Time (in seconds) spent above the stationary speed
+	StationaryTime float64 `json:"stationaryTime"` //Time (in seconds) spent at or below the stationary speed
+}
+
+//DefaultStationarySpeed Default speed (in m/s) at or below which a driver is stationary
+const DefaultStationarySpeed = 1
+
+//bearing Returns the initial bearing (in degrees from the north, clockwise, between 0 and 360) to go from a to b (longitude, latitude)
+func bearing(a, b [2]float64) float64 {
+	lat1 := a[1] * math.Pi / 180
+	lat2 := b[1] * math.Pi / 180
+	dLon := (b[0] - a[0]) * math.Pi / 180
+	y := math.Sin(dLon) * math.Cos(lat2)
+	x := math.Cos(lat1)*math.Sin(lat2) - math.Sin(lat1)*math.Cos(lat2)*math.Cos(dLon)
+	return math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+}
+
+//segments Computes, for every location, the speed (m/s) and the bearing from the previous accepted location.
+//deltas[i] is the distance (m) from the previous location (GEODIST) or from the previous accepted one (filteredDeltas),
+//timestamps are in Unix time in ms. The first location, missing positions and rejected locations have a 0 speed and no bearing (nil),
+//as the segments without elapsed time. Segments without distance have no bearing. elapsed[i] is the duration (s) of the segment
+//and distances[i] its length (m): it is measured from the previous accepted location when the previous location is skipped
+func segments(positions []*[2]float64, timestamps []int64, rejected []bool, deltas []float64) (speeds []float64, bearings []*float64, elapsed []float64, distances []float64) {
+	speeds = make([]float64, len(positions))
+	bearings = make([]*float64, len(positions))
+	elapsed = make([]float64, len(positions))
+	distances = make([]float64, len(positions))
+	previous := -1
+	for i, position := range positions {
+		if position == nil || rejected[i] {
+			continue
+		}
+		if previous >= 0 {
+			distances[i] = deltas[i]
+			if previous != i-1 {
+				distances[i] = haversine(*positions[previous], *position)
+			}
+			elapsed[i] = float64(timestamps[i]-timestamps[previous]) / 1e3
+			if elapsed[i] > 0 {
+				speeds[i] = distances[i] / elapsed[i]
+			}
+			if distances[i] > 0 {
+				value := bearing(*positions[previous], *position)
+				bearings[i] = &value
+			}
+		}
+		previous = i
+	}
+	return speeds, bearings, elapsed, distances
+}
+
+//summarise Returns the stats of the segments. A segment is stationary when its speed is at most stationarySpeed (m/s)
+func summarise(speeds, elapsed, distances []float64, stationarySpeed float64) LocationStats {
+	var stats LocationStats
+	for i := range speeds {
+		if elapsed[i] <= 0 {
+			continue
+		}
+		stats.Distance += distances[i]
+		if speeds[i] > stats.MaxSpeed {
+			stats.MaxSpeed = speeds[i]
+		}
+		if speeds[i] > stationarySpeed {
+			stats.MovingTime += elapsed[i]
+		} else {
+			stats.StationaryTime += elapsed[i]
+		}
+	}
+	if total := stats.MovingTime + stats.StationaryTime; total > 0 {
+		stats.AvgSpeed = stats.Distance / total
+	}
+	stats.Distance = math.Floor(stats.Distance*1e3) / 1e3
+	stats.MaxSpeedKmh = math.Floor(stats.MaxSpeed*3.6*1e3) / 1e3
+	stats.MaxSpeed = math.Floor(stats.MaxSpeed*1e3) / 1e3
+	stats.AvgSpeedKmh = math.Floor(stats.AvgSpeed*3.6*1e3) / 1e3
+	stats.AvgSpeed = math.Floor(stats.AvgSpeed*1e3) / 1e3
+	stats.MovingTime = math.Floor(stats.MovingTime*1e3) / 1e3
+	stats.StationaryTime = math.Floor(stats.StationaryTime*1e3) / 1e3
+	return stats
+}
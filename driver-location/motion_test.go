@@ -0,0 +1,130 @@
+/*
+Driver location service for Zombie test.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_bearing(t *testing.T) {
+	tests := []struct {
+		name     string
+		to       [2]float64
+		expected float64
+	}{
+		//Test cases
+		{"North", [2]float64{2.364988, 48.874193}, 0},
+		{"East", [2]float64{2.374988, 48.864193}, 90},
+		{"South", [2]float64{2.364988, 48.854193}, 180},
+		{"West", [2]float64{2.354988, 48.864193}, 270},
+	}
+	for _, tt := range tests {
+		assert.InDelta(t, tt.expected, bearing([2]float64{2.364988, 48.864193}, tt.to), 0.01, "Testing "+tt.name)
+	}
+}
+
+func Test_segments(t *testing.T) {
+	//~7.3 meters every 5 seconds, then parked, with a missing position and an outlier
+	positions, timestamps := testPositions(7, 5)
+	positions[3] = &[2]float64{positions[2][0], positions[2][1]}
+	positions[4] = nil
+	positions[6] = &[2]float64{positions[2][0], positions[2][1]}
+	rejected := []bool{false, false, false, false, false, true, false}
+	deltas := filteredDeltas(positions, rejected)
+	speeds, bearings, elapsed, distances := segments(positions, timestamps, rejected, deltas)
+	assert.Equal(t, 0.0, speeds[0])
+	assert.Nil(t, bearings[0])
+	assert.InDelta(t, 7.3/5, speeds[1], 0.01)
+	if assert.NotNil(t, bearings[1]) {
+		assert.InDelta(t, 90, *bearings[1], 0.01)
+	}
+	//Parked: no speed, no bearing
+	assert.Equal(t, 0.0, speeds[3])
+	assert.Nil(t, bearings[3])
+	//Missing and rejected locations are skipped. The segment of location 6 starts at location 3
+	assert.Equal(t, []float64{0, 5, 5, 5, 0, 0, 15}, elapsed)
+	stats := summarise(speeds, elapsed, distances, DefaultStationarySpeed)
+	assert.InDelta(t, 14.6, stats.Distance, 0.1)
+	assert.InDelta(t, 7.3/5, stats.MaxSpeed, 0.01)
+	assert.InDelta(t, 7.32/5*3.6, stats.MaxSpeedKmh, 0.01)
+	assert.InDelta(t, 14.6/30, stats.AvgSpeed, 0.01)
+	assert.Equal(t, 10.0, stats.MovingTime)
+	assert.Equal(t, 20.0, stats.StationaryTime)
+}
+
+func Test_segmentsMissingPosition(t *testing.T) {
+	//~7.3 meters every 5 seconds, position 2 is missing
+	positions, timestamps := testPositions(4)
+	positions[2] = nil
+	rejected := make([]bool, 4)
+	//GEODIST deltas: measured from the previous location, 0 when a position is missing
+	deltas := make([]float64, 4)
+	for i := 1; i < 4; i++ {
+		if positions[i] != nil && positions[i-1] != nil {
+			deltas[i] = haversine(*positions[i-1], *positions[i])
+		}
+	}
+	speeds, bearings, elapsed, distances := segments(positions, timestamps, rejected, deltas)
+	//The segment of location 3 starts at location 1: ~14.6 meters in 10 seconds
+	assert.Equal(t, 10.0, elapsed[3])
+	assert.InDelta(t, 14.6, distances[3], 0.1)
+	assert.InDelta(t, 7.3/5, speeds[3], 0.01)
+	if assert.NotNil(t, bearings[3]) {
+		assert.InDelta(t, 90, *bearings[3], 0.01)
+	}
+	stats := summarise(speeds, elapsed, distances, DefaultStationarySpeed)
+	assert.InDelta(t, 21.9, stats.Distance, 0.1)
+	assert.Equal(t, 15.0, stats.MovingTime)
+}
+
+func TestGetLocationsRouteSpeed(t *testing.T) {
+	pool = newPool(Config.Redis.Host)
+	conn := pool.Get()
+	timestamps := saveTestHistory(conn, "speed001", 4)
+	conn.Do("DEL", rejectedKey("speed001"))
+	conn.Close()
+	router := setupRouter()
+	//Speed and bearing of every location
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/drivers/speed001/locations?from=%v&speed=true&filter=false", timestamps[0]), nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var locations []map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &locations)
+	if assert.Equal(t, 4, len(locations)) {
+		assert.Equal(t, 0.0, locations[0]["speed"])
+		assert.Nil(t, locations[0]["bearing"])
+		assert.InDelta(t, 1.47, locations[1]["speed"], 0.05)
+		assert.InDelta(t, 5.3, locations[1]["speedKmh"], 0.2)
+		assert.InDelta(t, 90, locations[1]["bearing"], 0.1)
+		_, isThere := locations[1]["cumulativeDistance"]
+		assert.False(t, isThere)
+	}
+	//Stats envelope
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/drivers/speed001/locations?from=%v&stats=true&distance=true&filter=false", timestamps[0]), nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var envelope struct {
+		Locations []map[string]interface{} `json:"locations"`
+		Stats     LocationStats            `json:"stats"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &envelope)
+	if assert.Equal(t, 4, len(envelope.Locations)) {
+		assert.Equal(t, envelope.Locations[3]["cumulativeDistance"], envelope.Stats.Distance)
+		_, isThere := envelope.Locations[1]["speed"]
+		assert.False(t, isThere)
+	}
+	assert.InDelta(t, 1.47, envelope.Stats.AvgSpeed, 0.05)
+	assert.Equal(t, 15.0, envelope.Stats.MovingTime)
+	assert.Equal(t, 0.0, envelope.Stats.StationaryTime)
+}
@@ -0,0 +1,174 @@
+/*
+Driver location service for Zombie test.
+
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gomodule/redigo/redis"
+)
+
+//NearbyOptions describes the options of the nearby drivers query
+type NearbyOptions struct {
+	StaleAfter int `yaml:"stale-after,omitempty"` //Seconds after which the last location of a driver is too old to be returned
+	MaxLimit   int `yaml:"max-limit,omitempty"`   //Maximum number of drivers in the reply
+}
+
+//DefaultStaleAfter Default number of seconds after which the last location of a driver is too old to be returned
+const DefaultStaleAfter = 300
+
+//DefaultNearbyLimit Default number of drivers returned by getNearbyDrivers
+const DefaultNearbyLimit = 10
+
+//DefaultNearbyMaxLimit Default maximum number of drivers returned by getNearbyDrivers
+const DefaultNearbyMaxLimit = 100
+
+//nearbyQuery describes the drivers requested to getNearbyDrivers
+type nearbyQuery struct {
+	latitude   float64
+	longitude  float64
+	radius     float64
+	unit       string //m, km, mi or ft
+	limit      int
+	timeFormat string //Format of last_seen
+}
+
+//parseNearbyQuery Reads the querystring of getNearbyDrivers. The returned error explains which parameter is invalid
+func parseNearbyQuery(c *gin.Context, opts NearbyOptions) (query nearbyQuery, err error) {
+	maxLimit := opts.MaxLimit
+	if maxLimit <= 0 {
+		maxLimit = DefaultNearbyMaxLimit
+	}
+	query.latitude, err = strconv.ParseFloat(c.Query("lat"), 64)
+	if err != nil || query.latitude > 85.05112878 || query.latitude < -85.05112878 {
+		return query, errors.New("lat must be a number between -85.05112878 and 85.05112878")
+	}
+	query.longitude, err = strconv.ParseFloat(c.Query("lon"), 64)
+	if err != nil || query.longitude > 180 || query.longitude < -180 {
+		return query, errors.New("lon must be a number between -180 and 180")
+	}
+	query.radius, err = strconv.ParseFloat(c.Query("radius"), 64)
+	if err != nil || query.radius <= 0 || math.IsInf(query.radius, 0) {
+		return query, errors.New("radius must be a positive number")
+	}
+	query.unit = c.DefaultQuery("unit", "m")
+	switch query.unit {
+	case "m", "km", "mi", "ft":
+	default:
+		return query, errors.New("unit must be m, km, mi or ft")
+	}
+	query.limit = DefaultNearbyLimit
+	if limit, isThere := c.GetQuery("limit"); isThere {
+		query.limit, err = strconv.Atoi(limit)
+		if err != nil || query.limit < 1 || query.limit > maxLimit {
+			return query, fmt.Errorf("limit must be an integer between 1 and %v", maxLimit)
+		}
+	}
+	query.timeFormat = c.DefaultQuery("time_format", TimeFormatRFC3339Nano)
+	if query.timeFormat != TimeFormatRFC3339Nano && query.timeFormat != TimeFormatEpochMs {
+		return query, fmt.Errorf("time_format must be %v or %v", TimeFormatRFC3339Nano, TimeFormatEpochMs)
+	}
+	return query, nil
+}
+
+//nearbyDrivers Returns at most query.limit drivers of on-course in the query radius, seen after freshAfter (Unix time in ms),
+//sorted by distance. Stale drivers are skipped: the search is extended (COUNT doubled) until enough fresh drivers are found
+//or there are no more drivers in the radius
+func nearbyDrivers(conn redis.Conn, query nearbyQuery, freshAfter int64) ([]map[string]interface{}, error) {
+	drivers := make([]map[string]interface{}, 0)
+	count := query.limit
+	for {
+		reply, err := redis.Values(conn.Do("GEORADIUS", "on-course", query.longitude, query.latitude, query.radius, query.unit, "WITHDIST", "WITHCOORD", "ASC", "COUNT", count))
+		if err != nil {
+			return nil, err
+		}
+		//Gets the last seen times with a single pipeline
+		ids := make([]string, len(reply))
+		distances := make([]float64, len(reply))
+		coordinates := make([][2]float64, len(reply))
+		for i, item := range reply {
+			var position []float64
+			if _, err = redis.Scan(item.([]interface{}), &ids[i], &distances[i], &position); err != nil {
+				return nil, err
+			}
+			copy(coordinates[i][:], position)
+			conn.Send("ZSCORE", LastSeenKey, ids[i])
+		}
+		if err = conn.Flush(); err != nil {
+			return nil, err
+		}
+		drivers = drivers[:0]
+		for i := range reply {
+			lastSeen, err := redis.Int64(conn.Receive())
+			if err == redis.ErrNil || (err == nil && lastSeen < freshAfter) {
+				//Never seen or stale
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if len(drivers) < query.limit {
+				drivers = append(drivers, map[string]interface{}{
+					"driverId":  ids[i],
+					"distance":  distances[i],
+					"unit":      query.unit,
+					"latitude":  math.Floor(coordinates[i][1]*1e6) / 1e6,
+					"longitude": math.Floor(coordinates[i][0]*1e6) / 1e6,
+					"last_seen": formatTime(lastSeen, query.timeFormat),
+				})
+			}
+		}
+		if len(drivers) == query.limit || len(reply) < count {
+			return drivers, nil
+		}
+		count = count * 2
+	}
+}
+
+//formatTime Formats a time (Unix time in ms) as RFC3339 with sub-second precision or as Unix time in ms
+func formatTime(ts int64, timeFormat string) interface{} {
+	if timeFormat == TimeFormatEpochMs {
+		return ts
+	}
+	return timestampAsISO(ts)
+}
+
+//getNearbyDrivers Replies with the drivers around a position, sorted by distance
+func getNearbyDrivers(c *gin.Context) {
+	query, err := parseNearbyQuery(c, Config.Nearby)
+	if err != nil {
+		badRequestReply := map[string]string{
+			"message": err.Error(),
+		}
+		c.IndentedJSON(http.StatusBadRequest, badRequestReply)
+		return
+	}
+	staleAfter := Config.Nearby.StaleAfter
+	if staleAfter <= 0 {
+		staleAfter = DefaultStaleAfter
+	}
+	if pool == nil {
+		//Pool not initialized (e.g. in unit tests). Provide a pool initialization
+		pool = newPool(Config.Redis.Host)
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	freshAfter := time.Now().UnixNano()/1e6 - int64(staleAfter)*1e3
+	drivers, err := nearbyDrivers(conn, query, freshAfter)
+	if err != nil {
+		log.Printf("Error in looking for nearby drivers. %v", err)
+		c.String(http.StatusInternalServerError, "Ooops. Something went wrong on our side.")
+		return
+	}
+	c.IndentedJSON(http.StatusOK, drivers)
+}
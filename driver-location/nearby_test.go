@@ -0,0 +1,62 @@
+/*
+Driver location service for Zombie test.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNearbyDriversRoute(t *testing.T) {
+	pool = newPool(Config.Redis.Host)
+	conn := pool.Get()
+	defer conn.Close()
+	now := time.Now().UnixNano() / 1e6
+	conn.Do("DEL", "on-course", LastSeenKey)
+	//Drivers around Place de la République, Paris. near003 hasn't sent any location for 1 hour
+	conn.Do("GEOADD", "on-course", 2.3640, 48.8675, "near001", 2.3650, 48.8675, "near002", 2.3635, 48.8676, "near003", 2.3700, 48.8675, "near004", 2.2945, 48.8584, "far001")
+	conn.Do("ZADD", LastSeenKey, now, "near001", now-10e3, "near002", now-3600e3, "near003", now, "near004", now, "far001")
+	tests := []struct {
+		name         string
+		querystring  string
+		expectedCode int
+		expectedIDs  []string
+		expectedBody string
+	}{
+		//Test Cases
+		{"Drivers in 1 km", "lat=48.8675&lon=2.3638&radius=1&unit=km", http.StatusOK, []string{"near001", "near002", "near004"}, ""},
+		{"Closest driver", "lat=48.8675&lon=2.3638&radius=1000&limit=1", http.StatusOK, []string{"near001"}, ""},
+		{"Closest 2 drivers (stale driver skipped)", "lat=48.8676&lon=2.3635&radius=1000&limit=2", http.StatusOK, []string{"near001", "near002"}, ""},
+		{"Nobody around", "lat=40.0&lon=2.3638&radius=1000", http.StatusOK, []string{}, ""},
+		{"Missing latitude", "lon=2.3638&radius=1000", http.StatusBadRequest, nil, "lat must be a number between -85.05112878 and 85.05112878"},
+		{"Invalid longitude", "lat=48.8675&lon=200&radius=1000", http.StatusBadRequest, nil, "lon must be a number between -180 and 180"},
+		{"Missing radius", "lat=48.8675&lon=2.3638", http.StatusBadRequest, nil, "radius must be a positive number"},
+		{"Unknown unit", "lat=48.8675&lon=2.3638&radius=1&unit=yd", http.StatusBadRequest, nil, "unit must be m, km, mi or ft"},
+		{"Limit too high", "lat=48.8675&lon=2.3638&radius=1&limit=1000", http.StatusBadRequest, nil, "limit must be an integer between 1 and 100"},
+	}
+	for _, tt := range tests {
+		router := setupRouter()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/drivers/nearby?"+tt.querystring, nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, tt.expectedCode, w.Code, "Testing "+tt.name)
+		assert.Contains(t, w.Body.String(), tt.expectedBody, "Testing "+tt.name)
+		if tt.expectedIDs != nil {
+			var drivers []map[string]interface{}
+			json.Unmarshal(w.Body.Bytes(), &drivers)
+			ids := make([]string, 0)
+			for _, driver := range drivers {
+				ids = append(ids, driver["driverId"].(string))
+			}
+			assert.Equal(t, tt.expectedIDs, ids, "Testing "+tt.name)
+		}
+	}
+}
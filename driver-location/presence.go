@@ -0,0 +1,289 @@
+/*
+Driver location service for Zombie test.
+
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gomodule/redigo/redis"
+)
+
+//PresenceOptions describes when a driver is considered online
+type PresenceOptions struct {
+	OnlineTimeout int `yaml:"online-timeout,omitempty"` //Seconds without locations after which a driver is offline (removed from on-course once idle, see RetentionOptions)
+}
+
+//DefaultOnlineTimeout Default number of seconds without locations after which a driver is offline
+const DefaultOnlineTimeout = 300
+
+//LastSeenKey Sorted set of all the drivers scored by the time (Unix time in ms) of their last location
+const LastSeenKey = "drivers:last-seen"
+
+//OnCourseLastSeenKey Sorted set of the drivers of on-course scored by the time (Unix time in ms) of their last location.
+//Drivers are removed from both when they go offline
+const OnCourseLastSeenKey = "on-course:last-seen"
+
+//Driver statuses
+const (
+	//StatusOnline The driver sent a location in the online timeout
+	StatusOnline = "online"
+	//StatusOffline The driver didn't send any location in the online timeout
+	StatusOffline = "offline"
+)
+
+//onlineTimeout Returns the online timeout (in seconds), with its default value
+func (opts PresenceOptions) onlineTimeout() int {
+	if opts.OnlineTimeout <= 0 {
+		return DefaultOnlineTimeout
+	}
+	return opts.OnlineTimeout
+}
+
+//driverStatus Tells if a driver last seen at lastSeen (Unix time in ms) is online at now (Unix time in ms)
+func driverStatus(lastSeen, now int64, opts PresenceOptions) string {
+	if now-lastSeen <= int64(opts.onlineTimeout())*1e3 {
+		return StatusOnline
+	}
+	return StatusOffline
+}
+
+//getActiveDrivers Replies with the drivers seen since the given time, from the most recently seen
+func getActiveDrivers(c *gin.Context) {
+	now := time.Now().UnixNano() / 1e6
+	since := now - int64(Config.Presence.onlineTimeout())*1e3
+	var err error
+	if value, isThere := c.GetQuery("since"); isThere {
+		if since, err = parseTime(value); err != nil {
+			badRequestReply := map[string]string{
+				"message": "since must be a RFC3339 time or a Unix time in ms",
+			}
+			c.IndentedJSON(http.StatusBadRequest, badRequestReply)
+			return
+		}
+	}
+	maxLimit := Config.Queries.MaxLimit
+	if maxLimit <= 0 {
+		maxLimit = DefaultMaxLimit
+	}
+	limit := maxLimit
+	if value, isThere := c.GetQuery("limit"); isThere {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxLimit {
+			badRequestReply := map[string]string{
+				"message": fmt.Sprintf("limit must be an integer between 1 and %v", maxLimit),
+			}
+			c.IndentedJSON(http.StatusBadRequest, badRequestReply)
+			return
+		}
+	}
+	//Page: the drivers seen at or before the cursor time, skipping the ones seen at that time already returned
+	maxScore, cursorSeen, skip := "+inf", int64(0), 0
+	if cursor, isThere := c.GetQuery("cursor"); isThere {
+		if cursorSeen, skip, err = decodeActiveCursor(cursor); err != nil {
+			badRequestReply := map[string]string{
+				"message": "cursor is not valid",
+			}
+			c.IndentedJSON(http.StatusBadRequest, badRequestReply)
+			return
+		}
+		maxScore = strconv.FormatInt(cursorSeen, 10)
+	}
+	timeFormat := c.DefaultQuery("time_format", TimeFormatRFC3339Nano)
+	if timeFormat != TimeFormatRFC3339Nano && timeFormat != TimeFormatEpochMs {
+		badRequestReply := map[string]string{
+			"message": fmt.Sprintf("time_format must be %v or %v", TimeFormatRFC3339Nano, TimeFormatEpochMs),
+		}
+		c.IndentedJSON(http.StatusBadRequest, badRequestReply)
+		return
+	}
+	if pool == nil {
+		//Pool not initialized (e.g. in unit tests). Provide a pool initialization
+		pool = newPool(Config.Redis.Host)
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	//One more driver tells if there is a next page
+	reply, err := redis.Values(conn.Do("ZREVRANGEBYSCORE", LastSeenKey, maxScore, since, "WITHSCORES", "LIMIT", skip, limit+1))
+	if err != nil {
+		log.Printf("Error in processing ZREVRANGEBYSCORE request. %v", err)
+		c.String(http.StatusInternalServerError, "Ooops. Something went wrong on our side.")
+		return
+	}
+	drivers := make([]map[string]interface{}, 0)
+	var pageLastSeen []int64
+	for len(reply) > 0 && len(drivers) < limit {
+		var (
+			id       string
+			lastSeen int64
+		)
+		if reply, err = redis.Scan(reply, &id, &lastSeen); err != nil {
+			log.Printf("Error in reading ZREVRANGEBYSCORE reply. %v", err)
+			c.String(http.StatusInternalServerError, "Ooops. Something went wrong on our side.")
+			return
+		}
+		drivers = append(drivers, map[string]interface{}{
+			"driverId":  id,
+			"last_seen": formatTime(lastSeen, timeFormat),
+			"status":    driverStatus(lastSeen, now, Config.Presence),
+		})
+		pageLastSeen = append(pageLastSeen, lastSeen)
+	}
+	if len(reply) > 0 {
+		//There are more drivers. The cursor of the next page is the last seen time of the last returned driver
+		//and the number of returned drivers seen at that time
+		last := pageLastSeen[len(pageLastSeen)-1]
+		n := 0
+		for i := len(pageLastSeen) - 1; i >= 0 && pageLastSeen[i] == last; i-- {
+			n++
+		}
+		if n == len(pageLastSeen) && last == cursorSeen {
+			//The whole page has been seen at the cursor time
+			n += skip
+		}
+		c.Header(NextCursorHeader, encodeActiveCursor(last, n))
+	}
+	c.IndentedJSON(http.StatusOK, drivers)
+}
+
+//encodeActiveCursor Returns the cursor of the page of active drivers following the one whose last driver has been seen at lastSeen (Unix time in ms).
+//skip is the number of drivers seen at lastSeen already returned
+func encodeActiveCursor(lastSeen int64, skip int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%v,%v", lastSeen, skip)))
+}
+
+//decodeActiveCursor Returns the last seen time (Unix time in ms) and the number of drivers to skip encoded in cursor
+func decodeActiveCursor(cursor string) (lastSeen int64, skip int, err error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, 0, err
+	}
+	parts := strings.Split(string(decoded), ",")
+	if len(parts) != 2 {
+		return 0, 0, errors.New("cursor is not valid")
+	}
+	lastSeen, err = strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || lastSeen <= 0 {
+		return 0, 0, errors.New("cursor is not valid")
+	}
+	skip, err = strconv.Atoi(parts[1])
+	if err != nil || skip < 0 {
+		return 0, 0, errors.New("cursor is not valid")
+	}
+	return lastSeen, skip, nil
+}
+
+//errDriverNotFound is returned when there is no data about a driver
+var errDriverNotFound = errors.New("Driver not found")
+
+//lastLocationPage Number of locations read at a time by lastLocation, from the newest, to find one that is not an outlier
+const lastLocationPage = 10
+
+//lastLocation Returns the last location of driver id (time in Unix ms, and position) and the time it has been seen for the last time.
+//Locations flagged as GPS outliers are skipped, as they are for on-course.
+//lastSeen is 0 if the driver hasn't been seen since last-seen tracking has been introduced
+func lastLocation(conn redis.Conn, id string) (updatedAt int64, position *[2]float64, lastSeen int64, err error) {
+	conn.Send("ZSCORE", LastSeenKey, id)
+	conn.Send("ZREVRANGE", fmt.Sprintf("driver:%v:timeline", id), 0, lastLocationPage-1)
+	if err = conn.Flush(); err != nil {
+		return 0, nil, 0, err
+	}
+	lastSeen, err = redis.Int64(conn.Receive())
+	if err != nil && err != redis.ErrNil {
+		return 0, nil, 0, err
+	}
+	members, err := redis.Int64s(conn.Receive())
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	if len(members) == 0 && lastSeen == 0 {
+		return 0, nil, 0, errDriverNotFound
+	}
+	for start := 0; len(members) > 0; start += lastLocationPage {
+		//readRejected reads the flags of locations in ascending order
+		timestamps := make([]int64, len(members))
+		for i, member := range members {
+			timestamps[len(members)-1-i] = member
+		}
+		rejected, err := readRejected(conn, id, timestamps)
+		if err != nil {
+			return 0, nil, 0, err
+		}
+		for i := len(timestamps) - 1; i >= 0; i-- {
+			if !rejected[i] {
+				positions, _ := readPositions(conn, id, timestamps[i:i+1], false)
+				return toMillis(timestamps[i]), positions[0], lastSeen, nil
+			}
+		}
+		if len(members) < lastLocationPage {
+			break
+		}
+		members, err = redis.Int64s(conn.Do("ZREVRANGE", fmt.Sprintf("driver:%v:timeline", id), start+lastLocationPage, start+2*lastLocationPage-1))
+		if err != nil {
+			return 0, nil, 0, err
+		}
+	}
+	//History has been trimmed, or it only holds outliers
+	return 0, nil, lastSeen, nil
+}
+
+//getDriverStatus Replies with the last position of a driver, the time it has been seen for the last time and if it's online
+func getDriverStatus(c *gin.Context) {
+	id := c.Param("id")
+	timeFormat := c.DefaultQuery("time_format", TimeFormatRFC3339Nano)
+	if timeFormat != TimeFormatRFC3339Nano && timeFormat != TimeFormatEpochMs {
+		badRequestReply := map[string]string{
+			"message": fmt.Sprintf("time_format must be %v or %v", TimeFormatRFC3339Nano, TimeFormatEpochMs),
+		}
+		c.IndentedJSON(http.StatusBadRequest, badRequestReply)
+		return
+	}
+	if pool == nil {
+		//Pool not initialized (e.g. in unit tests). Provide a pool initialization
+		pool = newPool(Config.Redis.Host)
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	updatedAt, position, lastSeen, err := lastLocation(conn, id)
+	if err == errDriverNotFound {
+		notFoundReply := map[string]string{
+			"message": "Driver not found",
+		}
+		c.IndentedJSON(http.StatusNotFound, notFoundReply)
+		return
+	}
+	if err != nil {
+		log.Printf("Error in looking for the last location of driver %v. %v", id, err)
+		c.String(http.StatusInternalServerError, "Ooops. Something went wrong on our side.")
+		return
+	}
+	status := map[string]interface{}{
+		"driverId":  id,
+		"status":    StatusOffline,
+		"last_seen": nil,
+		"location":  nil,
+	}
+	if lastSeen > 0 {
+		status["last_seen"] = formatTime(lastSeen, timeFormat)
+		status["status"] = driverStatus(lastSeen, time.Now().UnixNano()/1e6, Config.Presence)
+	}
+	if position != nil {
+		status["location"] = map[string]interface{}{
+			"latitude":   math.Floor(position[1]*1e6) / 1e6,
+			"longitude":  math.Floor(position[0]*1e6) / 1e6,
+			"updated_at": formatTime(updatedAt, timeFormat),
+		}
+	}
+	c.IndentedJSON(http.StatusOK, status)
+}
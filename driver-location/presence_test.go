@@ -0,0 +1,224 @@
+/*
+Driver location service for Zombie test.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_driverStatus(t *testing.T) {
+	now := int64(1540389600000)
+	tests := []struct {
+		name     string
+		lastSeen int64
+		opts     PresenceOptions
+		want     string
+	}{
+		//Test cases
+		{"Seen now", now, PresenceOptions{}, StatusOnline},
+		{"Seen 5 minutes ago (default timeout)", now - 300e3, PresenceOptions{}, StatusOnline},
+		{"Seen 5 minutes and 1 ms ago (default timeout)", now - 300e3 - 1, PresenceOptions{}, StatusOffline},
+		{"Seen 2 minutes ago (1 minute timeout)", now - 120e3, PresenceOptions{OnlineTimeout: 60}, StatusOffline},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, driverStatus(tt.lastSeen, now, tt.opts))
+		})
+	}
+}
+
+func TestActiveDriversRoute(t *testing.T) {
+	pool = newPool(Config.Redis.Host)
+	conn := pool.Get()
+	defer conn.Close()
+	now := time.Now().UnixNano() / 1e6
+	conn.Do("DEL", LastSeenKey)
+	conn.Do("ZADD", LastSeenKey, now-1e3, "active001", now-60e3, "active002", now-3600e3, "offline001")
+	tests := []struct {
+		name         string
+		querystring  string
+		expectedCode int
+		expectedIDs  []string
+		expectedBody string
+	}{
+		//Test Cases
+		{"Online drivers", "", http.StatusOK, []string{"active001", "active002"}, "\"status\": \"online\""},
+		{"Drivers of the last 2 hours", "since=" + time.Unix(0, (now-7200e3)*1e6).UTC().Format(time.RFC3339), http.StatusOK, []string{"active001", "active002", "offline001"}, "\"status\": \"offline\""},
+		{"Most recently seen driver", "since=0&limit=1", http.StatusOK, []string{"active001"}, ""},
+		{"Invalid since", "since=yesterday", http.StatusBadRequest, nil, "since must be a RFC3339 time or a Unix time in ms"},
+		{"Invalid limit", "limit=0", http.StatusBadRequest, nil, "limit must be an integer between 1 and 1000"},
+	}
+	for _, tt := range tests {
+		router := setupRouter()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/drivers/active?"+tt.querystring, nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, tt.expectedCode, w.Code, "Testing "+tt.name)
+		assert.Contains(t, w.Body.String(), tt.expectedBody, "Testing "+tt.name)
+		if tt.expectedIDs != nil {
+			var drivers []map[string]interface{}
+			json.Unmarshal(w.Body.Bytes(), &drivers)
+			ids := make([]string, 0)
+			for _, driver := range drivers {
+				ids = append(ids, driver["driverId"].(string))
+			}
+			assert.Equal(t, tt.expectedIDs, ids, "Testing "+tt.name)
+		}
+	}
+}
+
+func TestActiveDriversRoutePages(t *testing.T) {
+	pool = newPool(Config.Redis.Host)
+	conn := pool.Get()
+	defer conn.Close()
+	now := time.Now().UnixNano() / 1e6
+	conn.Do("DEL", LastSeenKey)
+	//7 drivers, 4 of them seen at the same time
+	conn.Do("ZADD", LastSeenKey, now-1e3, "page001", now-2e3, "page002", now-2e3, "page003", now-2e3, "page004", now-2e3, "page005", now-3e3, "page006", now-4e3, "page007")
+	router := setupRouter()
+	//Walks the drivers 2 at a time
+	got := make([]string, 0)
+	cursor := ""
+	for page := 0; page < 5; page++ {
+		querystring := "limit=2"
+		if cursor != "" {
+			querystring += "&cursor=" + cursor
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/drivers/active?"+querystring, nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var drivers []map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &drivers)
+		for _, driver := range drivers {
+			got = append(got, driver["driverId"].(string))
+		}
+		cursor = w.Header().Get(NextCursorHeader)
+		if cursor == "" {
+			break
+		}
+	}
+	assert.ElementsMatch(t, []string{"page001", "page002", "page003", "page004", "page005", "page006", "page007"}, got)
+	assert.Equal(t, "page001", got[0])
+	assert.Equal(t, []string{"page006", "page007"}, got[5:])
+	//The limit is bounded by queries.max-limit
+	queries := Config.Queries
+	Config.Queries.MaxLimit = 5
+	defer func() { Config.Queries = queries }()
+	tests := []struct {
+		name         string
+		querystring  string
+		expectedCode int
+		expectedBody string
+		truncated    bool
+	}{
+		//Test Cases
+		{"Default limit", "", http.StatusOK, "page005", true},
+		{"Limit too high", "limit=6", http.StatusBadRequest, "limit must be an integer between 1 and 5", false},
+		{"Invalid cursor", "cursor=1234", http.StatusBadRequest, "cursor is not valid", false},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/drivers/active?"+tt.querystring, nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, tt.expectedCode, w.Code, "Testing "+tt.name)
+		assert.Contains(t, w.Body.String(), tt.expectedBody, "Testing "+tt.name)
+		assert.Equal(t, tt.truncated, w.Header().Get(NextCursorHeader) != "", "Testing "+tt.name)
+	}
+}
+
+func TestDriverStatusRoute(t *testing.T) {
+	pool = newPool(Config.Redis.Host)
+	conn := pool.Get()
+	timestamps := saveTestHistory(conn, "status001", 3)
+	now := time.Now().UnixNano() / 1e6
+	conn.Do("ZADD", LastSeenKey, now, "status001", now-3600e3, "status002")
+	conn.Do("DEL", "driver:status002:timeline")
+	conn.Close()
+	tests := []struct {
+		name         string
+		driverID     string
+		expectedCode int
+		expected     map[string]interface{}
+	}{
+		//Test Cases
+		{"Online driver", "status001", http.StatusOK, map[string]interface{}{
+			"driverId":  "status001",
+			"status":    StatusOnline,
+			"last_seen": float64(now),
+			"location":  map[string]interface{}{"updated_at": float64(timestamps[2])},
+		}},
+		{"Offline driver without history", "status002", http.StatusOK, map[string]interface{}{
+			"driverId":  "status002",
+			"status":    StatusOffline,
+			"last_seen": float64(now - 3600e3),
+			"location":  nil,
+		}},
+		{"Not existing driverID", "IDONTEXIST", http.StatusNotFound, map[string]interface{}{"message": "Driver not found"}},
+	}
+	for _, tt := range tests {
+		router := setupRouter()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/drivers/"+tt.driverID+"/status?time_format=epoch_ms", nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, tt.expectedCode, w.Code, "Testing "+tt.name)
+		var status map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &status)
+		if location, ok := status["location"].(map[string]interface{}); ok {
+			//Positions are stored as geohashes: checks them apart
+			assert.InDelta(t, 48.864193, location["latitude"], 1e-5, "Testing "+tt.name)
+			assert.InDelta(t, 2.365188, location["longitude"], 1e-5, "Testing "+tt.name)
+			delete(location, "latitude")
+			delete(location, "longitude")
+		}
+		assert.Equal(t, tt.expected, status, "Testing "+tt.name)
+	}
+}
+
+func Test_lastLocationOutliers(t *testing.T) {
+	pool = newPool(Config.Redis.Host)
+	conn := pool.Get()
+	defer conn.Close()
+	timestamps := saveTestHistory(conn, "status003", 13)
+	latest := saveTestHistory(conn, "status005", 3)
+	conn.Do("DEL", rejectedKey("status003"), rejectedKey("status004"), rejectedKey("status005"))
+	//The 11 newest locations of status003 are outliers (more than a page), every location of status004 is one
+	for _, ts := range timestamps[2:] {
+		conn.Do("ZADD", rejectedKey("status003"), ts, ts)
+	}
+	for _, ts := range saveTestHistory(conn, "status004", 2) {
+		conn.Do("ZADD", rejectedKey("status004"), ts, ts)
+	}
+	tests := []struct {
+		name              string
+		driverID          string
+		expectedUpdatedAt int64
+		expectedLongitude float64
+	}{
+		//Test cases
+		{"Newest locations are outliers", "status003", timestamps[1], 2.364988 + 1e-4},
+		{"Only outliers", "status004", 0, 0},
+		{"No outliers", "status005", latest[2], 2.364988 + 2e-4},
+	}
+	for _, tt := range tests {
+		updatedAt, position, _, err := lastLocation(conn, tt.driverID)
+		assert.Nil(t, err, "Testing "+tt.name)
+		if tt.expectedUpdatedAt == 0 {
+			assert.Nil(t, position, "Testing "+tt.name)
+			continue
+		}
+		assert.Equal(t, tt.expectedUpdatedAt, updatedAt, "Testing "+tt.name)
+		if assert.NotNil(t, position, "Testing "+tt.name) {
+			assert.InDelta(t, tt.expectedLongitude, position[0], 1e-5, "Testing "+tt.name)
+		}
+	}
+}
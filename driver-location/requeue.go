@@ -0,0 +1,67 @@
+/*
+Driver location service for Zombie test.
+
+*/
+
+package main
+
+import (
+	"log"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+)
+
+//DefaultMaxAttempts Default number of deliveries of a message that can't be persisted before it is kept as a dead letter
+const DefaultMaxAttempts = 10
+
+//DefaultRequeueDelay Default number of seconds before the first redelivery of a message that can't be persisted
+const DefaultRequeueDelay = 1
+
+//DefaultMaxRequeueDelay Default maximum number of seconds before a redelivery
+const DefaultMaxRequeueDelay = 300
+
+//nsqSettings Returns opts with default values for the missing redelivery settings
+func nsqSettings(opts NsqServiceOptions) NsqServiceOptions {
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = DefaultMaxAttempts
+	}
+	if opts.RequeueDelay <= 0 {
+		opts.RequeueDelay = DefaultRequeueDelay
+	}
+	if opts.MaxRequeueDelay <= 0 {
+		opts.MaxRequeueDelay = DefaultMaxRequeueDelay
+	}
+	return opts
+}
+
+//requeueDelay Returns the delay before the redelivery of a message delivered attempts times: requeue-delay, doubled at every attempt,
+//up to max-requeue-delay
+func requeueDelay(attempts uint16, opts NsqServiceOptions) time.Duration {
+	maxDelay := time.Duration(opts.MaxRequeueDelay) * time.Second
+	delay := time.Duration(opts.RequeueDelay) * time.Second
+	for i := uint16(1); i < attempts && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+//requeueMessage Requeues message m that couldn't be persisted because of err, with an exponential backoff.
+//The consumer backs off too, as the other messages are likely to fail the same way.
+//After max-attempts deliveries the message is kept as a dead letter and finished
+func requeueMessage(m *nsq.Message, err error, opts NsqServiceOptions) error {
+	if int(m.Attempts) >= opts.MaxAttempts {
+		log.Printf("Message %s couldn't be persisted after %v attempts. It is kept as a dead letter", m.ID[:], m.Attempts)
+		deadLetter(m, ReasonPersistence, err)
+		return nil
+	}
+	delay := requeueDelay(m.Attempts, opts)
+	log.Printf("Message %s couldn't be persisted (attempt %v). Requeued in %v", m.ID[:], m.Attempts, delay)
+	nsqMessages.WithLabelValues(ResultRequeued).Inc()
+	m.Requeue(delay)
+	//The message has been requeued: the consumer doesn't requeue it again
+	return err
+}
@@ -0,0 +1,124 @@
+/*
+Driver location service for Zombie test.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	nsq "github.com/nsqio/go-nsq"
+	"github.com/stretchr/testify/assert"
+)
+
+//recordingDelegate Keeps the responses to NSQ (what a nsqd connection would send)
+type recordingDelegate struct {
+	finished bool
+	requeued bool
+	delay    time.Duration
+	backoff  bool
+}
+
+func (d *recordingDelegate) OnFinish(m *nsq.Message) { d.finished = true }
+func (d *recordingDelegate) OnRequeue(m *nsq.Message, delay time.Duration, backoff bool) {
+	d.requeued, d.delay, d.backoff = true, delay, backoff
+}
+func (d *recordingDelegate) OnTouch(m *nsq.Message) {}
+
+func Test_requeueDelay(t *testing.T) {
+	opts := nsqSettings(NsqServiceOptions{})
+	tests := []struct {
+		name     string
+		attempts uint16
+		opts     NsqServiceOptions
+		expected time.Duration
+	}{
+		//Test cases
+		{"First attempt", 1, opts, time.Second},
+		{"Second attempt", 2, opts, 2 * time.Second},
+		{"Fifth attempt", 5, opts, 16 * time.Second},
+		{"Capped", 12, opts, 300 * time.Second},
+		{"Configured delays", 3, NsqServiceOptions{RequeueDelay: 5, MaxRequeueDelay: 15}, 15 * time.Second},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, requeueDelay(tt.attempts, tt.opts), "Testing "+tt.name)
+	}
+}
+
+func Test_handleMessageRequeue(t *testing.T) {
+	//Redis is down
+	redisPool := newPool(Config.Redis.Host)
+	pool = newPool("127.0.0.1:1")
+	defer func() { pool = redisPool }()
+	publisher := &recordingPublisher{}
+	deadLetters = publisher
+	defer func() { deadLetters = nil }()
+	nsqOptions := Config.Nsq
+	Config.Nsq.MaxAttempts = 3
+	defer func() { Config.Nsq = nsqOptions }()
+	body := []byte(`{"driverId": "requeue001", "latitude": 48.864193, "longitude": 2.364988}`)
+	tests := []struct {
+		name             string
+		attempts         uint16
+		expectedRequeued bool
+		expectedDelay    time.Duration
+	}{
+		//Test cases
+		{"First attempt", 1, true, time.Second},
+		{"Second attempt", 2, true, 2 * time.Second},
+		{"Last attempt", 3, false, 0},
+	}
+	for _, tt := range tests {
+		var id nsq.MessageID
+		copy(id[:], "requeue000000001")
+		m := nsq.NewMessage(id, body)
+		m.Attempts = tt.attempts
+		m.Timestamp = time.Now().UnixNano()
+		delegate := &recordingDelegate{}
+		m.Delegate = delegate
+		err := handleMessage(m)
+		assert.Equal(t, tt.expectedRequeued, err != nil, "Testing "+tt.name)
+		assert.Equal(t, tt.expectedRequeued, delegate.requeued, "Testing "+tt.name)
+		if tt.expectedRequeued {
+			assert.Equal(t, tt.expectedDelay, delegate.delay, "Testing "+tt.name)
+			assert.True(t, delegate.backoff, "Testing "+tt.name)
+			assert.Equal(t, 0, len(publisher.messages), "Testing "+tt.name)
+			continue
+		}
+		//Given up: kept as a dead letter
+		if assert.Equal(t, 1, len(publisher.messages), "Testing "+tt.name) {
+			var letter DeadLetter
+			json.Unmarshal(publisher.messages[0], &letter)
+			assert.Equal(t, ReasonPersistence, letter.Reason, "Testing "+tt.name)
+			assert.Equal(t, string(body), letter.Body, "Testing "+tt.name)
+		}
+	}
+}
+
+func Test_persistMessageToRedisIdempotent(t *testing.T) {
+	pool = newPool(Config.Redis.Host)
+	conn := pool.Get()
+	defer conn.Close()
+	conn.Do("DEL", "driver:requeue002:log", "driver:requeue002:timeline", rejectedKey("requeue002"))
+	conn.Do("ZREM", "on-course", "requeue002")
+	now := time.Now().UnixNano() / 1e6
+	older := map[string]interface{}{"driverId": "requeue002", "latitude": 48.864193, "longitude": 2.364988, "timestamp": now - 5e3}
+	newer := map[string]interface{}{"driverId": "requeue002", "latitude": 48.864193, "longitude": 2.365088, "timestamp": now}
+	//The older message is redelivered after the newer one
+	for _, message := range []map[string]interface{}{older, newer, older, newer} {
+		assert.Nil(t, persistMessageToRedis(message))
+	}
+	count, _ := redis.Int(conn.Do("ZCARD", "driver:requeue002:timeline"))
+	assert.Equal(t, 2, count)
+	count, _ = redis.Int(conn.Do("ZCARD", "driver:requeue002:log"))
+	assert.Equal(t, 2, count)
+	assert.Nil(t, persistMessageToRedis(older))
+	current, _ := redis.Positions(conn.Do("GEOPOS", "on-course", "requeue002"))
+	if assert.NotNil(t, current[0]) {
+		assert.InDelta(t, 2.365088, current[0][0], 1e-5)
+	}
+}
@@ -0,0 +1,305 @@
+/*
+Driver location service for Zombie test.
+
+*/
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gomodule/redigo/redis"
+)
+
+//RetentionOptions describes how long the driver data is kept in Redis
+type RetentionOptions struct {
+	History      int `yaml:"history,omitempty"`        //Minutes of history kept for every key family without its own setting. 0 keeps everything
+	Locations    int `yaml:"locations,omitempty"`      //Minutes of locations kept for every driver (driver:<id>:log, driver:<id>:timeline). 0 uses History, -1 keeps everything
+	Rejected     int `yaml:"rejected,omitempty"`       //Minutes of outlier flags kept for every driver (driver:<id>:rejected). 0 uses History, -1 keeps everything
+	LastSeen     int `yaml:"last-seen,omitempty"`      //Minutes without locations before a driver is removed from drivers:last-seen. 0 uses History, -1 keeps everything
+	OnCourseIdle int `yaml:"on-course-idle,omitempty"` //Minutes without locations before a driver is removed from on-course (never before it is offline). 0 uses History, -1 keeps everything
+	Interval     int `yaml:"interval,omitempty"`       //Time (in seconds) between two maintenance runs
+	BatchSize    int `yaml:"batch-size,omitempty"`     //Number of keys (SCAN) or members (ZREM) handled by each Redis request
+}
+
+//RetentionStats describes what the maintenance loop removed
+type RetentionStats struct {
+	Runs                 uint64  `json:"runs"`
+	LastRun              string  `json:"lastRun,omitempty"`
+	LastDuration         float64 `json:"lastDuration"` //Duration (in seconds) of the last run
+	LastDrivers          int     `json:"lastDrivers"`  //Drivers whose history has been checked during the last run
+	LastLocationsRemoved int     `json:"lastLocationsRemoved"`
+	LastDriversEvicted   int     `json:"lastDriversEvicted"` //Idle drivers removed from on-course during the last run
+	LocationsRemoved     uint64  `json:"locationsRemoved"`
+	DriversEvicted       uint64  `json:"driversEvicted"`
+	LastError            string  `json:"lastError,omitempty"`
+}
+
+//DefaultRetentionInterval Default time (in seconds) between two maintenance runs
+const DefaultRetentionInterval = 60
+
+//DefaultRetentionBatchSize Default number of keys or members handled by each maintenance request
+const DefaultRetentionBatchSize = 100
+
+//expireScript Removes at most ARGV[2] members scored before ARGV[1] (Unix time in ms) in KEYS[1] from all the KEYS
+//(e.g. the locations of a driver from its timeline and log). It runs atomically and is bounded by the batch size,
+//so it doesn't block the location writes for long
+var expireScript = redis.NewScript(-1, `
+local members = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, ARGV[2])
+if #members > 0 then
+	for _, key in ipairs(KEYS) do
+		redis.call("ZREM", key, unpack(members))
+	end
+end
+return #members
+`)
+
+var (
+	retentionStats    RetentionStats //What the maintenance loop removed so far
+	retentionStatsMtx sync.Mutex
+)
+
+//retentionSettings Returns opts with default values for the missing settings
+func retentionSettings(opts RetentionOptions) RetentionOptions {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultRetentionInterval
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultRetentionBatchSize
+	}
+	return opts
+}
+
+//keep Returns the minutes a key family is kept (minutes is its own setting). 0 keeps everything
+func (opts RetentionOptions) keep(minutes int) int {
+	switch {
+	case minutes == 0:
+		return opts.History
+	case minutes < 0:
+		return 0
+	default:
+		return minutes
+	}
+}
+
+//retentionCutoff Returns the time (Unix time in ms) before which the data kept for minutes is removed. 0 if it is kept forever
+func retentionCutoff(now int64, minutes int) int64 {
+	if minutes <= 0 {
+		return 0
+	}
+	return now - int64(minutes)*60e3
+}
+
+//expireKeys Removes the members of keys[0] scored before cutoff (Unix time in ms) from all the keys, batchSize members at a time
+func expireKeys(conn redis.Conn, keys []string, cutoff int64, batchSize int) (removed int, err error) {
+	args := redis.Args{}.Add(len(keys)).AddFlat(keys).Add(cutoff, batchSize)
+	for {
+		n, err := redis.Int(expireScript.Do(conn, args...))
+		if err != nil {
+			return removed, err
+		}
+		removed += n
+		if n < batchSize {
+			return removed, nil
+		}
+	}
+}
+
+//trimDriverHistory Removes the locations of driver id older than cutoff and its outlier flags older than rejectedCutoff (Unix time in ms),
+//batchSize members at a time. A cutoff of 0 keeps everything. removed counts the locations
+func trimDriverHistory(conn redis.Conn, id string, cutoff, rejectedCutoff int64, batchSize int) (removed int, err error) {
+	if cutoff > 0 {
+		removed, err = expireKeys(conn, []string{"driver:" + id + ":timeline", "driver:" + id + ":log"}, cutoff, batchSize)
+		if err != nil {
+			return removed, err
+		}
+	}
+	if rejectedCutoff > 0 {
+		_, err = expireKeys(conn, []string{rejectedKey(id)}, rejectedCutoff, batchSize)
+	}
+	return removed, err
+}
+
+//scanKeys Calls fn for every key matching pattern, batchSize keys at a time
+func scanKeys(pattern string, batchSize int, fn func(conn redis.Conn, key string) error) error {
+	cursor := 0
+	for {
+		//A connection for each batch of keys: ingestion doesn't wait for the whole run
+		conn := pool.Get()
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", batchSize))
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		var keys []string
+		if _, err = redis.Scan(values, &cursor, &keys); err != nil {
+			conn.Close()
+			return err
+		}
+		for _, key := range keys {
+			if err = fn(conn, key); err != nil {
+				conn.Close()
+				return err
+			}
+		}
+		conn.Close()
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+//trimHistories Walks all the driver timelines and removes the locations older than cutoff, then all the outlier flags
+//(drivers without a timeline included) and removes the ones older than rejectedCutoff (Unix time in ms). A cutoff of 0 keeps everything
+func trimHistories(cutoff, rejectedCutoff int64, batchSize int) (drivers, removed int, err error) {
+	if cutoff > 0 {
+		err = scanKeys("driver:*:timeline", batchSize, func(conn redis.Conn, key string) error {
+			id := strings.TrimSuffix(strings.TrimPrefix(key, "driver:"), ":timeline")
+			n, err := trimDriverHistory(conn, id, cutoff, 0, batchSize)
+			removed += n
+			if err != nil {
+				return err
+			}
+			drivers++
+			return nil
+		})
+		if err != nil {
+			return drivers, removed, err
+		}
+	}
+	if rejectedCutoff > 0 {
+		err = scanKeys(rejectedKey("*"), batchSize, func(conn redis.Conn, key string) error {
+			_, err := expireKeys(conn, []string{key}, rejectedCutoff, batchSize)
+			return err
+		})
+	}
+	return drivers, removed, err
+}
+
+//seedLastSeen Adds the drivers of on-course that have never been seen (stored by previous versions) to the on-course last seen set,
+//as seen at now (Unix time in ms). They are evicted if they don't send any location before the online timeout
+func seedLastSeen(now int64, batchSize int) error {
+	conn := pool.Get()
+	defer conn.Close()
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("ZSCAN", "on-course", cursor, "COUNT", batchSize))
+		if err != nil {
+			return err
+		}
+		var members []string
+		if _, err = redis.Scan(values, &cursor, &members); err != nil {
+			return err
+		}
+		//ZSCAN replies with member, score pairs
+		args := redis.Args{}.Add(OnCourseLastSeenKey, "NX")
+		for i := 0; i < len(members); i += 2 {
+			args = args.Add(now, members[i])
+		}
+		if len(members) > 0 {
+			if _, err = conn.Do("ZADD", args...); err != nil {
+				return err
+			}
+		}
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+//expireMembers Works as expireKeys, with a connection for each batch: ingestion doesn't wait for the whole run
+func expireMembers(keys []string, cutoff int64, batchSize int) (removed int, err error) {
+	args := redis.Args{}.Add(len(keys)).AddFlat(keys).Add(cutoff, batchSize)
+	for {
+		conn := pool.Get()
+		n, err := redis.Int(expireScript.Do(conn, args...))
+		conn.Close()
+		if err != nil {
+			return removed, err
+		}
+		removed += n
+		if n < batchSize {
+			return removed, nil
+		}
+	}
+}
+
+//runRetention Applies the retention policy of every key family once and updates the stats.
+//Drivers are removed from on-course once they are idle, but never before they have been offline for onlineTimeout seconds
+func runRetention(opts RetentionOptions, onlineTimeout int) {
+	start := time.Now()
+	now := start.UnixNano() / 1e6
+	var (
+		drivers, removed, evicted int
+		errs                      []string
+	)
+	cutoff := retentionCutoff(now, opts.keep(opts.Locations))
+	rejectedCutoff := retentionCutoff(now, opts.keep(opts.Rejected))
+	if cutoff > 0 || rejectedCutoff > 0 {
+		var err error
+		drivers, removed, err = trimHistories(cutoff, rejectedCutoff, opts.BatchSize)
+		if err != nil {
+			log.Printf("Error in trimming driver histories: %v", err)
+			errs = append(errs, err.Error())
+		}
+	}
+	//Forgets the drivers not seen for a while
+	if lastSeenCutoff := retentionCutoff(now, opts.keep(opts.LastSeen)); lastSeenCutoff > 0 {
+		if _, err := expireMembers([]string{LastSeenKey}, lastSeenCutoff, opts.BatchSize); err != nil {
+			log.Printf("Error in trimming %v: %v", LastSeenKey, err)
+			errs = append(errs, err.Error())
+		}
+	}
+	if idleCutoff := retentionCutoff(now, opts.keep(opts.OnCourseIdle)); idleCutoff > 0 {
+		if offlineCutoff := now - int64(onlineTimeout)*1e3; offlineCutoff < idleCutoff {
+			idleCutoff = offlineCutoff
+		}
+		var err error
+		evicted, err = expireMembers([]string{OnCourseLastSeenKey, "on-course"}, idleCutoff, opts.BatchSize)
+		if err != nil {
+			log.Printf("Error in evicting idle drivers from on-course: %v", err)
+			errs = append(errs, err.Error())
+		}
+	}
+	duration := time.Since(start)
+	log.Printf("Retention run: %v drivers checked, %v locations removed, %v idle drivers removed from on-course in %v", drivers, removed, evicted, duration)
+	retentionStatsMtx.Lock()
+	defer retentionStatsMtx.Unlock()
+	retentionStats.Runs++
+	retentionStats.LastRun = start.UTC().Format(time.RFC3339)
+	retentionStats.LastDuration = duration.Seconds()
+	retentionStats.LastDrivers = drivers
+	retentionStats.LastLocationsRemoved = removed
+	retentionStats.LastDriversEvicted = evicted
+	retentionStats.LocationsRemoved += uint64(removed)
+	retentionStats.DriversEvicted += uint64(evicted)
+	retentionStats.LastError = strings.Join(errs, "; ")
+}
+
+//retentionLoop Applies the retention policy of every key family every opts.Interval seconds
+func retentionLoop(opts RetentionOptions, presence PresenceOptions) {
+	opts = retentionSettings(opts)
+	if opts.keep(opts.Locations) <= 0 {
+		log.Println("No retention policy for the locations. Driver history is kept forever")
+	}
+	if err := seedLastSeen(time.Now().UnixNano()/1e6, opts.BatchSize); err != nil {
+		log.Printf("Error in adding on-course drivers to %v: %v", OnCourseLastSeenKey, err)
+	}
+	for {
+		runRetention(opts, presence.onlineTimeout())
+		time.Sleep(time.Duration(opts.Interval) * time.Second)
+	}
+}
+
+//retentionStatsHandler Replies with what the maintenance loop removed
+func retentionStatsHandler(c *gin.Context) {
+	retentionStatsMtx.Lock()
+	stats := retentionStats
+	retentionStatsMtx.Unlock()
+	c.IndentedJSON(http.StatusOK, stats)
+}
@@ -0,0 +1,138 @@
+/*
+Driver location service for Zombie test.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_trimDriverHistory(t *testing.T) {
+	pool = newPool(Config.Redis.Host)
+	conn := pool.Get()
+	defer conn.Close()
+	//10 locations, one every 5 seconds up to now
+	timestamps := saveTestHistory(conn, "test005", 10)
+	//Removes the 7 oldest ones, 3 at a time
+	removed, err := trimDriverHistory(conn, "test005", timestamps[6], 0, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, 7, removed)
+	timeline, _ := redis.Int64s(conn.Do("ZRANGE", "driver:test005:timeline", 0, -1))
+	assert.Equal(t, timestamps[7:], timeline)
+	logCount, _ := redis.Int(conn.Do("ZCARD", "driver:test005:log"))
+	assert.Equal(t, 3, logCount)
+	//Nothing else to remove
+	removed, err = trimDriverHistory(conn, "test005", timestamps[6], 0, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, removed)
+}
+
+func Test_evictOfflineDrivers(t *testing.T) {
+	pool = newPool(Config.Redis.Host)
+	conn := pool.Get()
+	defer conn.Close()
+	now := time.Now().UnixNano() / 1e6
+	conn.Do("DEL", LastSeenKey, OnCourseLastSeenKey, "on-course")
+	conn.Do("GEOADD", "on-course", 2.364988, 48.864193, "idle001", 2.364988, 48.864193, "idle002", 2.364988, 48.864193, "active001", 2.364988, 48.864193, "legacy001")
+	conn.Do("ZADD", OnCourseLastSeenKey, now-3600e3, "idle001", now-7200e3, "idle002", now, "active001")
+	conn.Do("ZADD", LastSeenKey, now-3600e3, "idle001", now-7200e3, "idle002", now, "active001")
+	//legacy001 has never been seen: it is considered as seen now
+	assert.Nil(t, seedLastSeen(now, 2))
+	score, _ := redis.Int64(conn.Do("ZSCORE", OnCourseLastSeenKey, "legacy001"))
+	assert.Equal(t, now, score)
+	score, _ = redis.Int64(conn.Do("ZSCORE", OnCourseLastSeenKey, "idle001"))
+	assert.Equal(t, now-3600e3, score)
+	//Drivers idle for 5 minutes are removed from on-course, 1 at a time
+	runRetention(RetentionOptions{OnCourseIdle: 5, BatchSize: 1}, 300)
+	drivers, _ := redis.Strings(conn.Do("ZRANGE", "on-course", 0, -1))
+	assert.ElementsMatch(t, []string{"active001", "legacy001"}, drivers)
+	drivers, _ = redis.Strings(conn.Do("ZRANGE", OnCourseLastSeenKey, 0, -1))
+	assert.ElementsMatch(t, []string{"active001", "legacy001"}, drivers)
+	//Their last seen time is kept
+	drivers, _ = redis.Strings(conn.Do("ZRANGE", LastSeenKey, 0, -1))
+	assert.ElementsMatch(t, []string{"idle002", "idle001", "active001"}, drivers)
+	//... until it is older than the history
+	runRetention(RetentionOptions{History: 90, BatchSize: 1}, 300)
+	drivers, _ = redis.Strings(conn.Do("ZRANGE", LastSeenKey, 0, -1))
+	assert.ElementsMatch(t, []string{"idle001", "active001"}, drivers)
+}
+
+func Test_runRetentionKeyFamilies(t *testing.T) {
+	pool = newPool(Config.Redis.Host)
+	conn := pool.Get()
+	defer conn.Close()
+	now := time.Now().UnixNano() / 1e6
+	//Locations and outlier flags 3 hours, 1 hour and 1 minute old
+	timestamps := []int64{now - 180*60e3, now - 60*60e3, now - 60e3}
+	conn.Do("DEL", "driver:family001:log", "driver:family001:timeline", rejectedKey("family001"), rejectedKey("family006"))
+	for _, ts := range timestamps {
+		conn.Do("GEOADD", "driver:family001:log", 2.364988, 48.864193, ts)
+		conn.Do("ZADD", "driver:family001:timeline", ts, ts)
+		conn.Do("ZADD", rejectedKey("family001"), ts, ts)
+	}
+	//Outlier flags of a driver without a timeline (e.g. trimmed by a previous run)
+	conn.Do("ZADD", rejectedKey("family006"), timestamps[0], timestamps[0], timestamps[2], timestamps[2])
+	conn.Do("ZADD", LastSeenKey, now-120*60e3, "family002", now-200*60e3, "family003")
+	conn.Do("ZADD", OnCourseLastSeenKey, now-30*60e3, "family004", now-3*60e3, "family005")
+	conn.Do("GEOADD", "on-course", 2.364988, 48.864193, "family004", 2.364988, 48.864193, "family005")
+	defer conn.Do("ZREM", LastSeenKey, "family002", "family003")
+	defer conn.Do("ZREM", OnCourseLastSeenKey, "family004", "family005")
+	defer conn.Do("ZREM", "on-course", "family004", "family005")
+	defer conn.Do("DEL", rejectedKey("family006"))
+	//Locations use history, last-seen is kept forever, on-course-idle is shorter than the online timeout (5 minutes)
+	runRetention(RetentionOptions{History: 150, Rejected: 30, LastSeen: -1, OnCourseIdle: 1, BatchSize: 10}, 300)
+	tests := []struct {
+		name   string
+		key    string
+		member interface{}
+		kept   bool
+	}{
+		//Test cases
+		{"Location older than history", "driver:family001:timeline", timestamps[0], false},
+		{"Location within history", "driver:family001:timeline", timestamps[1], true},
+		{"Location log within history", "driver:family001:log", timestamps[1], true},
+		{"Outlier flag older than rejected", rejectedKey("family001"), timestamps[1], false},
+		{"Outlier flag within rejected", rejectedKey("family001"), timestamps[2], true},
+		{"Outlier flag older than rejected without timeline", rejectedKey("family006"), timestamps[0], false},
+		{"Outlier flag within rejected without timeline", rejectedKey("family006"), timestamps[2], true},
+		{"Last seen kept forever", LastSeenKey, "family003", true},
+		{"Idle and offline driver", OnCourseLastSeenKey, "family004", false},
+		{"Idle and offline driver position", "on-course", "family004", false},
+		{"Idle but online driver", OnCourseLastSeenKey, "family005", true},
+	}
+	for _, tt := range tests {
+		score, _ := conn.Do("ZSCORE", tt.key, tt.member)
+		assert.Equal(t, tt.kept, score != nil, "Testing "+tt.name)
+	}
+}
+
+func TestRetentionStatsRoute(t *testing.T) {
+	pool = newPool(Config.Redis.Host)
+	conn := pool.Get()
+	defer conn.Close()
+	//20 locations, one every 5 seconds: the 8 older than 1 minute are removed
+	saveTestHistory(conn, "test006", 20)
+	runRetention(RetentionOptions{History: 1, BatchSize: 2}, DefaultOnlineTimeout)
+	count, _ := redis.Int(conn.Do("ZCARD", "driver:test006:timeline"))
+	assert.True(t, count == 11 || count == 12, "%v locations kept", count)
+	router := setupRouter()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/_admin/retention", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var stats RetentionStats
+	json.Unmarshal(w.Body.Bytes(), &stats)
+	assert.True(t, stats.Runs >= 1)
+	assert.True(t, stats.LastDrivers >= 1)
+	assert.True(t, stats.LastLocationsRemoved >= 8)
+	assert.Equal(t, "", stats.LastError)
+}
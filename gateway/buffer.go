@@ -0,0 +1,475 @@
+/*
+Gateway service for Zombie test.
+
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//DefaultBufferMaxSize Default maximum size (in bytes) of a disk buffer
+const DefaultBufferMaxSize = 64 * 1024 * 1024
+
+//DefaultBufferRetryInterval Default time (in seconds) before the first replay retry. It doubles at every failure
+const DefaultBufferRetryInterval = 1
+
+//DefaultBufferMaxBackoff Default maximum time (in seconds) between two replay retries
+const DefaultBufferMaxBackoff = 60
+
+//recordHeaderSize Size of the header of a buffer record: enqueue time (8 bytes, Unix ns) + payload length (4 bytes)
+const recordHeaderSize = 12
+
+//errBufferFull is returned when a message doesn't fit in the buffer anymore
+var errBufferFull = errors.New("disk buffer is full")
+
+//errCorruptRecord is returned when a pending record can't be parsed (e.g. the buffer file has been altered)
+var errCorruptRecord = errors.New("corrupt buffer record")
+
+//BufferOptions describes the options of the disk buffer used when NSQ can't be reached
+type BufferOptions struct {
+	Dir           string `yaml:"dir,omitempty"`            //Directory of the buffer files. Buffering is disabled if empty
+	Name          string `yaml:"name,omitempty"`           //Name of the buffer file (<dir>/<name>.buffer). Defaults to the route topic
+	MaxSize       int64  `yaml:"max-size,omitempty"`       //Maximum size (in bytes) of the buffer
+	RetryInterval int    `yaml:"retry-interval,omitempty"` //Time (in seconds) before the first replay retry
+	MaxBackoff    int    `yaml:"max-backoff,omitempty"`    //Maximum time (in seconds) between two replay retries
+	Fsync         bool   `yaml:"fsync,omitempty"`          //Syncs the buffer file to disk after every append
+}
+
+//BufferStats describes the state of a disk buffer
+type BufferStats struct {
+	Name        string  `json:"name"`
+	Pending     int     `json:"pending"`
+	Bytes       int64   `json:"bytes"`
+	MaxSize     int64   `json:"maxSize"`
+	Lag         float64 `json:"lag"` //Age (in seconds) of the oldest pending message
+	Replayed    uint64  `json:"replayed"`
+	Rejected    uint64  `json:"rejected"`    //Messages refused because the buffer was full
+	Quarantined uint64  `json:"quarantined"` //Messages moved to the quarantine file (corrupt or refused by nsqd)
+	LastError   string  `json:"lastError,omitempty"`
+	RetryingIn  float64 `json:"retryingIn,omitempty"` //Seconds before the next replay attempt
+}
+
+//diskBuffer is a bounded write-ahead buffer on disk. Messages that can't be published are appended to it
+//and a background loop replays them in order (with retry and exponential backoff) once NSQ is back
+type diskBuffer struct {
+	mtx           sync.Mutex
+	name          string             //Buffer name (used for file names and stats)
+	path          string             //Path of the buffer file
+	topic         string             //Topic the buffered messages are replayed to
+	settings      BufferOptions      //Settings of the buffer (with default values), shared by the routes that use it
+	publisher     *nsqPublisher      //Publisher of the replayed messages
+	file          *os.File           //Buffer file (records are appended at its end)
+	offsetPath    string             //File that stores readOffset, to survive restarts
+	readOffset    int64              //Offset of the oldest pending record
+	size          int64              //Size of the buffer file
+	pending       int                //Number of pending records
+	oldest        time.Time          //Enqueue time of the oldest pending record
+	maxSize       int64              //Maximum size of the pending records
+	fsync         bool               //Syncs the file after every append
+	publish       func([]byte) error //Function that publishes a replayed message
+	retryInterval time.Duration      //Time before the first replay retry
+	maxBackoff    time.Duration      //Maximum time between two replay retries
+	wake          chan struct{}      //Wakes up the replay loop when a record is appended
+	replayed      uint64             //Number of messages replayed successfully
+	rejected      uint64             //Number of messages refused because the buffer was full
+	quarantined   uint64             //Number of messages moved to the quarantine file
+	lastError     string             //Last replay error
+	nextRetry     time.Time          //Time of the next replay attempt after a failure
+}
+
+//buffers holds the disk buffers created by the gateway, by file path
+var (
+	buffers    = make(map[string]*diskBuffer)
+	buffersMtx sync.Mutex
+)
+
+//bufferSettings Returns opts with default values for the missing settings
+func bufferSettings(opts BufferOptions, topic string) BufferOptions {
+	if opts.Name == "" {
+		opts.Name = topic
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = DefaultBufferMaxSize
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = DefaultBufferRetryInterval
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultBufferMaxBackoff
+	}
+	return opts
+}
+
+//getBuffer Returns the disk buffer of a route, creating it (and starting its replay loop) if needed.
+//Routes can share a buffer (same dir and name) only if they publish to the same topic and nsqd nodes with the same buffer settings
+func getBuffer(opts BufferOptions, topic string, publisher *nsqPublisher) (*diskBuffer, error) {
+	opts = bufferSettings(opts, topic)
+	path := filepath.Join(opts.Dir, opts.Name+".buffer")
+	buffersMtx.Lock()
+	defer buffersMtx.Unlock()
+	b, isThere := buffers[path]
+	if isThere {
+		if b.topic != topic || b.publisher != publisher || b.settings != opts {
+			return nil, fmt.Errorf("buffer %v is already used by another route with different settings. Set buffer.name to give each route its own buffer", path)
+		}
+		return b, nil
+	}
+	b, err := openDiskBuffer(path, opts.MaxSize, opts.Fsync)
+	if err != nil {
+		return nil, err
+	}
+	b.topic = topic
+	b.settings = opts
+	b.publisher = publisher
+	b.publish = func(body []byte) error {
+		return publisher.Publish(topic, body)
+	}
+	b.retryInterval = time.Duration(opts.RetryInterval) * time.Second
+	b.maxBackoff = time.Duration(opts.MaxBackoff) * time.Second
+	go b.replayLoop()
+	buffers[path] = b
+	return b, nil
+}
+
+//openDiskBuffer Opens (or creates) a buffer file and recovers its state
+func openDiskBuffer(path string, maxSize int64, fsync bool) (*diskBuffer, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, fmt.Errorf("can't create buffer directory. %v", err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("can't open buffer file. %v", err)
+	}
+	b := &diskBuffer{
+		name:       strings.TrimSuffix(filepath.Base(path), ".buffer"),
+		path:       path,
+		file:       file,
+		offsetPath: path + ".offset",
+		maxSize:    maxSize,
+		fsync:      fsync,
+		wake:       make(chan struct{}, 1),
+	}
+	//Reads the offset of the oldest pending record (if any)
+	offset, err := ioutil.ReadFile(b.offsetPath)
+	if err == nil {
+		b.readOffset, err = strconv.ParseInt(strings.TrimSpace(string(offset)), 10, 64)
+		if err != nil {
+			log.Printf("Buffer offset file %v is corrupted. Replaying from the beginning. %v", b.offsetPath, err)
+			b.readOffset = 0
+		}
+	}
+	//Counts the pending records. A partially written record (e.g. crash during an append) is discarded
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if b.readOffset > info.Size() {
+		b.readOffset = 0
+	}
+	b.size = b.readOffset
+	for b.size < info.Size() {
+		enqueuedAt, length, err := b.readHeader(b.size)
+		if err != nil || b.size+recordHeaderSize+length > info.Size() {
+			log.Printf("Discarding a partial record at the end of buffer %v", path)
+			break
+		}
+		if b.pending == 0 {
+			b.oldest = enqueuedAt
+		}
+		b.pending++
+		b.size = b.size + recordHeaderSize + length
+	}
+	if b.size < info.Size() {
+		err = file.Truncate(b.size)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	if b.pending > 0 {
+		log.Printf("Buffer %v has %v pending messages to replay", b.name, b.pending)
+	}
+	return b, nil
+}
+
+//readHeader Reads the header of the record at offset
+func (b *diskBuffer) readHeader(offset int64) (enqueuedAt time.Time, length int64, err error) {
+	header := make([]byte, recordHeaderSize)
+	_, err = b.file.ReadAt(header, offset)
+	if err != nil {
+		return enqueuedAt, 0, err
+	}
+	enqueuedAt = time.Unix(0, int64(binary.BigEndian.Uint64(header[0:8])))
+	length = int64(binary.BigEndian.Uint32(header[8:12]))
+	return enqueuedAt, length, nil
+}
+
+//Append Appends a message to the buffer. It fails with errBufferFull if the message doesn't fit
+func (b *diskBuffer) Append(body []byte) error {
+	return b.AppendAll([][]byte{body})
+}
+
+//AppendAll Appends messages to the buffer, all or none of them. It fails with errBufferFull if they don't all fit
+func (b *diskBuffer) AppendAll(bodies [][]byte) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	recordsSize := int64(0)
+	for _, body := range bodies {
+		recordsSize = recordsSize + int64(recordHeaderSize+len(body))
+	}
+	//Replayed records still in the file (before readOffset) don't count
+	if b.size-b.readOffset+recordsSize > b.maxSize {
+		b.rejected = b.rejected + uint64(len(bodies))
+		return errBufferFull
+	}
+	now := time.Now()
+	records := make([]byte, recordsSize)
+	offset := 0
+	for _, body := range bodies {
+		binary.BigEndian.PutUint64(records[offset:offset+8], uint64(now.UnixNano()))
+		binary.BigEndian.PutUint32(records[offset+8:offset+12], uint32(len(body)))
+		copy(records[offset+recordHeaderSize:], body)
+		offset = offset + recordHeaderSize + len(body)
+	}
+	_, err := b.file.WriteAt(records, b.size)
+	if err != nil {
+		//Drops what could have been written of the records
+		b.file.Truncate(b.size)
+		return fmt.Errorf("can't write to buffer. %v", err)
+	}
+	if b.fsync {
+		err = b.file.Sync()
+		if err != nil {
+			return fmt.Errorf("can't sync buffer. %v", err)
+		}
+	}
+	if b.pending == 0 {
+		b.oldest = now
+	}
+	b.pending = b.pending + len(bodies)
+	b.size = b.size + recordsSize
+	//Wakes up the replay loop (if it's waiting)
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+//Pending Returns the number of messages waiting to be replayed
+func (b *diskBuffer) Pending() int {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.pending
+}
+
+//peek Returns the oldest pending message, the offset of the following record and the number of records up to that offset.
+//count is 0 if the buffer is empty. A corrupt record fails with errCorruptRecord: the following records can't be found,
+//so next is the end of the buffer and count the number of pending records
+func (b *diskBuffer) peek() (body []byte, next int64, count int, err error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.pending == 0 {
+		return nil, 0, 0, nil
+	}
+	_, length, err := b.readHeader(b.readOffset)
+	if err == io.EOF || err == io.ErrUnexpectedEOF || err == nil && b.readOffset+recordHeaderSize+length > b.size {
+		return nil, b.size, b.pending, errCorruptRecord
+	}
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	body = make([]byte, length)
+	n, err := b.file.ReadAt(body, b.readOffset+recordHeaderSize)
+	if err != nil && (err != io.EOF || int64(n) < length) {
+		return nil, 0, 0, err
+	}
+	return body, b.readOffset + recordHeaderSize + length, 1, nil
+}
+
+//advance Marks the oldest pending message as replayed
+func (b *diskBuffer) advance(next int64) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.replayed++
+	b.release(next, 1)
+}
+
+//quarantine Moves count pending records (up to offset next) to the quarantine file (<path>.quarantine), so that they don't block the following ones
+func (b *diskBuffer) quarantine(next int64, count int, reason error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	records := make([]byte, next-b.readOffset)
+	_, err := b.file.ReadAt(records, b.readOffset)
+	if err == nil || err == io.EOF {
+		var file *os.File
+		file, err = os.OpenFile(b.path+".quarantine", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err == nil {
+			_, err = file.Write(records)
+			file.Close()
+		}
+	}
+	if err != nil {
+		log.Printf("Error in saving quarantined records of buffer %v. %v messages are lost. %v", b.name, count, err)
+	}
+	log.Printf("%v messages of buffer %v quarantined. %v", count, b.name, reason)
+	b.quarantined = b.quarantined + uint64(count)
+	b.lastError = reason.Error()
+	b.release(next, count)
+	nsqMessages.WithLabelValues(b.topic, ResultQuarantined).Add(float64(count))
+}
+
+//release Removes count pending records (up to offset next). The file is emptied when every message has been replayed,
+//and compacted when the replayed records take most of it. b.mtx must be held
+func (b *diskBuffer) release(next int64, count int) {
+	b.readOffset = next
+	b.pending = b.pending - count
+	if b.pending == 0 {
+		b.lastError = ""
+		err := b.file.Truncate(0)
+		if err != nil {
+			log.Printf("Error in truncating buffer %v. %v", b.name, err)
+		} else {
+			b.readOffset = 0
+			b.size = 0
+		}
+	} else {
+		enqueuedAt, _, err := b.readHeader(b.readOffset)
+		if err == nil {
+			b.oldest = enqueuedAt
+		}
+		if b.readOffset > b.size/2 && b.readOffset >= b.maxSize/4 {
+			err = b.compact()
+			if err != nil {
+				log.Printf("Error in compacting buffer %v. %v", b.name, err)
+			}
+		}
+	}
+	err := ioutil.WriteFile(b.offsetPath, []byte(strconv.FormatInt(b.readOffset, 10)), 0644)
+	if err != nil {
+		log.Printf("Error in saving offset of buffer %v. %v", b.name, err)
+	}
+}
+
+//compact Rewrites the buffer file without the replayed records. The pending records are copied to a new file that replaces the old one.
+//Compaction only happens when readOffset is past the middle of the file: if the gateway stops before the new offset is saved,
+//the old offset is beyond the end of the new file and the buffer is replayed from its beginning (see openDiskBuffer)
+func (b *diskBuffer) compact() error {
+	tmpPath := b.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, io.NewSectionReader(b.file, b.readOffset, b.size-b.readOffset))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, b.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	b.file.Close()
+	b.file = tmp
+	b.size = b.size - b.readOffset
+	b.readOffset = 0
+	return nil
+}
+
+//replayLoop Publishes the buffered messages in order. Failures (publishing or reading the buffer) are retried with exponential backoff.
+//Corrupt records and messages refused by nsqd are quarantined
+func (b *diskBuffer) replayLoop() {
+	backoff := b.retryInterval
+	for {
+		body, next, count, err := b.peek()
+		if err == errCorruptRecord {
+			b.quarantine(next, count, err)
+			continue
+		}
+		if err == nil && count == 0 {
+			//Nothing to replay. Waits for a new record
+			<-b.wake
+			continue
+		}
+		if err == nil {
+			err = b.publish(body)
+			if errors.Is(err, errMessageRejected) {
+				b.quarantine(next, count, err)
+				continue
+			}
+		}
+		if err != nil {
+			b.mtx.Lock()
+			b.lastError = err.Error()
+			b.nextRetry = time.Now().Add(backoff)
+			b.mtx.Unlock()
+			log.Printf("Replay of buffer %v failed. Retrying in %v. %v", b.name, backoff, err)
+			time.Sleep(backoff)
+			backoff = backoff * 2
+			if backoff > b.maxBackoff {
+				backoff = b.maxBackoff
+			}
+			continue
+		}
+		backoff = b.retryInterval
+		nsqMessages.WithLabelValues(b.topic, ResultReplayed).Inc()
+		b.advance(next)
+	}
+}
+
+//Stats Returns the state of the buffer
+func (b *diskBuffer) Stats() BufferStats {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	stats := BufferStats{
+		Name:        b.name,
+		Pending:     b.pending,
+		Bytes:       b.size - b.readOffset,
+		MaxSize:     b.maxSize,
+		Replayed:    b.replayed,
+		Rejected:    b.rejected,
+		Quarantined: b.quarantined,
+		LastError:   b.lastError,
+	}
+	if b.pending > 0 {
+		stats.Lag = time.Since(b.oldest).Seconds()
+		if wait := time.Until(b.nextRetry); wait > 0 {
+			stats.RetryingIn = wait.Seconds()
+		}
+	}
+	return stats
+}
+
+//bufferStats Handler that replies with the state of every disk buffer used by the gateway
+func bufferStats(c *gin.Context) {
+	buffersMtx.Lock()
+	stats := make([]BufferStats, 0)
+	for _, b := range buffers {
+		stats = append(stats, b.Stats())
+	}
+	buffersMtx.Unlock()
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	c.IndentedJSON(http.StatusOK, stats)
+}
@@ -0,0 +1,290 @@
+/*
+Gateway service for Zombie test.
+
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_getBuffer(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gateway-buffer")
+	defer os.RemoveAll(dir)
+	publisher, _ := newNsqPublisher([]string{"127.0.0.1:1"}, nil, time.Minute)
+	other, _ := newNsqPublisher([]string{"127.0.0.1:2"}, nil, time.Minute)
+	first, err := getBuffer(BufferOptions{Dir: dir, MaxSize: DefaultBufferMaxSize}, "routes", publisher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		opts      BufferOptions
+		topic     string
+		publisher *nsqPublisher
+		shared    bool
+		wantErr   bool
+	}{
+		//Test cases
+		{"Same settings (defaults)", BufferOptions{Dir: dir}, "routes", publisher, true, false},
+		{"Other max size", BufferOptions{Dir: dir, MaxSize: 1000}, "routes", publisher, false, true},
+		{"Other fsync", BufferOptions{Dir: dir, Fsync: true}, "routes", publisher, false, true},
+		{"Other nsqd nodes", BufferOptions{Dir: dir}, "routes", other, false, true},
+		{"Other topic with the same name", BufferOptions{Dir: dir, Name: "routes"}, "routes-batch", publisher, false, true},
+		{"Own buffer", BufferOptions{Dir: dir, Name: "routes-batch", MaxSize: 1000}, "routes", publisher, false, false},
+	}
+	for _, tt := range tests {
+		b, err := getBuffer(tt.opts, tt.topic, tt.publisher)
+		assert.Equal(t, tt.wantErr, err != nil, "Testing "+tt.name)
+		if err == nil {
+			assert.Equal(t, tt.shared, b == first, "Testing "+tt.name)
+		}
+	}
+}
+
+func Test_diskBuffer_Append(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gateway-buffer")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "locations.buffer")
+	b, err := openDiskBuffer(path, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, b.Append([]byte("first")))
+	assert.Nil(t, b.Append([]byte("second")))
+	assert.Equal(t, 2, b.Pending())
+	assert.Equal(t, int64(2*recordHeaderSize+len("first")+len("second")), b.Stats().Bytes)
+	//Buffer is bounded
+	assert.Equal(t, errBufferFull, b.Append(make([]byte, 100)))
+	assert.Equal(t, uint64(1), b.Stats().Rejected)
+	//Replays the first message and simulates a restart: only the second one is pending
+	body, next, count, _ := b.peek()
+	assert.Equal(t, 1, count)
+	assert.Equal(t, "first", string(body))
+	b.advance(next)
+	b.file.Close()
+	b, err = openDiskBuffer(path, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, b.Pending())
+	body, next, _, _ = b.peek()
+	assert.Equal(t, "second", string(body))
+	//Buffer file is emptied when everything has been replayed
+	b.advance(next)
+	assert.Equal(t, 0, b.Pending())
+	info, _ := os.Stat(path)
+	assert.Equal(t, int64(0), info.Size())
+}
+
+func Test_diskBuffer_AppendAll(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gateway-buffer")
+	defer os.RemoveAll(dir)
+	b, _ := openDiskBuffer(filepath.Join(dir, "locations.buffer"), 100, false)
+	assert.Nil(t, b.AppendAll([][]byte{[]byte("first"), []byte("second")}))
+	assert.Equal(t, 2, b.Pending())
+	//A batch that doesn't fit is refused as a whole: nothing is written
+	assert.Equal(t, errBufferFull, b.AppendAll([][]byte{[]byte("third"), make([]byte, 60)}))
+	stats := b.Stats()
+	assert.Equal(t, 2, stats.Pending)
+	assert.Equal(t, int64(2*recordHeaderSize+len("first")+len("second")), stats.Bytes)
+	assert.Equal(t, uint64(2), stats.Rejected)
+	for _, expected := range []string{"first", "second"} {
+		body, next, _, _ := b.peek()
+		assert.Equal(t, expected, string(body))
+		b.advance(next)
+	}
+	assert.Equal(t, 0, b.Pending())
+}
+
+func Test_diskBuffer_steadyTraffic(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gateway-buffer")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "locations.buffer")
+	b, _ := openDiskBuffer(path, 100, false)
+	//New messages keep coming while the buffer is replayed: pending never reaches 0
+	message := []byte("0123456789")
+	assert.Nil(t, b.Append(message))
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, b.Append(message), "Testing append %v", i)
+		body, next, count, _ := b.peek()
+		assert.Equal(t, 1, count)
+		assert.Equal(t, string(message), string(body))
+		b.advance(next)
+		assert.Equal(t, 1, b.Pending())
+	}
+	assert.Equal(t, uint64(0), b.Stats().Rejected)
+	assert.Equal(t, int64(recordHeaderSize+len(message)), b.Stats().Bytes)
+	//Replayed records have been dropped from the file
+	info, _ := os.Stat(path)
+	assert.True(t, info.Size() <= 100)
+	//The compacted buffer survives a restart
+	b.file.Close()
+	b, _ = openDiskBuffer(path, 100, false)
+	assert.Equal(t, 1, b.Pending())
+	body, _, _, _ := b.peek()
+	assert.Equal(t, string(message), string(body))
+}
+
+func Test_diskBuffer_quarantine(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gateway-buffer")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "locations.buffer")
+	b, _ := openDiskBuffer(path, 1000, false)
+	var mtx sync.Mutex
+	published := make([]string, 0)
+	//nsqd refuses the "too big" message
+	b.publish = func(body []byte) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if string(body) == "too big" {
+			return fmt.Errorf("%w by nsqd 127.0.0.1:4150: E_BAD_MESSAGE", errMessageRejected)
+		}
+		published = append(published, string(body))
+		return nil
+	}
+	b.retryInterval = 10 * time.Millisecond
+	b.maxBackoff = 20 * time.Millisecond
+	b.AppendAll([][]byte{[]byte("1"), []byte("too big"), []byte("2")})
+	go b.replayLoop()
+	for i := 0; i < 100 && b.Pending() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	mtx.Lock()
+	assert.Equal(t, []string{"1", "2"}, published)
+	mtx.Unlock()
+	assert.Equal(t, uint64(1), b.Stats().Quarantined)
+	quarantined, _ := ioutil.ReadFile(path + ".quarantine")
+	assert.Equal(t, recordHeaderSize+len("too big"), len(quarantined))
+	//A corrupt record: its length goes beyond the end of the buffer. It can't be replayed, nor the records after it
+	records := make([]byte, 2*(recordHeaderSize+1))
+	binary.BigEndian.PutUint32(records[8:12], 0xffffffff)
+	records[recordHeaderSize] = '3'
+	binary.BigEndian.PutUint32(records[recordHeaderSize+1+8:recordHeaderSize+1+12], 1)
+	records[2*recordHeaderSize+1] = '4'
+	b.mtx.Lock()
+	b.file.WriteAt(records, b.size)
+	b.size = b.size + int64(len(records))
+	b.pending = b.pending + 2
+	b.mtx.Unlock()
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+	for i := 0; i < 100 && b.Pending() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, uint64(3), b.Stats().Quarantined)
+	//The following records are replayed
+	b.Append([]byte("5"))
+	for i := 0; i < 100 && b.Pending() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	assert.Equal(t, []string{"1", "2", "5"}, published)
+}
+
+func Test_diskBuffer_readError(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gateway-buffer")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "locations.buffer")
+	b, _ := openDiskBuffer(path, 1000, false)
+	published := make(chan string, 10)
+	b.publish = func(body []byte) error {
+		published <- string(body)
+		return nil
+	}
+	b.retryInterval = 10 * time.Millisecond
+	b.maxBackoff = 20 * time.Millisecond
+	b.Append([]byte("1"))
+	//The buffer file can't be read: the record is neither lost nor skipped, and the replay is retried
+	file := b.file
+	b.file.Close()
+	_, _, count, err := b.peek()
+	assert.NotNil(t, err)
+	assert.NotEqual(t, errCorruptRecord, err)
+	assert.Equal(t, 0, count)
+	go b.replayLoop()
+	time.Sleep(50 * time.Millisecond)
+	stats := b.Stats()
+	assert.Equal(t, 1, stats.Pending)
+	assert.Equal(t, uint64(0), stats.Quarantined)
+	assert.NotEqual(t, "", stats.LastError)
+	//The file can be read again
+	b.mtx.Lock()
+	b.file, _ = os.OpenFile(file.Name(), os.O_RDWR, 0644)
+	b.mtx.Unlock()
+	select {
+	case body := <-published:
+		assert.Equal(t, "1", body)
+	case <-time.After(time.Second):
+		t.Error("Buffered message not replayed")
+	}
+}
+
+func Test_diskBuffer_partialRecord(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gateway-buffer")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "locations.buffer")
+	b, _ := openDiskBuffer(path, 1000, false)
+	b.Append([]byte("complete"))
+	b.Append([]byte("truncated"))
+	b.file.Close()
+	//Simulates a crash in the middle of the second append
+	os.Truncate(path, int64(2*recordHeaderSize+len("complete")+3))
+	b, err := openDiskBuffer(path, 1000, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, b.Pending())
+	body, _, _, _ := b.peek()
+	assert.Equal(t, "complete", string(body))
+}
+
+func Test_diskBuffer_replayLoop(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gateway-buffer")
+	defer os.RemoveAll(dir)
+	b, _ := openDiskBuffer(filepath.Join(dir, "locations.buffer"), 1000, false)
+	//NSQ is down for the first 2 attempts
+	var mtx sync.Mutex
+	attempts := 0
+	published := make([]string, 0)
+	b.publish = func(body []byte) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		attempts++
+		if attempts <= 2 {
+			return errors.New("nsqd is down")
+		}
+		published = append(published, string(body))
+		return nil
+	}
+	b.retryInterval = 10 * time.Millisecond
+	b.maxBackoff = 20 * time.Millisecond
+	b.Append([]byte("1"))
+	b.Append([]byte("2"))
+	b.Append([]byte("3"))
+	go b.replayLoop()
+	for i := 0; i < 100 && b.Pending() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	assert.Equal(t, []string{"1", "2", "3"}, published)
+	stats := b.Stats()
+	assert.Equal(t, 0, stats.Pending)
+	assert.Equal(t, uint64(3), stats.Replayed)
+	assert.Equal(t, "", stats.LastError)
+}
@@ -7,12 +7,19 @@ package main
 
 //Import statements
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"gopkg.in/yaml.v2"
@@ -34,13 +41,31 @@ type Endpoints struct {
 
 //NsqServiceOptions describes the options for the gateway to interact with NSQ messaging service
 type NsqServiceOptions struct {
-	Topic    string `yaml:"topic,omitempty"`    //Topic to post messages for async services
-	Nsqdhost string `yaml:"nsqdhost,omitempty"` //nsqd host:port that listens to HTTP clients
+	Topic             string        `yaml:"topic,omitempty"`              //Topic to post messages for async services
+	NsqdHosts         []string      `yaml:"nsqd-hosts,omitempty"`         //nsqd host:port list that listen to native (TCP) clients
+	NsqlookupdHosts   []string      `yaml:"nsqlookupd-hosts,omitempty"`   //nsqlookupd host:port list that listen to HTTP clients (nsqd discovery)
+	DiscoveryInterval int           `yaml:"discovery-interval,omitempty"` //Time (in seconds) between two nsqlookupd discoveries
+	RetryInterval     int           `yaml:"retry-interval,omitempty"`     //Time (in seconds) a failing nsqd node is skipped
+	Buffer            BufferOptions `yaml:"buffer,omitempty"`             //Disk buffer used when NSQ can't be reached
+	Batch             bool          `yaml:"batch,omitempty"`              //The route accepts an array of timestamped locations
+	MaxBatchSize      int           `yaml:"max-batch-size,omitempty"`     //Maximum number of locations in a batch
+	publisher         *nsqPublisher //Publisher shared by the routes with the same nsq hosts (set by prepare)
+	buffer            *diskBuffer   //Disk buffer of the route topic (set by prepare, nil if disabled)
 }
 
 //HTTPRestServiceOptions describes the options for the gateway regarding the HTTP REST APIs
 type HTTPRestServiceOptions struct {
-	Host string `yaml:"host,omitempty"` //Hostname
+	Host          string         `yaml:"host,omitempty"`          //Hostname
+	Path          string         `yaml:"path,omitempty"`          //Upstream path template (e.g. /drivers/:id/locations). Defaults to the route path
+	Rewrite       RewriteRule    `yaml:"rewrite,omitempty"`       //Rewrite rule applied to the upstream path after templating
+	ForwardQuery  bool           `yaml:"forward-query,omitempty"` //Passes the original querystring to the upstream service
+	rewriteRegexp *regexp.Regexp //Compiled Rewrite.Pattern (set by prepare)
+}
+
+//RewriteRule describes a regular expression based rewrite of the upstream path
+type RewriteRule struct {
+	Pattern     string `yaml:"pattern,omitempty"`     //Regular expression matched against the upstream path
+	Replacement string `yaml:"replacement,omitempty"` //Replacement string. Can reference capture groups ($1, ${name})
 }
 
 //CONSTANTS
@@ -48,6 +73,15 @@ type HTTPRestServiceOptions struct {
 //ConfigFileName Path of the config file
 const ConfigFileName string = "./config.yaml"
 
+//AdminPathPrefix Prefix of the gateway internal routes (e.g. NSQ stats)
+const AdminPathPrefix = "/_gateway"
+
+//DefaultMaxBatchSize Default maximum number of locations accepted by a batch route
+const DefaultMaxBatchSize = 100
+
+//ProxyFlushInterval Interval between flushes of a streamed upstream response to the client
+const ProxyFlushInterval = 100 * time.Millisecond
+
 //VARIABLES
 
 //Config is the struct that contains all the settings specified in config file
@@ -83,28 +117,131 @@ func init() {
 func setupRouter() *gin.Engine {
 	//Sets up the Gin framework router
 	router := gin.Default()
+	//Counts the requests and measures their latency
+	router.Use(metricsMiddleware)
 	//Builds the routes dynamically
 	for _, endpoint := range Config.Urls {
 		var handler func(*gin.Context)
 		if endpoint.Nsq.Topic != "" {
-			handler = endpoint.Nsq.nsqHandler
+			opts, err := endpoint.Nsq.prepare()
+			if err != nil {
+				log.Fatalf("Route %v %v can't be registered. %v", endpoint.Method, endpoint.Path, err)
+			}
+			handler = opts.nsqHandler
+			if opts.Batch {
+				handler = opts.nsqBatchHandler
+			}
 		} else if endpoint.HTTP.Host != "" {
-			handler = endpoint.HTTP.httpForward
+			opts, err := endpoint.HTTP.prepare(endpoint.Path)
+			if err != nil {
+				log.Fatalf("Route %v %v can't be registered. %v", endpoint.Method, endpoint.Path, err)
+			}
+			handler = opts.httpForward
 		}
 		router.Handle(endpoint.Method, endpoint.Path, handler)
 	}
+	//Gateway internal routes
+	router.GET(AdminPathPrefix+"/nsq", nsqStats)
+	router.GET(AdminPathPrefix+"/buffers", bufferStats)
+	router.GET(MetricsPath, metricsHandler)
 	return router
 }
 
+//prepare Validates the options and attaches the publisher of the route
+func (opts NsqServiceOptions) prepare() (NsqServiceOptions, error) {
+	publisher, err := getPublisher(opts)
+	if err != nil {
+		return opts, err
+	}
+	opts.publisher = publisher
+	//Store-and-forward buffer (if enabled)
+	if opts.Buffer.Dir != "" {
+		buffer, err := getBuffer(opts.Buffer, opts.Topic, publisher)
+		if err != nil {
+			return opts, err
+		}
+		opts.buffer = buffer
+	}
+	return opts, nil
+}
+
+//publish Publishes messages to the route topic (several messages are published in a single multi-publish call).
+//If NSQ can't be reached (or older messages are still waiting to be replayed) the messages are stored in the route disk buffer, if enabled
+func (opts NsqServiceOptions) publish(messages ...[]byte) (buffered bool, err error) {
+	defer func() {
+		result := ResultPublished
+		if err != nil {
+			result = ResultFailed
+		} else if buffered {
+			result = ResultBuffered
+		}
+		nsqMessages.WithLabelValues(opts.Topic, result).Add(float64(len(messages)))
+	}()
+	if opts.buffer != nil && opts.buffer.Pending() > 0 {
+		//Keeps the messages in order: they'll be published after the ones already in the buffer
+		return true, opts.buffer.AppendAll(messages)
+	}
+	if len(messages) == 1 {
+		err = opts.publisher.Publish(opts.Topic, messages[0])
+	} else {
+		err = opts.publisher.MultiPublish(opts.Topic, messages)
+	}
+	if err == nil || opts.buffer == nil || errors.Is(err, errMessageRejected) {
+		//A rejected message is not buffered: its replay would fail the same way
+		return false, err
+	}
+	log.Printf("Error in publishing to NSQ service. Buffering the messages. Error: %v", err)
+	return true, opts.buffer.AppendAll(messages)
+}
+
+//parseLocation Extracts [long, lat] from a parsed location payload. errMsg describes why the payload is not valid
+func parseLocation(parsedBody map[string]interface{}) (location [2]float64, errMsg string) {
+	//Has it the necessary fields?
+	longitude, isThereLongitude := parsedBody["longitude"]
+	latitude, isThereLatitude := parsedBody["latitude"]
+	if !isThereLongitude || !isThereLatitude {
+		//Missing fields
+		return location, "Missing latitude/longitude"
+	}
+	//Fields are there. Check if they are correctly typed
+	switch v := longitude.(type) {
+	case float64:
+		location[0] = v
+	default:
+		return location, "Longitude is not a number"
+	}
+	switch v := latitude.(type) {
+	case float64:
+		location[1] = v
+	default:
+		return location, "Latitude is not a number"
+	}
+	return location, ""
+}
+
+//parseRecordedAt Converts a recorded_at value (RFC3339 string or Unix time in milliseconds) to Unix time in milliseconds
+func parseRecordedAt(recordedAt interface{}) (int64, error) {
+	switch v := recordedAt.(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return 0, err
+		}
+		return t.UnixNano() / 1e6, nil
+	case float64:
+		if v < 0 || v != math.Trunc(v) {
+			return 0, fmt.Errorf("%v is not a valid Unix time in milliseconds", v)
+		}
+		return int64(v), nil
+	default:
+		return 0, fmt.Errorf("%v is neither a RFC3339 string nor a number", v)
+	}
+}
+
 //nsqHandler Saves the payload to a NSQ topic
 func (opts NsqServiceOptions) nsqHandler(c *gin.Context) {
 	//Extract paramenters from the path
 	id := c.Param("id")
-	// Extracts the host and topic from opts
-	host := opts.Nsqdhost
-	topic := opts.Topic
-	//Builds the url
-	url := "http://" + host + "/pub?topic=" + topic
 	//Reads the submitted body
 	body, err := ioutil.ReadAll(c.Request.Body)
 	if err != nil {
@@ -123,28 +260,10 @@ func (opts NsqServiceOptions) nsqHandler(c *gin.Context) {
 		c.String(http.StatusBadRequest, "Body is not a JSON.")
 		return
 	}
-	//Body is a JSON. Has it the necessary fields?
-	longitude, isThereLongitude := parsedBody["longitude"]
-	latitude, isThereLatitude := parsedBody["latitude"]
-	if !isThereLongitude || !isThereLatitude {
-		//Missing fields
-		c.String(http.StatusBadRequest, "Missing latitude/longitude")
-		return
-	}
-	//Fields are there. Check if they are correctly typed
-	var location [2]float64 //[long, lat]
-	switch v := longitude.(type) {
-	case float64:
-		location[0] = v
-	default:
-		c.String(http.StatusBadRequest, "Longitude is not a number")
-		return
-	}
-	switch v := latitude.(type) {
-	case float64:
-		location[1] = v
-	default:
-		c.String(http.StatusBadRequest, "Latitude is not a number")
+	//Body is a JSON. Has it the necessary (and correctly typed) fields?
+	location, errMsg := parseLocation(parsedBody)
+	if errMsg != "" {
+		c.String(http.StatusBadRequest, errMsg)
 		return
 	}
 	//Builds a message payload for NSQ service
@@ -153,6 +272,15 @@ func (opts NsqServiceOptions) nsqHandler(c *gin.Context) {
 		"longitude": location[0],
 		"latitude":  location[1],
 	}
+	//Time the device recorded the location (optional)
+	if recordedAt, isThere := parsedBody["recorded_at"]; isThere {
+		ts, err := parseRecordedAt(recordedAt)
+		if err != nil {
+			c.String(http.StatusBadRequest, "recorded_at is not a valid timestamp")
+			return
+		}
+		messagePayload["recordedAt"] = ts
+	}
 	//Builds the JSON message payload
 	message, err := json.MarshalIndent(messagePayload, "", "  ")
 	if err != nil {
@@ -160,44 +288,238 @@ func (opts NsqServiceOptions) nsqHandler(c *gin.Context) {
 		c.String(http.StatusInternalServerError, "Ooops. Something went wrong on our side.")
 		return
 	}
-	// Posts the message to NSQ service
-	log.Printf("POSTing to NSQ service: %s", string(message))
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(message))
+	//Publishes the message to NSQ service
+	log.Printf("Publishing to NSQ service: %s", string(message))
+	buffered, err := opts.publish(message)
 	if err != nil {
-		log.Printf("Error in POSTing topic to NSQ service. Error: %v", err)
+		log.Printf("Error in publishing to NSQ service. Error: %v", err)
 		c.String(http.StatusBadGateway, "Ooops. Something went wrong on our side.")
 		return
 	}
-	defer resp.Body.Close()
-	respBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("Problem in processing the response from NSQ service. Error returned %v", err)
-		c.String(http.StatusBadGateway, "Ooops. Something went wrong on our side.")
+	if buffered {
+		//Message will be published as soon as NSQ is back
+		c.String(http.StatusAccepted, "%v", "Got data!")
 		return
 	}
-	log.Printf("Answer from NSQ: %s", string(respBody))
 	c.String(http.StatusOK, "%v", "Got data!")
 }
 
-//httpForward Forwards the request to an external host (upstream) and gives back its answer to the requesting client
-func (opts HTTPRestServiceOptions) httpForward(c *gin.Context) {
+//BatchItemResult describes whether a location of a batch has been accepted
+type BatchItemResult struct {
+	Index    int    `json:"index"`
+	Accepted bool   `json:"accepted"`
+	Error    string `json:"error,omitempty"`
+}
+
+//nsqBatchHandler Saves a batch of timestamped locations of a driver to a NSQ topic, with a single multi-publish call
+func (opts NsqServiceOptions) nsqBatchHandler(c *gin.Context) {
+	//Extract paramenters from the path
 	id := c.Param("id")
-	host := opts.Host
-	log.Printf("ID: %v - Host %s", id, host)
-	resp, err := http.Get("http://" + host + "/drivers/" + id)
+	//Reads the submitted body
+	body, err := ioutil.ReadAll(c.Request.Body)
 	if err != nil {
-		log.Printf("We had a problem in forwarding your request to our systems. Error returned %s", err)
-		c.String(http.StatusBadGateway, "We had a problem in forwarding your request to our systems.")
-	} else {
-		defer resp.Body.Close()
-		body, err := ioutil.ReadAll(resp.Body)
+		//Answers with a 400 error
+		log.Printf("Client sent a wrongly formatted body. Error in ioutil.ReadAll(c.Request.Body): %v", err)
+		c.String(http.StatusBadRequest, "Body is wrongly formatted. %v", err)
+		return
+	}
+	//The body must be a JSON array of locations
+	var parsedBody []interface{}
+	err = json.Unmarshal(body, &parsedBody)
+	if err != nil {
+		log.Printf("Error while Unmarshaling body into JSON array. %v", err)
+		c.String(http.StatusBadRequest, "Body is not a JSON array.")
+		return
+	}
+	maxBatchSize := opts.MaxBatchSize
+	if maxBatchSize <= 0 {
+		maxBatchSize = DefaultMaxBatchSize
+	}
+	if len(parsedBody) == 0 {
+		c.String(http.StatusBadRequest, "Batch is empty")
+		return
+	}
+	if len(parsedBody) > maxBatchSize {
+		c.String(http.StatusBadRequest, "Batch has more than %v locations", maxBatchSize)
+		return
+	}
+	//Validates every location of the batch
+	results := make([]BatchItemResult, len(parsedBody))
+	messages := make([][]byte, 0, len(parsedBody))
+	for i, entry := range parsedBody {
+		results[i].Index = i
+		parsedEntry, ok := entry.(map[string]interface{})
+		if !ok {
+			results[i].Error = "Location is not a JSON object"
+			continue
+		}
+		location, errMsg := parseLocation(parsedEntry)
+		if errMsg != "" {
+			results[i].Error = errMsg
+			continue
+		}
+		recordedAt, isThere := parsedEntry["recorded_at"]
+		if !isThere {
+			results[i].Error = "Missing recorded_at"
+			continue
+		}
+		ts, err := parseRecordedAt(recordedAt)
+		if err != nil {
+			results[i].Error = "recorded_at is not a valid timestamp"
+			continue
+		}
+		message, err := json.Marshal(map[string]interface{}{
+			"driverId":   id,
+			"longitude":  location[0],
+			"latitude":   location[1],
+			"recordedAt": ts,
+		})
+		if err != nil {
+			log.Printf("Error in encoding json for NSQ service. Error: %v", err)
+			c.String(http.StatusInternalServerError, "Ooops. Something went wrong on our side.")
+			return
+		}
+		results[i].Accepted = true
+		messages = append(messages, message)
+	}
+	response := map[string]interface{}{
+		"accepted": len(messages),
+		"rejected": len(parsedBody) - len(messages),
+		"items":    results,
+	}
+	if len(messages) == 0 {
+		c.IndentedJSON(http.StatusBadRequest, response)
+		return
+	}
+	//Publishes the valid locations to NSQ service
+	log.Printf("Publishing %v locations of driver %v to NSQ service", len(messages), id)
+	buffered, err := opts.publish(messages...)
+	if err != nil {
+		log.Printf("Error in publishing to NSQ service. Error: %v", err)
+		c.String(http.StatusBadGateway, "Ooops. Something went wrong on our side.")
+		return
+	}
+	if buffered {
+		//Messages will be published as soon as NSQ is back
+		c.IndentedJSON(http.StatusAccepted, response)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, response)
+}
+
+//routeParams Returns the names of the path parameters (:name and *name) found in a route path
+func routeParams(path string) map[string]bool {
+	params := make(map[string]bool)
+	for _, segment := range strings.Split(path, "/") {
+		if len(segment) > 1 && (segment[0] == ':' || segment[0] == '*') {
+			params[segment[1:]] = true
+		}
+	}
+	return params
+}
+
+//prepare Validates the options against the route path and returns a copy ready to serve requests
+func (opts HTTPRestServiceOptions) prepare(routePath string) (HTTPRestServiceOptions, error) {
+	//By default the upstream path is the same as the path of the original request
+	if opts.Path == "" {
+		opts.Path = routePath
+	}
+	//Every parameter used in the template must be provided by the route
+	available := routeParams(routePath)
+	for param := range routeParams(opts.Path) {
+		if !available[param] {
+			return opts, fmt.Errorf("upstream path %v uses parameter %v that is not in the route path", opts.Path, param)
+		}
+	}
+	//Compiles the rewrite rule (if any)
+	if opts.Rewrite.Pattern != "" {
+		re, err := regexp.Compile(opts.Rewrite.Pattern)
 		if err != nil {
-			log.Printf("We had a problem in processing the response. Error returned %v", err)
-			c.String(http.StatusBadGateway, "We had a problem in processing the response.")
-		} else {
-			c.String(resp.StatusCode, "%s", string(body))
+			return opts, fmt.Errorf("rewrite pattern is not a valid regular expression. %v", err)
+		}
+		opts.rewriteRegexp = re
+	}
+	return opts, nil
+}
+
+//upstreamURL Builds the upstream URL by filling the path template with the request path parameters
+func (opts HTTPRestServiceOptions) upstreamURL(c *gin.Context) string {
+	segments := strings.Split(opts.Path, "/")
+	for i, segment := range segments {
+		if len(segment) < 2 {
+			continue
+		}
+		switch segment[0] {
+		case ':':
+			//Named parameter. Escaped to keep it in a single path segment
+			segments[i] = url.PathEscape(c.Param(segment[1:]))
+		case '*':
+			//Catch-all parameter. Gin includes its leading slash
+			segments[i] = strings.TrimPrefix(c.Param(segment[1:]), "/")
+		}
+	}
+	path := strings.Join(segments, "/")
+	//Applies the rewrite rule
+	if opts.rewriteRegexp != nil {
+		path = opts.rewriteRegexp.ReplaceAllString(path, opts.Rewrite.Replacement)
+	}
+	upstream := "http://" + opts.Host + path
+	//Passes the original querystring through
+	if opts.ForwardQuery && c.Request.URL.RawQuery != "" {
+		upstream = upstream + "?" + c.Request.URL.RawQuery
+	}
+	return upstream
+}
+
+//setForwardedHeaders Adds the X-Forwarded-* headers that describe the original request to an upstream request
+func setForwardedHeaders(upstreamReq *http.Request, original *http.Request) {
+	//X-Forwarded-For is appended by httputil.ReverseProxy using the client address.
+	//Host and protocol are kept if a front proxy (e.g. Nginx) has already set them
+	if upstreamReq.Header.Get("X-Forwarded-Host") == "" {
+		upstreamReq.Header.Set("X-Forwarded-Host", original.Host)
+	}
+	if upstreamReq.Header.Get("X-Forwarded-Proto") == "" {
+		proto := "http"
+		if original.TLS != nil {
+			proto = "https"
 		}
+		upstreamReq.Header.Set("X-Forwarded-Proto", proto)
+	}
+}
+
+//httpForward Forwards the request to an external host (upstream) and streams its answer back to the requesting client.
+//Method, body and end-to-end headers are forwarded, hop-by-hop headers are stripped (by httputil.ReverseProxy)
+//and upstream status code and headers are passed through
+func (opts HTTPRestServiceOptions) httpForward(c *gin.Context) {
+	upstream, err := url.Parse(opts.upstreamURL(c))
+	if err != nil {
+		log.Printf("We had a problem in building the upstream URL. Error returned %v", err)
+		c.String(http.StatusBadGateway, "We had a problem in forwarding your request to our systems.")
+		return
+	}
+	log.Printf("Forwarding %v to %s", c.Request.Method, upstream)
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = upstream.Scheme
+			req.URL.Host = upstream.Host
+			req.URL.Path = upstream.Path
+			req.URL.RawPath = upstream.RawPath
+			req.URL.RawQuery = upstream.RawQuery
+			req.Host = upstream.Host
+			setForwardedHeaders(req, c.Request)
+		},
+		FlushInterval: ProxyFlushInterval,
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			log.Printf("We had a problem in forwarding your request to our systems. Error returned %s", err)
+			c.String(http.StatusBadGateway, "We had a problem in forwarding your request to our systems.")
+		},
 	}
+	//Only the writer and flusher are exposed to the proxy: client disconnections are detected through the request context
+	writer := struct {
+		http.ResponseWriter
+		http.Flusher
+	}{c.Writer, c.Writer}
+	proxy.ServeHTTP(writer, c.Request)
 }
 
 func main() {
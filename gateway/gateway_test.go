@@ -8,12 +8,15 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -24,8 +27,14 @@ func TestIniConfig_getConfFromYaml(t *testing.T) {
 	var config IniConfig
 	var expectedConfig IniConfig
 	expectedConfig.Urls = []Endpoints{
-		{"/drivers/:id/locations", "PATCH", NsqServiceOptions{"locations", "localhost:4151"}, HTTPRestServiceOptions{}},
-		{"/drivers/:id", "GET", NsqServiceOptions{}, HTTPRestServiceOptions{"zombie-driver"}},
+		{"/drivers/:id/locations", "PATCH", NsqServiceOptions{Topic: "locations", NsqdHosts: []string{"localhost:4150"}, NsqlookupdHosts: []string{"localhost:4161"}}, HTTPRestServiceOptions{}},
+		{"/drivers/:id", "GET", NsqServiceOptions{}, HTTPRestServiceOptions{Host: "zombie-driver"}},
+		{"/v1/drivers/:id/locations", "GET", NsqServiceOptions{}, HTTPRestServiceOptions{
+			Host:         "driver-location",
+			Path:         "/v1/drivers/:id/locations",
+			Rewrite:      RewriteRule{Pattern: "^/v1", Replacement: ""},
+			ForwardQuery: true,
+		}},
 	}
 	expectedConfig.Port = 3000
 	var ar args
@@ -75,6 +84,8 @@ func TestNsqHandlerRoute(t *testing.T) {
 		{"Missing Lat", "", map[string]interface{}{"longitude": 48.864193}, http.StatusBadRequest, "Missing latitude/longitude"},
 		{"Empty body", "", map[string]interface{}{}, http.StatusBadRequest, "Missing latitude/longitude"},
 		{"Not a JSON", "ahahaha", map[string]interface{}{}, http.StatusBadRequest, "Body is not a JSON."},
+		{"With recorded_at", "", map[string]interface{}{"longitude": 2.364988, "latitude": 48.864193, "recorded_at": "2018-10-24T13:58:10Z"}, http.StatusOK, "Got data!"},
+		{"Wrong recorded_at", "", map[string]interface{}{"longitude": 2.364988, "latitude": 48.864193, "recorded_at": "yesterday"}, http.StatusBadRequest, "recorded_at is not a valid timestamp"},
 	}
 	for _, tt := range tests {
 		log.Printf("Testing %v", tt.name)
@@ -92,6 +103,65 @@ func TestNsqHandlerRoute(t *testing.T) {
 	}
 }
 
+func TestNsqBatchHandlerRoute(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		expectedCode int
+		expectedBody []string
+	}{
+		//Test Cases
+		{"Regular batch", `[{"longitude": 2.364988, "latitude": 48.864193, "recorded_at": "2018-10-24T13:58:10Z"}, {"longitude": 2.365988, "latitude": 48.864193, "recorded_at": 1540389495000}]`, http.StatusOK, []string{`"accepted": 2`, `"rejected": 0`}},
+		{"Partially valid batch", `[{"longitude": 2.364988, "latitude": 48.864193, "recorded_at": "2018-10-24T13:58:10Z"}, {"longitude": "2.365988", "latitude": 48.864193, "recorded_at": 1540389495000}]`, http.StatusOK, []string{`"accepted": 1`, `"rejected": 1`, `"error": "Longitude is not a number"`}},
+		{"Missing recorded_at", `[{"longitude": 2.364988, "latitude": 48.864193}]`, http.StatusBadRequest, []string{`"accepted": 0`, `"error": "Missing recorded_at"`}},
+		{"Wrong recorded_at", `[{"longitude": 2.364988, "latitude": 48.864193, "recorded_at": "yesterday"}]`, http.StatusBadRequest, []string{`"error": "recorded_at is not a valid timestamp"`}},
+		{"Not an object", `[42]`, http.StatusBadRequest, []string{`"error": "Location is not a JSON object"`}},
+		{"Empty batch", `[]`, http.StatusBadRequest, []string{"Batch is empty"}},
+		{"Not an array", `{"longitude": 2.364988, "latitude": 48.864193}`, http.StatusBadRequest, []string{"Body is not a JSON array."}},
+	}
+	for _, tt := range tests {
+		router := setupRouter()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/drivers/test001/locations/batch", strings.NewReader(tt.body))
+		req.Header.Set("Content-type", "application/json")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, tt.expectedCode, w.Code, "Testing "+tt.name)
+		for _, expected := range tt.expectedBody {
+			assert.Contains(t, w.Body.String(), expected, "Testing "+tt.name)
+		}
+	}
+}
+
+func Test_parseRecordedAt(t *testing.T) {
+	tests := []struct {
+		name       string
+		recordedAt interface{}
+		want       int64
+		wantErr    bool
+	}{
+		//Test cases
+		{"RFC3339", "2018-10-18T08:12:51Z", 1539850371000, false},
+		{"RFC3339 with milliseconds and offset", "2018-10-18T10:12:51.250+02:00", 1539850371250, false},
+		{"Unix time in milliseconds", float64(1539850371250), 1539850371250, false},
+		{"Not a date", "yesterday", 0, true},
+		{"Negative number", float64(-1), 0, true},
+		{"Fractional milliseconds", 1539850371250.5, 0, true},
+		{"Boolean", true, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRecordedAt(tt.recordedAt)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseRecordedAt() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("parseRecordedAt() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestHttpForwardRoute(t *testing.T) {
 	router := setupRouter()
 	w := httptest.NewRecorder()
@@ -99,5 +169,103 @@ func TestHttpForwardRoute(t *testing.T) {
 	router.ServeHTTP(w, req)
 
 	assert.Equal(t, 200, w.Code)
-	assert.Equal(t, "{\n    \"id\": \"test001\",\n    \"zombie\": true\n}", w.Body.String())
+	assert.Equal(t, "{\n    \"id\": \"test001\",\n    \"state\": \"zombie\",\n    \"strategy\": \"distance\",\n    \"zombie\": true\n}", w.Body.String())
+}
+
+func TestHTTPRestServiceOptions_upstreamURL(t *testing.T) {
+	tests := []struct {
+		name      string
+		routePath string
+		opts      HTTPRestServiceOptions
+		params    gin.Params
+		request   string
+		want      string
+		wantErr   bool
+	}{
+		//Test cases
+		{"Default path", "/drivers/:id", HTTPRestServiceOptions{Host: "zombie"}, gin.Params{{Key: "id", Value: "42"}}, "/drivers/42?a=b", "http://zombie/drivers/42", false},
+		{"Template with query", "/drivers/:id/locations", HTTPRestServiceOptions{Host: "dl", Path: "/drivers/:id/locations", ForwardQuery: true}, gin.Params{{Key: "id", Value: "42"}}, "/drivers/42/locations?minutes=5&distance=true", "http://dl/drivers/42/locations?minutes=5&distance=true", false},
+		{"Several params", "/fleets/:fleet/drivers/:id", HTTPRestServiceOptions{Host: "dl", Path: "/drivers/:id/fleet/:fleet"}, gin.Params{{Key: "fleet", Value: "north"}, {Key: "id", Value: "7"}}, "/fleets/north/drivers/7", "http://dl/drivers/7/fleet/north", false},
+		{"Escaped param", "/drivers/:id", HTTPRestServiceOptions{Host: "zombie", Path: "/drivers/:id"}, gin.Params{{Key: "id", Value: "a b"}}, "/drivers/a%20b", "http://zombie/drivers/a%20b", false},
+		{"Catch-all param", "/static/*file", HTTPRestServiceOptions{Host: "cdn", Path: "/assets/*file"}, gin.Params{{Key: "file", Value: "/img/logo.png"}}, "/static/img/logo.png", "http://cdn/assets/img/logo.png", false},
+		{"Rewrite rule", "/v1/drivers/:id", HTTPRestServiceOptions{Host: "zombie", Rewrite: RewriteRule{Pattern: "^/v1/(.*)$", Replacement: "/$1"}}, gin.Params{{Key: "id", Value: "42"}}, "/v1/drivers/42", "http://zombie/drivers/42", false},
+		{"Unknown param", "/drivers/:id", HTTPRestServiceOptions{Host: "zombie", Path: "/drivers/:driver"}, nil, "/drivers/42", "", true},
+		{"Wrong rewrite pattern", "/drivers/:id", HTTPRestServiceOptions{Host: "zombie", Rewrite: RewriteRule{Pattern: "(("}}, nil, "/drivers/42", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := tt.opts.prepare(tt.routePath)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("HTTPRestServiceOptions.prepare() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Params = tt.params
+			c.Request, _ = http.NewRequest("GET", tt.request, nil)
+			assert.Equal(t, tt.want, opts.upstreamURL(c), "Testing "+tt.name)
+		})
+	}
+}
+
+func TestHTTPRestServiceOptions_httpForward(t *testing.T) {
+	//Upstream service that echoes what it received
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("X-Upstream-Method", r.Method)
+		w.Header().Set("X-Upstream-Path", r.URL.RequestURI())
+		w.Header().Set("X-Upstream-Custom", r.Header.Get("X-Custom"))
+		w.Header().Set("X-Upstream-Hop", r.Header.Get("X-Hop"))
+		w.Header().Set("X-Upstream-Forwarded-For", r.Header.Get("X-Forwarded-For"))
+		w.Header().Set("X-Upstream-Forwarded-Host", r.Header.Get("X-Forwarded-Host"))
+		w.Header().Set("X-Upstream-Forwarded-Proto", r.Header.Get("X-Forwarded-Proto"))
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	}))
+	defer upstream.Close()
+	opts, err := HTTPRestServiceOptions{Host: strings.TrimPrefix(upstream.URL, "http://"), ForwardQuery: true}.prepare("/drivers/:id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	router.Any("/drivers/:id", opts.httpForward)
+	gateway := httptest.NewServer(router)
+	defer gateway.Close()
+
+	req, _ := http.NewRequest("POST", gateway.URL+"/drivers/test001?x=1", strings.NewReader(`{"hello":"world"}`))
+	req.Host = "gateway.example"
+	req.Header.Set("X-Custom", "kept")
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "dropped")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, `{"hello":"world"}`, string(body))
+	assert.Equal(t, "application/json; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "POST", resp.Header.Get("X-Upstream-Method"))
+	assert.Equal(t, "/drivers/test001?x=1", resp.Header.Get("X-Upstream-Path"))
+	assert.Equal(t, "kept", resp.Header.Get("X-Upstream-Custom"))
+	assert.Equal(t, "", resp.Header.Get("X-Upstream-Hop"))
+	assert.Equal(t, "127.0.0.1", resp.Header.Get("X-Upstream-Forwarded-For"))
+	assert.Equal(t, "gateway.example", resp.Header.Get("X-Upstream-Forwarded-Host"))
+	assert.Equal(t, "http", resp.Header.Get("X-Upstream-Forwarded-Proto"))
+
+	//Upstream not reachable
+	upstream.Close()
+	resp, err = http.Get(gateway.URL + "/drivers/test001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Equal(t, "We had a problem in forwarding your request to our systems.", string(body))
 }
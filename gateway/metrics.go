@@ -0,0 +1,96 @@
+/*
+Gateway service for Zombie test.
+
+*/
+
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+//MetricsPath Path of the Prometheus metrics endpoint
+const MetricsPath = "/metrics"
+
+//MetricsNamespace Prefix of the gateway metric names
+const MetricsNamespace = "gateway"
+
+//Results of a NSQ message published by a route
+const (
+	//ResultPublished The message has been published to NSQ
+	ResultPublished = "published"
+	//ResultBuffered The message has been stored in the route disk buffer
+	ResultBuffered = "buffered"
+	//ResultFailed The message could neither be published nor buffered
+	ResultFailed = "failed"
+	//ResultReplayed A buffered message has been published to NSQ
+	ResultReplayed = "replayed"
+	//ResultQuarantined A buffered message has been moved to the quarantine file (corrupt or refused by nsqd)
+	ResultQuarantined = "quarantined"
+)
+
+var (
+	//httpRequests Number of HTTP requests by route, method and status code
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Number of HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "status"})
+	//httpRequestDuration Latency of the HTTP requests by route and method
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of the HTTP requests by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+	//httpRequestsInFlight Number of HTTP requests being handled
+	httpRequestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "http",
+		Name:      "requests_in_flight",
+		Help:      "Number of HTTP requests being handled.",
+	})
+	//nsqMessages Number of messages of the NSQ routes by topic and result (published, buffered, failed, replayed)
+	nsqMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "nsq",
+		Name:      "messages_total",
+		Help:      "Number of messages of the NSQ routes by topic and result (published, buffered, failed, replayed).",
+	}, []string{"topic", "result"})
+	//nsqNodePublishes Number of publish calls by nsqd node and result (ok, error)
+	nsqNodePublishes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "nsq",
+		Name:      "node_publishes_total",
+		Help:      "Number of publish calls (a multi-publish is one call) by nsqd node and result (ok, error).",
+	}, []string{"nsqd", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(httpRequests, httpRequestDuration, httpRequestsInFlight, nsqMessages, nsqNodePublishes)
+}
+
+//metricsMiddleware Counts the HTTP requests and measures their latency, by route
+func metricsMiddleware(c *gin.Context) {
+	start := time.Now()
+	httpRequestsInFlight.Inc()
+	defer httpRequestsInFlight.Dec()
+	c.Next()
+	route := c.FullPath()
+	if route == "" {
+		//No route matched: keeps the cardinality bounded
+		route = "unmatched"
+	}
+	httpRequests.WithLabelValues(route, c.Request.Method, strconv.Itoa(c.Writer.Status())).Inc()
+	httpRequestDuration.WithLabelValues(route, c.Request.Method).Observe(time.Since(start).Seconds())
+}
+
+//metricsHandler Exposes the metrics in the Prometheus text format
+var metricsHandler = gin.WrapH(promhttp.Handler())
@@ -0,0 +1,44 @@
+/*
+Gateway service for Zombie test.
+
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsRoute(t *testing.T) {
+	router := setupRouter()
+	for _, path := range []string{AdminPathPrefix + "/nsq", "/unknown/path"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		router.ServeHTTP(w, req)
+	}
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", MetricsPath, nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `gateway_http_requests_total{method="GET",route="/_gateway/nsq",status="200"}`)
+	assert.Contains(t, w.Body.String(), `gateway_http_requests_total{method="GET",route="unmatched",status="404"}`)
+	assert.Contains(t, w.Body.String(), `gateway_http_request_duration_seconds_count{method="GET",route="/_gateway/nsq"}`)
+	assert.Contains(t, w.Body.String(), "gateway_http_requests_in_flight 1")
+}
+
+func TestNsqMessagesMetrics(t *testing.T) {
+	publisher, _ := newNsqPublisher([]string{"127.0.0.1:1"}, nil, time.Minute)
+	opts := NsqServiceOptions{Topic: "metrics", publisher: publisher}
+	failed := testutil.ToFloat64(nsqMessages.WithLabelValues("metrics", ResultFailed))
+	nodeErrors := testutil.ToFloat64(nsqNodePublishes.WithLabelValues("127.0.0.1:1", "error"))
+	_, err := opts.publish([]byte("{}"), []byte("{}"))
+	assert.NotNil(t, err)
+	assert.Equal(t, failed+2, testutil.ToFloat64(nsqMessages.WithLabelValues("metrics", ResultFailed)))
+	assert.Equal(t, nodeErrors+1, testutil.ToFloat64(nsqNodePublishes.WithLabelValues("127.0.0.1:1", "error")))
+}
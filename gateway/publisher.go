@@ -0,0 +1,380 @@
+/*
+Gateway service for Zombie test.
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	nsq "github.com/nsqio/go-nsq"
+)
+
+//Sources of a nsqd node
+const (
+	//NodeSourceStatic nsqd node listed in config file (nsqd-hosts)
+	NodeSourceStatic = "static"
+	//NodeSourceLookupd nsqd node discovered through nsqlookupd
+	NodeSourceLookupd = "nsqlookupd"
+)
+
+//DefaultDiscoveryInterval Default time (in seconds) between two nsqlookupd discoveries
+const DefaultDiscoveryInterval = 60
+
+//DefaultRetryInterval Default time (in seconds) a failing nsqd node is skipped before being tried again
+const DefaultRetryInterval = 5
+
+//errNoNsqdNodes is returned when a publisher doesn't know any nsqd node
+var errNoNsqdNodes = errors.New("no nsqd node available")
+
+//errMessageRejected is returned when nsqd refuses the message itself (e.g. too big). Publishing it again would fail the same way
+var errMessageRejected = errors.New("message rejected by nsqd")
+
+//isRejection Tells if err is nsqd refusing the message (not the node failing)
+func isRejection(err error) bool {
+	protocolErr, isProtocol := err.(nsq.ErrProtocol)
+	if !isProtocol {
+		return false
+	}
+	for _, code := range []string{"E_BAD_MESSAGE", "E_BAD_BODY", "E_BAD_TOPIC"} {
+		if strings.HasPrefix(protocolErr.Reason, code) {
+			return true
+		}
+	}
+	return false
+}
+
+//nsqNode is a nsqd node that the gateway publishes to through a long-lived go-nsq Producer
+type nsqNode struct {
+	address   string        //nsqd host:port that listens to native (TCP) clients
+	source    string        //How the node has been found (NodeSourceStatic/NodeSourceLookupd)
+	producer  *nsq.Producer //Producer connected to the node
+	published uint64        //Number of successful publish calls
+	errors    uint64        //Number of failed publish calls
+	downUntil int64         //Unix time (ns) until the node is skipped after a failure
+}
+
+//NsqNodeStats describes the publishing statistics of a nsqd node
+type NsqNodeStats struct {
+	Address   string `json:"address"`
+	Source    string `json:"source"`
+	Topics    string `json:"topics"`
+	Published uint64 `json:"published"`
+	Errors    uint64 `json:"errors"`
+	Down      bool   `json:"down"`
+}
+
+//nsqPublisher publishes messages to a pool of nsqd nodes, failing over between them
+type nsqPublisher struct {
+	mtx           sync.RWMutex
+	nodes         []*nsqNode    //Known nsqd nodes
+	lookupds      []string      //nsqlookupd host:port that listen to HTTP clients
+	topics        []string      //Topics published through the publisher (for stats)
+	cfg           *nsq.Config   //Config shared by all the producers
+	next          uint64        //Round-robin cursor
+	retryInterval time.Duration //Time a failing node is skipped
+	httpClient    *http.Client  //Client used to query nsqlookupd
+}
+
+//publishers holds the publishers created by the gateway. Routes with the same nsq hosts share the same publisher (and connections)
+var (
+	publishers    = make(map[string]*nsqPublisher)
+	publishersMtx sync.Mutex
+)
+
+//getPublisher Returns the publisher for the nsqd/nsqlookupd hosts of opts, creating it if needed
+func getPublisher(opts NsqServiceOptions) (*nsqPublisher, error) {
+	if len(opts.NsqdHosts) == 0 && len(opts.NsqlookupdHosts) == 0 {
+		return nil, errors.New("at least one of nsqd-hosts and nsqlookupd-hosts must be set")
+	}
+	key := strings.Join(opts.NsqdHosts, ",") + "|" + strings.Join(opts.NsqlookupdHosts, ",")
+	publishersMtx.Lock()
+	defer publishersMtx.Unlock()
+	p, isThere := publishers[key]
+	if !isThere {
+		discoveryInterval := opts.DiscoveryInterval
+		if discoveryInterval <= 0 {
+			discoveryInterval = DefaultDiscoveryInterval
+		}
+		retryInterval := opts.RetryInterval
+		if retryInterval <= 0 {
+			retryInterval = DefaultRetryInterval
+		}
+		var err error
+		p, err = newNsqPublisher(opts.NsqdHosts, opts.NsqlookupdHosts, time.Duration(retryInterval)*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		if len(opts.NsqlookupdHosts) > 0 {
+			go p.discoveryLoop(time.Duration(discoveryInterval) * time.Second)
+		}
+		publishers[key] = p
+	}
+	p.addTopic(opts.Topic)
+	return p, nil
+}
+
+//newNsqPublisher Creates a publisher for the given static nsqd nodes and runs a first nsqlookupd discovery
+func newNsqPublisher(nsqds, lookupds []string, retryInterval time.Duration) (*nsqPublisher, error) {
+	cfg := nsq.NewConfig()
+	cfg.DialTimeout = 5 * time.Second
+	cfg.UserAgent = fmt.Sprintf("gateway/%s go-nsq/%s", "0.1", nsq.VERSION)
+	p := &nsqPublisher{
+		lookupds:      lookupds,
+		cfg:           cfg,
+		retryInterval: retryInterval,
+		httpClient:    &http.Client{Timeout: 5 * time.Second},
+	}
+	for _, addr := range nsqds {
+		err := p.addNode(addr, NodeSourceStatic)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(lookupds) > 0 {
+		err := p.discover()
+		if err != nil {
+			//Not fatal: static nodes (if any) can be used and discovery is retried periodically
+			log.Printf("nsqlookupd discovery failed. %v", err)
+		}
+	}
+	return p, nil
+}
+
+//addTopic Records a topic published through the publisher
+func (p *nsqPublisher) addTopic(topic string) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for _, t := range p.topics {
+		if t == topic {
+			return
+		}
+	}
+	p.topics = append(p.topics, topic)
+}
+
+//addNode Adds a nsqd node (if not already known) and creates its producer
+func (p *nsqPublisher) addNode(addr, source string) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for _, node := range p.nodes {
+		if node.address == addr {
+			return nil
+		}
+	}
+	producer, err := nsq.NewProducer(addr, p.cfg)
+	if err != nil {
+		return fmt.Errorf("can't create a producer for nsqd %v. %v", addr, err)
+	}
+	producer.SetLogger(log.New(os.Stderr, "", log.Flags()), nsq.LogLevelWarning)
+	p.nodes = append(p.nodes, &nsqNode{address: addr, source: source, producer: producer})
+	log.Printf("nsqd node %v (%v) added", addr, source)
+	return nil
+}
+
+//lookupdNodes Queries a nsqlookupd for the list of nsqd nodes (host:port of TCP clients)
+func (p *nsqPublisher) lookupdNodes(lookupd string) ([]string, error) {
+	req, err := http.NewRequest("GET", "http://"+lookupd+"/nodes", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.nsq; version=1.0")
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("nsqlookupd %v answered with status code %v", lookupd, resp.StatusCode)
+	}
+	//nsqlookupd < 1.0 wraps the answer in a data object unless the versioned Accept header is honoured
+	type peer struct {
+		BroadcastAddress string `json:"broadcast_address"`
+		TCPPort          int    `json:"tcp_port"`
+	}
+	var parsedBody struct {
+		Producers []peer `json:"producers"`
+		Data      struct {
+			Producers []peer `json:"producers"`
+		} `json:"data"`
+	}
+	err = json.Unmarshal(body, &parsedBody)
+	if err != nil {
+		return nil, fmt.Errorf("nsqlookupd %v answer is not a valid JSON. %v", lookupd, err)
+	}
+	peers := append(parsedBody.Producers, parsedBody.Data.Producers...)
+	addresses := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		addresses = append(addresses, net.JoinHostPort(peer.BroadcastAddress, strconv.Itoa(peer.TCPPort)))
+	}
+	return addresses, nil
+}
+
+//discover Updates the nsqd nodes with the ones registered in nsqlookupd.
+//Discovered nodes that are no longer registered are removed
+func (p *nsqPublisher) discover() error {
+	discovered := make(map[string]bool)
+	failures := make([]error, 0)
+	for _, lookupd := range p.lookupds {
+		addresses, err := p.lookupdNodes(lookupd)
+		if err != nil {
+			failures = append(failures, err)
+			continue
+		}
+		for _, addr := range addresses {
+			discovered[addr] = true
+		}
+	}
+	if len(failures) == len(p.lookupds) {
+		//No nsqlookupd answered. Keeps the known nodes
+		return fmt.Errorf("no nsqlookupd answered: %v", failures)
+	}
+	for addr := range discovered {
+		err := p.addNode(addr, NodeSourceLookupd)
+		if err != nil {
+			log.Printf("%v", err)
+		}
+	}
+	//Removes the nodes that disappeared from nsqlookupd
+	p.mtx.Lock()
+	nodes := make([]*nsqNode, 0, len(p.nodes))
+	for _, node := range p.nodes {
+		if node.source == NodeSourceLookupd && !discovered[node.address] {
+			log.Printf("nsqd node %v is no longer registered in nsqlookupd. Removing it", node.address)
+			node.producer.Stop()
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	p.nodes = nodes
+	p.mtx.Unlock()
+	return nil
+}
+
+//discoveryLoop Runs nsqlookupd discovery every interval
+func (p *nsqPublisher) discoveryLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		err := p.discover()
+		if err != nil {
+			log.Printf("nsqlookupd discovery failed. %v", err)
+		}
+	}
+}
+
+//candidates Returns the nodes in the order they have to be tried: available nodes in round-robin order first,
+//then the nodes that recently failed (last resort)
+func (p *nsqPublisher) candidates() []*nsqNode {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	n := len(p.nodes)
+	if n == 0 {
+		return nil
+	}
+	now := time.Now().UnixNano()
+	start := int(atomic.AddUint64(&p.next, 1) % uint64(n))
+	available := make([]*nsqNode, 0, n)
+	down := make([]*nsqNode, 0)
+	for i := 0; i < n; i++ {
+		node := p.nodes[(start+i)%n]
+		if atomic.LoadInt64(&node.downUntil) > now {
+			down = append(down, node)
+		} else {
+			available = append(available, node)
+		}
+	}
+	return append(available, down...)
+}
+
+//publish Runs a publish function against the nodes until one of them succeeds
+func (p *nsqPublisher) publish(fn func(*nsq.Producer) error) error {
+	nodes := p.candidates()
+	if len(nodes) == 0 {
+		return errNoNsqdNodes
+	}
+	failures := make([]string, 0)
+	for _, node := range nodes {
+		err := fn(node.producer)
+		if err == nil {
+			nsqNodePublishes.WithLabelValues(node.address, "ok").Inc()
+			atomic.AddUint64(&node.published, 1)
+			atomic.StoreInt64(&node.downUntil, 0)
+			return nil
+		}
+		nsqNodePublishes.WithLabelValues(node.address, "error").Inc()
+		atomic.AddUint64(&node.errors, 1)
+		if isRejection(err) {
+			//The node works: other nodes would refuse the message as well
+			return fmt.Errorf("%w by nsqd %v: %v", errMessageRejected, node.address, err)
+		}
+		atomic.StoreInt64(&node.downUntil, time.Now().Add(p.retryInterval).UnixNano())
+		log.Printf("Publishing to nsqd %v failed. Trying next node. %v", node.address, err)
+		failures = append(failures, fmt.Sprintf("%v: %v", node.address, err))
+	}
+	return fmt.Errorf("publishing failed on every nsqd node: %v", strings.Join(failures, "; "))
+}
+
+//Publish Publishes a message to a topic
+func (p *nsqPublisher) Publish(topic string, body []byte) error {
+	return p.publish(func(producer *nsq.Producer) error {
+		return producer.Publish(topic, body)
+	})
+}
+
+//MultiPublish Publishes several messages to a topic in a single call
+func (p *nsqPublisher) MultiPublish(topic string, bodies [][]byte) error {
+	return p.publish(func(producer *nsq.Producer) error {
+		return producer.MultiPublish(topic, bodies)
+	})
+}
+
+//Stats Returns the publishing statistics of every known node
+func (p *nsqPublisher) Stats() []NsqNodeStats {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	now := time.Now().UnixNano()
+	stats := make([]NsqNodeStats, 0, len(p.nodes))
+	for _, node := range p.nodes {
+		stats = append(stats, NsqNodeStats{
+			Address:   node.address,
+			Source:    node.source,
+			Topics:    strings.Join(p.topics, ","),
+			Published: atomic.LoadUint64(&node.published),
+			Errors:    atomic.LoadUint64(&node.errors),
+			Down:      atomic.LoadInt64(&node.downUntil) > now,
+		})
+	}
+	return stats
+}
+
+//nsqStats Handler that replies with the publishing statistics of every nsqd node used by the gateway
+func nsqStats(c *gin.Context) {
+	publishersMtx.Lock()
+	stats := make([]NsqNodeStats, 0)
+	for _, p := range publishers {
+		stats = append(stats, p.Stats()...)
+	}
+	publishersMtx.Unlock()
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Address < stats[j].Address })
+	c.IndentedJSON(http.StatusOK, stats)
+}
@@ -0,0 +1,130 @@
+/*
+Gateway service for Zombie test.
+
+*/
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	nsq "github.com/nsqio/go-nsq"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_nsqPublisher_lookupdNodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		answer  string
+		code    int
+		want    []string
+		wantErr bool
+	}{
+		//Test cases
+		{"nsqlookupd >= 1.0", `{"producers":[{"broadcast_address":"10.0.0.1","tcp_port":4150},{"broadcast_address":"10.0.0.2","tcp_port":4152}]}`, http.StatusOK, []string{"10.0.0.1:4150", "10.0.0.2:4152"}, false},
+		{"nsqlookupd < 1.0", `{"status_code":200,"status_txt":"OK","data":{"producers":[{"broadcast_address":"10.0.0.3","tcp_port":4150}]}}`, http.StatusOK, []string{"10.0.0.3:4150"}, false},
+		{"No nodes", `{"producers":[]}`, http.StatusOK, []string{}, false},
+		{"Not a JSON", `ahahaha`, http.StatusOK, nil, true},
+		{"Error status", `{}`, http.StatusInternalServerError, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookupd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/nodes", r.URL.Path)
+				w.WriteHeader(tt.code)
+				w.Write([]byte(tt.answer))
+			}))
+			defer lookupd.Close()
+			p, _ := newNsqPublisher(nil, nil, time.Second)
+			got, err := p.lookupdNodes(strings.TrimPrefix(lookupd.URL, "http://"))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("nsqPublisher.lookupdNodes() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil {
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_nsqPublisher_discover(t *testing.T) {
+	answer := `{"producers":[{"broadcast_address":"127.0.0.1","tcp_port":1},{"broadcast_address":"127.0.0.1","tcp_port":2}]}`
+	lookupd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(answer))
+	}))
+	defer lookupd.Close()
+	p, err := newNsqPublisher([]string{"127.0.0.1:3"}, []string{strings.TrimPrefix(lookupd.URL, "http://")}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addresses := func() []string {
+		list := make([]string, 0)
+		for _, stats := range p.Stats() {
+			list = append(list, stats.Address+" "+stats.Source)
+		}
+		sort.Strings(list)
+		return list
+	}
+	assert.Equal(t, []string{"127.0.0.1:1 nsqlookupd", "127.0.0.1:2 nsqlookupd", "127.0.0.1:3 static"}, addresses())
+	//A node disappears from nsqlookupd. Static nodes are kept
+	answer = `{"producers":[{"broadcast_address":"127.0.0.1","tcp_port":2}]}`
+	assert.Nil(t, p.discover())
+	assert.Equal(t, []string{"127.0.0.1:2 nsqlookupd", "127.0.0.1:3 static"}, addresses())
+	//nsqlookupd is down. Known nodes are kept
+	lookupd.Close()
+	assert.NotNil(t, p.discover())
+	assert.Equal(t, []string{"127.0.0.1:2 nsqlookupd", "127.0.0.1:3 static"}, addresses())
+}
+
+func Test_nsqPublisher_Publish(t *testing.T) {
+	//No node at all
+	p, _ := newNsqPublisher(nil, nil, time.Minute)
+	assert.Equal(t, errNoNsqdNodes, p.Publish("locations", []byte("{}")))
+	//Unreachable nodes: every node is tried and its error counter is updated
+	p, _ = newNsqPublisher([]string{"127.0.0.1:1", "127.0.0.1:2"}, nil, time.Minute)
+	assert.NotNil(t, p.Publish("locations", []byte("{}")))
+	for _, stats := range p.Stats() {
+		assert.Equal(t, uint64(1), stats.Errors, stats.Address)
+		assert.Equal(t, uint64(0), stats.Published, stats.Address)
+		assert.True(t, stats.Down, stats.Address)
+	}
+}
+
+func Test_nsqPublisher_candidates(t *testing.T) {
+	p, _ := newNsqPublisher([]string{"127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3"}, nil, time.Minute)
+	//Marks the first node as failed: it has to be the last candidate
+	p.nodes[0].downUntil = time.Now().Add(time.Minute).UnixNano()
+	for i := 0; i < 3; i++ {
+		candidates := p.candidates()
+		assert.Equal(t, 3, len(candidates))
+		assert.Equal(t, "127.0.0.1:1", candidates[2].address)
+	}
+	//Round-robin between the available nodes
+	first := p.candidates()[0].address
+	second := p.candidates()[0].address
+	assert.NotEqual(t, first, second)
+}
+
+func Test_isRejection(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		//Test cases
+		{"Message too big", nsq.ErrProtocol{Reason: "E_BAD_MESSAGE PUB message too big 2000 > 1024"}, true},
+		{"Invalid topic", nsq.ErrProtocol{Reason: "E_BAD_TOPIC PUB topic name \"a b\" is not valid"}, true},
+		{"nsqd failure", nsq.ErrProtocol{Reason: "E_PUB_FAILED PUB failed exiting"}, false},
+		{"Connection error", errors.New("dial tcp 127.0.0.1:1: connect: connection refused"), false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, isRejection(tt.err), "Testing "+tt.name)
+	}
+}
@@ -0,0 +1,235 @@
+/*
+Zombie-service for Zombie test.
+Tells if a driver is a zombie or not
+
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+//DetectorOptions describes the zombie detection strategy
+type DetectorOptions struct {
+	Strategy string            `yaml:"strategy,omitempty"`  //distance (default), speed, displacement, all or any
+	MaxSpeed float64           `yaml:"max-speed,omitempty"` //speed: maximum average speed (in km/h) of a zombie. Default: zombie-mdc / zombie-e
+	Radius   float64           `yaml:"radius,omitempty"`    //displacement: maximum distance (in meters) of a zombie's locations from their center. Default: zombie-mdc / 2
+	Rules    []DetectorOptions `yaml:"rules,omitempty"`     //all, any: combined strategies
+}
+
+//TrackPoint is a location of a driver
+type TrackPoint struct {
+	Latitude  float64
+	Longitude float64
+	Time      int64 //Unix time in ms
+}
+
+//Track describes what a driver did during the evaluation window
+type Track struct {
+	Distance float64      //Distance (in meters) covered during the window
+	Window   float64      //Window (in minutes)
+	Points   []TrackPoint //Locations, from the oldest to the newest
+	AvgSpeed *float64     //Average speed (in km/h) given by driver-location (nil if unknown)
+}
+
+//Thresholds are the zombie definition parameters (zombie-e, zombie-mdc)
+type Thresholds struct {
+	Window      float64 //Window (in minutes) to evaluate a zombie state
+	MaxDistance float64 //Maximum distance (in meters) that a zombie can cover during the window
+}
+
+//Detector tells if a driver is a zombie
+type Detector interface {
+	//Name Returns the name of the strategy
+	Name() string
+	//Detect Tells if the track is the one of a zombie. fired is the name of the rule(s) that flagged the driver
+	Detect(track Track, thresholds Thresholds) (zombie bool, fired string)
+}
+
+//Detection strategies
+const (
+	//StrategyDistance Covered distance lower or equal to zombie-mdc (default)
+	StrategyDistance = "distance"
+	//StrategySpeed Average speed lower or equal to a maximum speed
+	StrategySpeed = "speed"
+	//StrategyDisplacement Locations inside a radius (drivers circling in place)
+	StrategyDisplacement = "displacement"
+	//StrategyAll Every rule flags the driver
+	StrategyAll = "all"
+	//StrategyAny At least one rule flags the driver
+	StrategyAny = "any"
+)
+
+//EarthRadius Earth radius (in meters) used by the haversine formula
+const EarthRadius = 6372797.560856
+
+//distanceDetector Flags the drivers that covered at most zombie-mdc meters during zombie-e minutes
+type distanceDetector struct{}
+
+func (d distanceDetector) Name() string {
+	return StrategyDistance
+}
+
+func (d distanceDetector) Detect(track Track, thresholds Thresholds) (bool, string) {
+	if track.Distance <= thresholds.MaxDistance {
+		return true, d.Name()
+	}
+	return false, ""
+}
+
+//speedDetector Flags the drivers whose average speed is at most maxSpeed km/h (zombie-mdc / zombie-e if 0)
+type speedDetector struct {
+	maxSpeed float64
+}
+
+func (d speedDetector) Name() string {
+	return StrategySpeed
+}
+
+//limit Returns the maximum average speed (in km/h) of a zombie
+func (d speedDetector) limit(thresholds Thresholds) float64 {
+	if d.maxSpeed > 0 {
+		return d.maxSpeed
+	}
+	return thresholds.MaxDistance / 1e3 / (thresholds.Window / 60)
+}
+
+func (d speedDetector) Detect(track Track, thresholds Thresholds) (bool, string) {
+	if averageSpeed(track) <= d.limit(thresholds) {
+		return true, d.Name()
+	}
+	return false, ""
+}
+
+//averageSpeed Returns the average speed (in km/h) given by driver-location or, if unknown, between the first and the last location
+//of a track (0 if there is no elapsed time)
+func averageSpeed(track Track) float64 {
+	if track.AvgSpeed != nil {
+		return *track.AvgSpeed
+	}
+	if len(track.Points) < 2 {
+		return 0
+	}
+	elapsed := float64(track.Points[len(track.Points)-1].Time-track.Points[0].Time) / 3600e3
+	if elapsed <= 0 {
+		return 0
+	}
+	return track.Distance / 1e3 / elapsed
+}
+
+//displacementDetector Flags the drivers whose locations are all within radius meters (zombie-mdc / 2 if 0) from their center
+type displacementDetector struct {
+	radius float64
+}
+
+func (d displacementDetector) Name() string {
+	return StrategyDisplacement
+}
+
+//limit Returns the maximum displacement (in meters) of a zombie
+func (d displacementDetector) limit(thresholds Thresholds) float64 {
+	if d.radius > 0 {
+		return d.radius
+	}
+	return thresholds.MaxDistance / 2
+}
+
+func (d displacementDetector) Detect(track Track, thresholds Thresholds) (bool, string) {
+	if displacement(track) <= d.limit(thresholds) {
+		return true, d.Name()
+	}
+	return false, ""
+}
+
+//displacement Returns the maximum distance (in meters) of the locations of a track from their center
+func displacement(track Track) float64 {
+	if len(track.Points) == 0 {
+		return 0
+	}
+	var center TrackPoint
+	for _, p := range track.Points {
+		center.Latitude += p.Latitude / float64(len(track.Points))
+		center.Longitude += p.Longitude / float64(len(track.Points))
+	}
+	max := 0.0
+	for _, p := range track.Points {
+		if d := haversine(center, p); d > max {
+			max = d
+		}
+	}
+	return max
+}
+
+//haversine Returns the distance (in meters) between two locations
+func haversine(a, b TrackPoint) float64 {
+	lat1 := a.Latitude * math.Pi / 180
+	lat2 := b.Latitude * math.Pi / 180
+	dLat := lat2 - lat1
+	dLon := (b.Longitude - a.Longitude) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * EarthRadius * math.Asin(math.Sqrt(h))
+}
+
+//combinedDetector Combines rules: a driver is a zombie if all of them (all) or one of them (any) flag it
+type combinedDetector struct {
+	strategy string
+	rules    []Detector
+}
+
+func (d combinedDetector) Name() string {
+	names := make([]string, len(d.rules))
+	for i, rule := range d.rules {
+		names[i] = rule.Name()
+	}
+	return fmt.Sprintf("%v(%v)", d.strategy, strings.Join(names, ","))
+}
+
+func (d combinedDetector) Detect(track Track, thresholds Thresholds) (bool, string) {
+	fired := make([]string, 0)
+	for _, rule := range d.rules {
+		zombie, name := rule.Detect(track, thresholds)
+		if zombie {
+			fired = append(fired, name)
+			if d.strategy == StrategyAny {
+				//The first rule that flags the driver is enough
+				return true, name
+			}
+		} else if d.strategy == StrategyAll {
+			return false, ""
+		}
+	}
+	if len(fired) == 0 {
+		return false, ""
+	}
+	return true, strings.Join(fired, ",")
+}
+
+//newDetector Builds the detector described by opts
+func newDetector(opts DetectorOptions) (Detector, error) {
+	switch opts.Strategy {
+	case "", StrategyDistance:
+		return distanceDetector{}, nil
+	case StrategySpeed:
+		return speedDetector{maxSpeed: opts.MaxSpeed}, nil
+	case StrategyDisplacement:
+		return displacementDetector{radius: opts.Radius}, nil
+	case StrategyAll, StrategyAny:
+		if len(opts.Rules) == 0 {
+			return nil, fmt.Errorf("strategy %v needs rules", opts.Strategy)
+		}
+		combined := combinedDetector{strategy: opts.Strategy}
+		for _, ruleOpts := range opts.Rules {
+			rule, err := newDetector(ruleOpts)
+			if err != nil {
+				return nil, err
+			}
+			combined.rules = append(combined.rules, rule)
+		}
+		return combined, nil
+	default:
+		return nil, fmt.Errorf("unknown strategy %v", opts.Strategy)
+	}
+}
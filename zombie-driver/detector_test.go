@@ -0,0 +1,113 @@
+/*
+Zombie-service for Zombie test.
+Tells if a driver is a zombie or not
+
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//testTrack Builds a track of points taken every minute (starting at a Unix time in ms) that covers distance meters
+func testTrack(distance float64, positions ...[2]float64) Track {
+	track := Track{Distance: distance, Window: 5}
+	for i, position := range positions {
+		track.Points = append(track.Points, TrackPoint{Latitude: position[0], Longitude: position[1], Time: 1540389600000 + int64(i)*60e3})
+	}
+	return track
+}
+
+func Test_newDetector(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         DetectorOptions
+		expectedName string
+		wantErr      bool
+	}{
+		//Test cases
+		{"Default", DetectorOptions{}, "distance", false},
+		{"Speed", DetectorOptions{Strategy: "speed", MaxSpeed: 10}, "speed", false},
+		{"Displacement", DetectorOptions{Strategy: "displacement"}, "displacement", false},
+		{"All", DetectorOptions{Strategy: "all", Rules: []DetectorOptions{{Strategy: "distance"}, {Strategy: "displacement"}}}, "all(distance,displacement)", false},
+		{"Nested", DetectorOptions{Strategy: "any", Rules: []DetectorOptions{{Strategy: "speed"}, {Strategy: "all", Rules: []DetectorOptions{{Strategy: "distance"}, {Strategy: "displacement"}}}}}, "any(speed,all(distance,displacement))", false},
+		{"Combined without rules", DetectorOptions{Strategy: "all"}, "", true},
+		{"Any without rules", DetectorOptions{Strategy: "any", Rules: []DetectorOptions{}}, "", true},
+		{"Nested combined without rules", DetectorOptions{Strategy: "all", Rules: []DetectorOptions{{Strategy: "distance"}, {Strategy: "any"}}}, "", true},
+		{"Unknown strategy", DetectorOptions{Strategy: "teleport"}, "", true},
+		{"Misspelled strategy", DetectorOptions{Strategy: "Distance"}, "", true},
+		{"Unknown nested strategy", DetectorOptions{Strategy: "any", Rules: []DetectorOptions{{Strategy: "teleport"}}}, "", true},
+	}
+	for _, tt := range tests {
+		detector, err := newDetector(tt.opts)
+		if tt.wantErr {
+			assert.NotNil(t, err, "Testing "+tt.name)
+			continue
+		}
+		if assert.Nil(t, err, "Testing "+tt.name) {
+			assert.Equal(t, tt.expectedName, detector.Name(), "Testing "+tt.name)
+		}
+	}
+}
+
+func Test_newDetectorConfig(t *testing.T) {
+	//The service doesn't start with an invalid strategy: the one of config.yaml must be valid
+	_, err := newDetector(Config.Detector)
+	assert.Nil(t, err)
+}
+
+func TestDetectors(t *testing.T) {
+	thresholds := Thresholds{Window: 5, MaxDistance: 500}
+	//Circling around Place de la République: ~600 meters covered, less than 100 meters from the center
+	circling := testTrack(600, [2]float64{48.8675, 2.3637}, [2]float64{48.8681, 2.3645}, [2]float64{48.8675, 2.3653}, [2]float64{48.8669, 2.3645}, [2]float64{48.8675, 2.3637})
+	//Driving straight on for ~1.2 km in 4 minutes (18 km/h)
+	driving := testTrack(1200, [2]float64{48.8675, 2.3637}, [2]float64{48.8702, 2.3637}, [2]float64{48.8729, 2.3637}, [2]float64{48.8756, 2.3637}, [2]float64{48.8783, 2.3637})
+	//Barely moving: 100 meters in 4 minutes (1.5 km/h)
+	parked := testTrack(100, [2]float64{48.8675, 2.3637}, [2]float64{48.8677, 2.3637}, [2]float64{48.8679, 2.3637}, [2]float64{48.8681, 2.3637}, [2]float64{48.8684, 2.3637})
+	//Average speed (in km/h) computed by driver-location
+	walking := 4.5
+	all := DetectorOptions{Strategy: "all", Rules: []DetectorOptions{{Strategy: "distance"}, {Strategy: "displacement"}}}
+	any := DetectorOptions{Strategy: "any", Rules: []DetectorOptions{{Strategy: "distance"}, {Strategy: "displacement"}}}
+	tests := []struct {
+		name          string
+		opts          DetectorOptions
+		track         Track
+		expected      bool
+		expectedFired string
+	}{
+		//Test cases
+		{"Distance: circling", DetectorOptions{Strategy: "distance"}, circling, false, ""},
+		{"Distance: parked", DetectorOptions{Strategy: "distance"}, parked, true, "distance"},
+		{"Speed: driving", DetectorOptions{Strategy: "speed"}, driving, false, ""},
+		{"Speed: parked", DetectorOptions{Strategy: "speed"}, parked, true, "speed"},
+		{"Speed: driving under max-speed", DetectorOptions{Strategy: "speed", MaxSpeed: 20}, driving, true, "speed"},
+		{"Speed: average speed given by driver-location", DetectorOptions{Strategy: "speed"}, Track{Distance: 1200, Points: driving.Points, AvgSpeed: &walking}, true, "speed"},
+		{"Speed: a single location", DetectorOptions{Strategy: "speed"}, testTrack(0, [2]float64{48.8675, 2.3637}), true, "speed"},
+		{"Displacement: circling", DetectorOptions{Strategy: "displacement"}, circling, true, "displacement"},
+		{"Displacement: driving", DetectorOptions{Strategy: "displacement"}, driving, false, ""},
+		{"Displacement: circling out of radius", DetectorOptions{Strategy: "displacement", Radius: 20}, circling, false, ""},
+		{"All: parked", all, parked, true, "distance,displacement"},
+		{"All: circling", all, circling, false, ""},
+		{"Any: circling", any, circling, true, "displacement"},
+		{"Any: driving", any, driving, false, ""},
+	}
+	for _, tt := range tests {
+		detector, err := newDetector(tt.opts)
+		if !assert.Nil(t, err, "Testing "+tt.name) {
+			continue
+		}
+		zombie, fired := detector.Detect(tt.track, thresholds)
+		assert.Equal(t, tt.expected, zombie, "Testing "+tt.name)
+		assert.Equal(t, tt.expectedFired, fired, "Testing "+tt.name)
+	}
+}
+
+func Test_haversine(t *testing.T) {
+	//Place de la République - Bastille
+	d := haversine(TrackPoint{Latitude: 48.867465, Longitude: 2.363717}, TrackPoint{Latitude: 48.853196, Longitude: 2.369068})
+	assert.InDelta(t, 1633, d, 5)
+	assert.Equal(t, 0.0, haversine(TrackPoint{Latitude: 48.867465, Longitude: 2.363717}, TrackPoint{Latitude: 48.867465, Longitude: 2.363717}))
+}
@@ -0,0 +1,147 @@
+/*
+Zombie-service for Zombie test.
+Tells if a driver is a zombie or not
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/gomodule/redigo/redis"
+	nsq "github.com/nsqio/go-nsq"
+)
+
+//EventsOptions describes where the zombie state changes are published
+type EventsOptions struct {
+	NsqdHost string `yaml:"nsqd-host,omitempty"` //nsqd host:port that listens to native clients. Events are disabled if empty
+	Topic    string `yaml:"topic,omitempty"`     //Topic of the state change events
+}
+
+//StateChangeEvent is published when the zombie state of a driver changes
+type StateChangeEvent struct {
+	Version   int     `json:"version"`
+	Type      string  `json:"type"`
+	DriverID  string  `json:"driverId"`
+	OldState  string  `json:"oldState"`
+	NewState  string  `json:"newState"`
+	Distance  float64 `json:"distance"`  //Distance (in meters) covered during the window
+	Window    float64 `json:"window"`    //Window (in minutes) of the evaluation
+	Timestamp int64   `json:"timestamp"` //Time of the evaluation (Unix time in ms)
+}
+
+//eventPublisher publishes messages to a topic (a go-nsq producer)
+type eventPublisher interface {
+	Publish(topic string, body []byte) error
+}
+
+//StatesKey Redis hash of the last state of every driver (field: driver id, value: state)
+const StatesKey = "zombie:states"
+
+//DefaultEventsTopic Default topic of the state change events
+const DefaultEventsTopic = "zombie-state-changes"
+
+//EventVersion Version of the state change events format
+const EventVersion = 1
+
+//StateChangeEventType Type of the state change events
+const StateChangeEventType = "zombie.state_changed"
+
+//Driver zombie states
+const (
+	//StateZombie The driver is a zombie
+	StateZombie = "zombie"
+	//StateAlive The driver is not a zombie
+	StateAlive = "alive"
+	//StateUnknown The driver has never been evaluated
+	StateUnknown = "unknown"
+	//StateInsufficientData There is too little data to judge the driver
+	StateInsufficientData = "insufficient_data"
+)
+
+//swapStateScript Sets the state of a driver (KEYS[1] hash, ARGV[1] driver id, ARGV[2] new state) and returns the previous one
+var swapStateScript = redis.NewScript(1, `
+local old = redis.call("HGET", KEYS[1], ARGV[1])
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+return old
+`)
+
+//events Publisher of the state change events (nil if disabled)
+var events eventPublisher
+
+//newEventPublisher Creates the publisher of the state change events. It returns nil if events are disabled
+func newEventPublisher(opts EventsOptions) eventPublisher {
+	if opts.NsqdHost == "" {
+		log.Println("No nsqd host. Zombie state changes won't be published")
+		return nil
+	}
+	cfg := nsq.NewConfig()
+	cfg.UserAgent = fmt.Sprintf("zombie-driver/%s go-nsq/%s", "0.1", nsq.VERSION)
+	producer, err := nsq.NewProducer(opts.NsqdHost, cfg)
+	if err != nil {
+		log.Printf("A problem occurred in initializing NSQ Producer: %v", err)
+		return nil
+	}
+	producer.SetLogger(log.New(os.Stderr, "", log.Flags()), nsq.LogLevelWarning)
+	return producer
+}
+
+//verdictState Returns the state of a verdict (verdicts stored before states were introduced are zombie or alive)
+func verdictState(verdict Verdict) string {
+	if verdict.State != "" {
+		return verdict.State
+	}
+	if verdict.Zombie {
+		return StateZombie
+	}
+	return StateAlive
+}
+
+//trackState Updates the last state of a driver and publishes an event if it has changed.
+//If the event can't be published, the previous state is restored so the change is published by the next evaluation.
+//Verdicts without enough data don't change the state of the driver
+func trackState(conn redis.Conn, verdict Verdict, publisher eventPublisher, topic string) error {
+	newState := verdictState(verdict)
+	if newState == StateInsufficientData {
+		return nil
+	}
+	oldState, err := redis.String(swapStateScript.Do(conn, StatesKey, verdict.ID, newState))
+	if err == redis.ErrNil {
+		oldState = StateUnknown
+	} else if err != nil {
+		return err
+	}
+	if oldState == newState || publisher == nil {
+		return nil
+	}
+	if topic == "" {
+		topic = DefaultEventsTopic
+	}
+	event := StateChangeEvent{
+		Version:   EventVersion,
+		Type:      StateChangeEventType,
+		DriverID:  verdict.ID,
+		OldState:  oldState,
+		NewState:  newState,
+		Distance:  verdict.Distance,
+		Window:    verdict.Window,
+		Timestamp: verdict.EvaluatedAt,
+	}
+	body, _ := json.Marshal(event)
+	if err = publisher.Publish(topic, body); err != nil {
+		nsqPublished.WithLabelValues(topic, "error").Inc()
+		if oldState == StateUnknown {
+			conn.Do("HDEL", StatesKey, verdict.ID)
+		} else {
+			conn.Do("HSET", StatesKey, verdict.ID, oldState)
+		}
+		return err
+	}
+	nsqPublished.WithLabelValues(topic, "ok").Inc()
+	log.Printf("Driver %v is now %v (was %v)", verdict.ID, newState, oldState)
+	return nil
+}
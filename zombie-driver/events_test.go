@@ -0,0 +1,83 @@
+/*
+Zombie-service for Zombie test.
+Tells if a driver is a zombie or not
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+//recordingPublisher Keeps the published messages. It fails when err is set
+type recordingPublisher struct {
+	topics   []string
+	messages []StateChangeEvent
+	err      error
+}
+
+func (p *recordingPublisher) Publish(topic string, body []byte) error {
+	if p.err != nil {
+		return p.err
+	}
+	var event StateChangeEvent
+	json.Unmarshal(body, &event)
+	p.topics = append(p.topics, topic)
+	p.messages = append(p.messages, event)
+	return nil
+}
+
+func Test_trackState(t *testing.T) {
+	pool = newPool(Config.Redis.Host)
+	conn := pool.Get()
+	defer conn.Close()
+	conn.Do("HDEL", StatesKey, "event001")
+	publisher := &recordingPublisher{}
+	steps := []struct {
+		name      string
+		verdict   Verdict
+		published []string //old and new state of the published event (nil if no event)
+		err       bool
+	}{
+		//Test cases
+		{"First verdict", Verdict{ID: "event001", Zombie: false, Distance: 800, Window: 5, EvaluatedAt: 1540389600000}, []string{StateUnknown, StateAlive}, false},
+		{"Same state", Verdict{ID: "event001", Zombie: false, Distance: 700, Window: 5, EvaluatedAt: 1540389660000}, nil, false},
+		{"Becomes a zombie", Verdict{ID: "event001", Zombie: true, Distance: 12.5, Window: 5, EvaluatedAt: 1540389720000}, []string{StateAlive, StateZombie}, false},
+		{"Recovers but NSQ is down", Verdict{ID: "event001", Zombie: false, Distance: 600, Window: 5, EvaluatedAt: 1540389780000}, nil, true},
+		{"Recovers", Verdict{ID: "event001", Zombie: false, Distance: 650, Window: 5, EvaluatedAt: 1540389840000}, []string{StateZombie, StateAlive}, false},
+	}
+	for _, step := range steps {
+		publisher.messages = nil
+		publisher.err = nil
+		if step.err {
+			publisher.err = errors.New("nsqd is down")
+		}
+		err := trackState(conn, step.verdict, publisher, "zombies")
+		assert.Equal(t, step.err, err != nil, step.name)
+		if step.published == nil {
+			assert.Equal(t, 0, len(publisher.messages), step.name)
+			continue
+		}
+		if assert.Equal(t, 1, len(publisher.messages), step.name) {
+			assert.Equal(t, StateChangeEvent{
+				Version:   EventVersion,
+				Type:      StateChangeEventType,
+				DriverID:  "event001",
+				OldState:  step.published[0],
+				NewState:  step.published[1],
+				Distance:  step.verdict.Distance,
+				Window:    5,
+				Timestamp: step.verdict.EvaluatedAt,
+			}, publisher.messages[0], step.name)
+			assert.Equal(t, "zombies", publisher.topics[len(publisher.topics)-1], step.name)
+		}
+	}
+	state, _ := redis.String(conn.Do("HGET", StatesKey, "event001"))
+	assert.Equal(t, StateAlive, state)
+}
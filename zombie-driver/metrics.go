@@ -0,0 +1,193 @@
+/*
+Zombie-service for Zombie test.
+Tells if a driver is a zombie or not
+
+*/
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gomodule/redigo/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+//MetricsPath Path of the Prometheus metrics endpoint
+const MetricsPath = "/metrics"
+
+//MetricsNamespace Prefix of the zombie-driver metric names
+const MetricsNamespace = "zombie_driver"
+
+var (
+	//httpRequests Number of HTTP requests by route, method and status code
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Number of HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "status"})
+	//httpRequestDuration Latency of the HTTP requests by route and method
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of the HTTP requests by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+	//httpRequestsInFlight Number of HTTP requests being handled
+	httpRequestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "http",
+		Name:      "requests_in_flight",
+		Help:      "Number of HTTP requests being handled.",
+	})
+	//verdicts Number of verdicts given by state (zombie, alive, insufficient_data) and strategy
+	verdicts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "verdicts_total",
+		Help:      "Number of verdicts given by state (zombie, alive, insufficient_data) and strategy.",
+	}, []string{"state", "strategy"})
+	//evaluationErrors Number of driver evaluations without verdict by status code (404: unknown driver)
+	evaluationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "evaluation_errors_total",
+		Help:      "Number of driver evaluations without verdict by status code (404: unknown driver).",
+	}, []string{"status"})
+	//nsqPublished Number of state change events published to NSQ by topic and result (ok, error)
+	nsqPublished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "nsq",
+		Name:      "published_events_total",
+		Help:      "Number of state change events published to NSQ by topic and result (ok, error).",
+	}, []string{"topic", "result"})
+	//redisCommandDuration Latency of the Redis commands by command. A pipelined command is measured from Send to the Receive of its reply
+	redisCommandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "redis",
+		Name:      "command_duration_seconds",
+		Help:      "Latency of the Redis commands by command. A pipelined command is measured from Send to the Receive of its reply.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 8),
+	}, []string{"command"})
+	//redisCommandErrors Number of Redis commands that failed by command
+	redisCommandErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "redis",
+		Name:      "command_errors_total",
+		Help:      "Number of Redis commands that failed by command.",
+	}, []string{"command"})
+)
+
+func init() {
+	prometheus.MustRegister(httpRequests, httpRequestDuration, httpRequestsInFlight, verdicts, evaluationErrors, nsqPublished,
+		redisCommandDuration, redisCommandErrors)
+	//Redis pool stats, read when the metrics are scraped
+	poolStat := func(stat func(redis.PoolStats) float64) func() float64 {
+		return func() float64 {
+			if pool == nil {
+				return 0
+			}
+			return stat(pool.Stats())
+		}
+	}
+	prometheus.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: MetricsNamespace,
+			Subsystem: "redis",
+			Name:      "pool_active_connections",
+			Help:      "Number of connections in the Redis pool (in use or idle).",
+		}, poolStat(func(stats redis.PoolStats) float64 { return float64(stats.ActiveCount) })),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: MetricsNamespace,
+			Subsystem: "redis",
+			Name:      "pool_idle_connections",
+			Help:      "Number of idle connections in the Redis pool.",
+		}, poolStat(func(stats redis.PoolStats) float64 { return float64(stats.IdleCount) })),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: MetricsNamespace,
+			Subsystem: "redis",
+			Name:      "pool_waits_total",
+			Help:      "Number of times a connection of the Redis pool has been waited for.",
+		}, poolStat(func(stats redis.PoolStats) float64 { return float64(stats.WaitCount) })),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: MetricsNamespace,
+			Subsystem: "redis",
+			Name:      "pool_wait_duration_seconds_total",
+			Help:      "Time spent waiting for a connection of the Redis pool.",
+		}, poolStat(func(stats redis.PoolStats) float64 { return stats.WaitDuration.Seconds() })),
+	)
+}
+
+//metricsMiddleware Counts the HTTP requests and measures their latency, by route
+func metricsMiddleware(c *gin.Context) {
+	start := time.Now()
+	httpRequestsInFlight.Inc()
+	defer httpRequestsInFlight.Dec()
+	c.Next()
+	route := c.FullPath()
+	if route == "" {
+		//No route matched: keeps the cardinality bounded
+		route = "unmatched"
+	}
+	httpRequests.WithLabelValues(route, c.Request.Method, strconv.Itoa(c.Writer.Status())).Inc()
+	httpRequestDuration.WithLabelValues(route, c.Request.Method).Observe(time.Since(start).Seconds())
+}
+
+//metricsHandler Exposes the metrics in the Prometheus text format
+var metricsHandler = gin.WrapH(promhttp.Handler())
+
+//sentCommand A pipelined Redis command waiting for its reply
+type sentCommand struct {
+	name   string
+	sentAt time.Time
+}
+
+//instrumentedConn Measures the latency of the Redis commands sent over a connection
+type instrumentedConn struct {
+	redis.Conn
+	pending []sentCommand //Pipelined commands, in order
+}
+
+//observeRedisCommand Records the latency of a Redis command started at start
+func observeRedisCommand(name string, start time.Time, err error) {
+	name = strings.ToUpper(name)
+	redisCommandDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	if err != nil {
+		redisCommandErrors.WithLabelValues(name).Inc()
+	}
+}
+
+//Do Sends a command and waits for its reply. Pipelined commands are received as well
+func (c *instrumentedConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	start := time.Now()
+	reply, err := c.Conn.Do(commandName, args...)
+	for _, command := range c.pending {
+		observeRedisCommand(command.name, command.sentAt, nil)
+	}
+	c.pending = c.pending[:0]
+	if commandName != "" {
+		observeRedisCommand(commandName, start, err)
+	}
+	return reply, err
+}
+
+//Send Pipelines a command
+func (c *instrumentedConn) Send(commandName string, args ...interface{}) error {
+	c.pending = append(c.pending, sentCommand{commandName, time.Now()})
+	return c.Conn.Send(commandName, args...)
+}
+
+//Receive Receives the reply of the oldest pipelined command
+func (c *instrumentedConn) Receive() (interface{}, error) {
+	reply, err := c.Conn.Receive()
+	if len(c.pending) > 0 {
+		command := c.pending[0]
+		c.pending = c.pending[1:]
+		observeRedisCommand(command.name, command.sentAt, err)
+	}
+	return reply, err
+}
@@ -0,0 +1,43 @@
+/*
+Zombie-service for Zombie test.
+Tells if a driver is a zombie or not
+
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	pool = newPool(Config.Redis.Host)
+	stubDriverLocation(t, map[string]float64{"metrics001": 50, "metrics002": 900})
+	strategy := detector.Name()
+	zombies := testutil.ToFloat64(verdicts.WithLabelValues(StateZombie, strategy))
+	alive := testutil.ToFloat64(verdicts.WithLabelValues(StateAlive, strategy))
+	notFound := testutil.ToFloat64(evaluationErrors.WithLabelValues("404"))
+	for _, id := range []string{"metrics001", "metrics002", "metrics003"} {
+		evaluateAndStore(id)
+	}
+	assert.Equal(t, zombies+1, testutil.ToFloat64(verdicts.WithLabelValues(StateZombie, strategy)))
+	assert.Equal(t, alive+1, testutil.ToFloat64(verdicts.WithLabelValues(StateAlive, strategy)))
+	assert.Equal(t, notFound+1, testutil.ToFloat64(evaluationErrors.WithLabelValues("404")))
+	//HTTP and Redis metrics
+	router := setupRouter()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/fleet/report", nil)
+	router.ServeHTTP(w, req)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", MetricsPath, nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `zombie_driver_http_requests_total{method="GET",route="/fleet/report",status="200"}`)
+	assert.Contains(t, w.Body.String(), `zombie_driver_redis_command_duration_seconds_count{command="HSET"}`)
+	assert.Contains(t, w.Body.String(), "zombie_driver_redis_pool_idle_connections")
+}
@@ -0,0 +1,310 @@
+/*
+Zombie-service for Zombie test.
+Tells if a driver is a zombie or not
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gomodule/redigo/redis"
+)
+
+//ScannerOptions describes the options of the background zombie scanner
+type ScannerOptions struct {
+	Interval      int `yaml:"interval,omitempty"`        //Time (in seconds) between two scans. 0 disables the scanner
+	Concurrency   int `yaml:"concurrency,omitempty"`     //Maximum number of drivers evaluated at the same time
+	VerdictMaxAge int `yaml:"verdict-max-age,omitempty"` //Age (in seconds) after which a stored verdict isn't used anymore
+	BatchSize     int `yaml:"batch-size,omitempty"`      //Number of drivers read from on-course by each ZSCAN request
+}
+
+//ScanStats describes the last scan of the active drivers
+type ScanStats struct {
+	StartedAt        string  `json:"startedAt,omitempty"`
+	Duration         float64 `json:"duration"` //Duration (in seconds)
+	Drivers          int     `json:"drivers"`  //Drivers evaluated
+	Zombies          int     `json:"zombies"`
+	InsufficientData int     `json:"insufficientData"` //Drivers without enough data to be judged
+	Errors           int     `json:"errors"`           //Drivers that couldn't be evaluated
+	Pruned           int     `json:"pruned"`           //Stored verdicts removed because they were too old
+}
+
+//FleetReport describes the zombie state of the fleet, according to the stored verdicts
+type FleetReport struct {
+	Drivers          int       `json:"drivers"` //Drivers with a recent verdict
+	Zombies          int       `json:"zombies"`
+	Alive            int       `json:"alive"`
+	InsufficientData int       `json:"insufficientData"` //Drivers without enough data to be judged
+	LastScan         ScanStats `json:"lastScan"`
+	ZombieList       []Verdict `json:"zombieList"`
+}
+
+//VerdictsKey Redis hash of the last verdict of every driver (field: driver id, value: JSON verdict)
+const VerdictsKey = "zombie:verdicts"
+
+//DefaultScannerConcurrency Default maximum number of drivers evaluated at the same time
+const DefaultScannerConcurrency = 10
+
+//DefaultVerdictMaxAge Default age (in seconds) after which a stored verdict isn't used anymore
+const DefaultVerdictMaxAge = 120
+
+//DefaultScannerBatchSize Default number of drivers read from on-course by each ZSCAN request
+const DefaultScannerBatchSize = 100
+
+var (
+	lastScan    ScanStats //Stats of the last scan
+	lastScanMtx sync.Mutex
+)
+
+//scannerSettings Returns opts with default values for the missing settings
+func scannerSettings(opts ScannerOptions) ScannerOptions {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = DefaultScannerConcurrency
+	}
+	if opts.VerdictMaxAge <= 0 {
+		opts.VerdictMaxAge = DefaultVerdictMaxAge
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultScannerBatchSize
+	}
+	return opts
+}
+
+//storeVerdict Saves the verdict of a driver
+func storeVerdict(conn redis.Conn, verdict Verdict) error {
+	value, err := json.Marshal(verdict)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("HSET", VerdictsKey, verdict.ID, value)
+	return err
+}
+
+//loadVerdict Returns the stored verdict of driver id. found is false if there isn't any
+func loadVerdict(conn redis.Conn, id string) (verdict Verdict, found bool, err error) {
+	value, err := redis.Bytes(conn.Do("HGET", VerdictsKey, id))
+	if err == redis.ErrNil {
+		return verdict, false, nil
+	}
+	if err != nil {
+		return verdict, false, err
+	}
+	err = json.Unmarshal(value, &verdict)
+	return verdict, err == nil, err
+}
+
+//evaluateAndStore Evaluates driver id, stores its verdict and publishes its state change (if any).
+//The verdict of a driver unknown to driver-location is removed
+func evaluateAndStore(id string) (verdict Verdict, statusCode int) {
+	verdict, statusCode = isZombie(id)
+	conn := pool.Get()
+	defer conn.Close()
+	switch statusCode {
+	case http.StatusOK:
+		verdicts.WithLabelValues(verdictState(verdict), verdict.Strategy).Inc()
+		if err := storeVerdict(conn, verdict); err != nil {
+			log.Printf("Error in storing the verdict of driver %v: %v", id, err)
+		}
+		if err := trackState(conn, verdict, events, Config.Events.Topic); err != nil {
+			log.Printf("Error in publishing the state change of driver %v: %v", id, err)
+		}
+	case http.StatusNotFound:
+		evaluationErrors.WithLabelValues(strconv.Itoa(statusCode)).Inc()
+		conn.Do("HDEL", VerdictsKey, id)
+	default:
+		evaluationErrors.WithLabelValues(strconv.Itoa(statusCode)).Inc()
+	}
+	return verdict, statusCode
+}
+
+//lookupVerdict Returns the stored verdict of driver id if it is younger than the verdict max age, otherwise evaluates the driver
+func lookupVerdict(id string) (verdict Verdict, statusCode int) {
+	if pool == nil {
+		//Pool not initialized (e.g. in unit tests). Provide a pool initialization
+		pool = newPool(Config.Redis.Host)
+	}
+	opts := scannerSettings(Config.Scanner)
+	if opts.Interval > 0 {
+		conn := pool.Get()
+		verdict, found, err := loadVerdict(conn, id)
+		conn.Close()
+		if err != nil {
+			log.Printf("Error in loading the verdict of driver %v: %v", id, err)
+		}
+		//A verdict given by another strategy (before a config change) isn't used
+		if found && verdict.Strategy == detector.Name() && time.Now().UnixNano()/1e6-verdict.EvaluatedAt <= int64(opts.VerdictMaxAge)*1e3 {
+			return verdict, http.StatusOK
+		}
+	}
+	return evaluateAndStore(id)
+}
+
+//scanDrivers Evaluates all the drivers of on-course, at most opts.Concurrency at the same time, and stores their verdicts
+func scanDrivers(opts ScannerOptions) (stats ScanStats) {
+	start := time.Now()
+	stats.StartedAt = start.UTC().Format(time.RFC3339)
+	ids := make(chan string)
+	var (
+		statsMtx sync.Mutex
+		workers  sync.WaitGroup
+	)
+	for i := 0; i < opts.Concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for id := range ids {
+				verdict, statusCode := evaluateAndStore(id)
+				statsMtx.Lock()
+				switch {
+				case statusCode != http.StatusOK:
+					stats.Errors++
+				case verdictState(verdict) == StateInsufficientData:
+					stats.Drivers++
+					stats.InsufficientData++
+				case verdict.Zombie:
+					stats.Drivers++
+					stats.Zombies++
+				default:
+					stats.Drivers++
+				}
+				statsMtx.Unlock()
+			}
+		}()
+	}
+	//Walks on-course. A connection for each batch: the scan doesn't hold a connection during the evaluations
+	cursor := 0
+	for {
+		conn := pool.Get()
+		values, err := redis.Values(conn.Do("ZSCAN", "on-course", cursor, "COUNT", opts.BatchSize))
+		conn.Close()
+		if err != nil {
+			log.Printf("Error in reading on-course: %v", err)
+			break
+		}
+		var members []string
+		if _, err = redis.Scan(values, &cursor, &members); err != nil {
+			log.Printf("Error in reading on-course: %v", err)
+			break
+		}
+		//ZSCAN replies with member, score pairs
+		for i := 0; i < len(members); i += 2 {
+			ids <- members[i]
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	close(ids)
+	workers.Wait()
+	stats.Pruned = pruneVerdicts(start.UnixNano()/1e6-int64(opts.VerdictMaxAge)*1e3, opts.BatchSize)
+	stats.Duration = time.Since(start).Seconds()
+	return stats
+}
+
+//pruneVerdicts Removes the stored verdicts evaluated before cutoff (Unix time in ms), e.g. of drivers not in on-course anymore
+func pruneVerdicts(cutoff int64, batchSize int) (pruned int) {
+	conn := pool.Get()
+	defer conn.Close()
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("HSCAN", VerdictsKey, cursor, "COUNT", batchSize))
+		if err != nil {
+			log.Printf("Error in reading the stored verdicts: %v", err)
+			return pruned
+		}
+		var fields [][]byte
+		if _, err = redis.Scan(values, &cursor, &fields); err != nil {
+			log.Printf("Error in reading the stored verdicts: %v", err)
+			return pruned
+		}
+		//HSCAN replies with field, value pairs
+		for i := 0; i+1 < len(fields); i += 2 {
+			var verdict Verdict
+			if err := json.Unmarshal(fields[i+1], &verdict); err != nil || verdict.EvaluatedAt < cutoff {
+				conn.Do("HDEL", VerdictsKey, fields[i])
+				pruned++
+			}
+		}
+		if cursor == 0 {
+			return pruned
+		}
+	}
+}
+
+//scannerLoop Evaluates all the active drivers every opts.Interval seconds
+func scannerLoop(opts ScannerOptions) {
+	opts = scannerSettings(opts)
+	if opts.Interval <= 0 {
+		log.Println("Zombie scanner disabled")
+		return
+	}
+	for {
+		stats := scanDrivers(opts)
+		log.Printf("Zombie scan: %v drivers evaluated, %v zombies, %v without enough data, %v errors, %v old verdicts removed in %vs", stats.Drivers, stats.Zombies, stats.InsufficientData, stats.Errors, stats.Pruned, stats.Duration)
+		lastScanMtx.Lock()
+		lastScan = stats
+		lastScanMtx.Unlock()
+		time.Sleep(time.Duration(opts.Interval) * time.Second)
+	}
+}
+
+//fleetReport Replies with the zombie state of the fleet, according to the verdicts younger than the verdict max age
+func fleetReport(c *gin.Context) {
+	if pool == nil {
+		//Pool not initialized (e.g. in unit tests). Provide a pool initialization
+		pool = newPool(Config.Redis.Host)
+	}
+	opts := scannerSettings(Config.Scanner)
+	conn := pool.Get()
+	defer conn.Close()
+	cutoff := time.Now().UnixNano()/1e6 - int64(opts.VerdictMaxAge)*1e3
+	report := FleetReport{ZombieList: make([]Verdict, 0)}
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("HSCAN", VerdictsKey, cursor, "COUNT", opts.BatchSize))
+		if err != nil {
+			log.Printf("Error in reading the stored verdicts: %v", err)
+			c.String(http.StatusInternalServerError, "Ooops. Something went wrong on our side.")
+			return
+		}
+		var fields [][]byte
+		if _, err = redis.Scan(values, &cursor, &fields); err != nil {
+			log.Printf("Error in reading the stored verdicts: %v", err)
+			c.String(http.StatusInternalServerError, "Ooops. Something went wrong on our side.")
+			return
+		}
+		for i := 0; i+1 < len(fields); i += 2 {
+			var verdict Verdict
+			if err := json.Unmarshal(fields[i+1], &verdict); err != nil || verdict.EvaluatedAt < cutoff {
+				continue
+			}
+			report.Drivers++
+			switch verdictState(verdict) {
+			case StateZombie:
+				report.Zombies++
+				report.ZombieList = append(report.ZombieList, verdict)
+			case StateInsufficientData:
+				report.InsufficientData++
+			default:
+				report.Alive++
+			}
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	sort.Slice(report.ZombieList, func(i, j int) bool { return report.ZombieList[i].ID < report.ZombieList[j].ID })
+	lastScanMtx.Lock()
+	report.LastScan = lastScan
+	lastScanMtx.Unlock()
+	c.IndentedJSON(http.StatusOK, report)
+}
@@ -0,0 +1,134 @@
+/*
+Zombie-service for Zombie test.
+Tells if a driver is a zombie or not
+
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//stubDriverLocation Starts a fake driver-location service that replies with the given cumulative distances (in meters),
+//covered in 4 minutes, for every driver (locations and stats). Drivers without a distance are not found. It returns the number of requests received for each driver
+func stubDriverLocation(t *testing.T, distances map[string]float64) (calls map[string]int, mtx *sync.Mutex) {
+	calls = make(map[string]int)
+	mtx = &sync.Mutex{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/drivers/"), "/locations")
+		mtx.Lock()
+		calls[id]++
+		mtx.Unlock()
+		distance, isThere := distances[id]
+		if !isThere {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message": "Driver not found"}`))
+			return
+		}
+		now := time.Now().UTC()
+		fmt.Fprintf(w, `{"locations": [{"latitude": 48.864193, "longitude": 2.364988, "updated_at": %q, "elapsedDistance": 0, "cumulativeDistance": 0},
+			{"latitude": 48.864193, "longitude": 2.364988, "updated_at": %q, "elapsedDistance": %v, "cumulativeDistance": %v}],
+			"stats": {"distance": %v, "avgSpeedKmh": %v}}`,
+			now.Add(-4*time.Minute).Format(time.RFC3339Nano), now.Format(time.RFC3339Nano), distance, distance, distance, distance/240*3.6)
+	}))
+	host := Config.DriverLocationService.Host
+	Config.DriverLocationService.Host = strings.TrimPrefix(server.URL, "http://")
+	t.Cleanup(func() {
+		server.Close()
+		Config.DriverLocationService.Host = host
+	})
+	return calls, mtx
+}
+
+func Test_scanDrivers(t *testing.T) {
+	pool = newPool(Config.Redis.Host)
+	conn := pool.Get()
+	defer conn.Close()
+	conn.Do("DEL", "on-course", VerdictsKey)
+	conn.Do("GEOADD", "on-course", 2.364988, 48.864193, "scan001", 2.364988, 48.864193, "scan002", 2.364988, 48.864193, "scan003")
+	//scan003 is unknown to driver-location. An old verdict of a driver not in on-course anymore is pruned
+	storeVerdict(conn, Verdict{ID: "gone001", EvaluatedAt: time.Now().UnixNano()/1e6 - 3600e3})
+	calls, _ := stubDriverLocation(t, map[string]float64{"scan001": 1200, "scan002": 12})
+	stats := scanDrivers(ScannerOptions{Concurrency: 2, VerdictMaxAge: 120, BatchSize: 1})
+	assert.Equal(t, 2, stats.Drivers)
+	assert.Equal(t, 1, stats.Zombies)
+	assert.Equal(t, 1, stats.Errors)
+	assert.Equal(t, 1, stats.Pruned)
+	assert.Equal(t, map[string]int{"scan001": 1, "scan002": 1, "scan003": 1}, calls)
+	verdict, found, err := loadVerdict(conn, "scan002")
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.True(t, verdict.Zombie)
+	assert.Equal(t, 12.0, verdict.Distance)
+	_, found, _ = loadVerdict(conn, "scan003")
+	assert.False(t, found)
+	_, found, _ = loadVerdict(conn, "gone001")
+	assert.False(t, found)
+}
+
+func TestStoredVerdicts(t *testing.T) {
+	pool = newPool(Config.Redis.Host)
+	conn := pool.Get()
+	defer conn.Close()
+	conn.Do("DEL", VerdictsKey)
+	now := time.Now().UnixNano() / 1e6
+	storeVerdict(conn, Verdict{ID: "stored001", Zombie: true, Window: 5, EvaluatedAt: now - 10e3, Strategy: detector.Name()})
+	storeVerdict(conn, Verdict{ID: "stored002", Zombie: false, Distance: 800, Window: 5, EvaluatedAt: now - 20e3, Strategy: detector.Name()})
+	storeVerdict(conn, Verdict{ID: "stored003", Zombie: false, Distance: 2000, Window: 5, EvaluatedAt: now - 3600e3, Strategy: detector.Name()})
+	storeVerdict(conn, Verdict{ID: "stored004", Zombie: false, Distance: 0, Window: 5, EvaluatedAt: now - 10e3, Strategy: "teleport"})
+	//stored003 moved a lot... 1 hour ago. It's a zombie now. stored004 has been evaluated with another strategy
+	calls, mtx := stubDriverLocation(t, map[string]float64{"stored001": 0, "stored002": 0, "stored003": 0, "stored004": 0})
+	scanner := Config.Scanner
+	Config.Scanner = ScannerOptions{Interval: 60, VerdictMaxAge: 120}
+	defer func() { Config.Scanner = scanner }()
+	tests := []struct {
+		name         string
+		driverID     string
+		zombie       bool
+		driverCalled bool
+	}{
+		//Test Cases
+		{"Recent zombie verdict", "stored001", true, false},
+		{"Recent alive verdict", "stored002", false, false},
+		{"Old verdict", "stored003", true, true},
+		{"Verdict of another strategy", "stored004", true, true},
+	}
+	for _, tt := range tests {
+		router := setupRouter()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/drivers/"+tt.driverID, nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code, "Testing "+tt.name)
+		assert.Contains(t, w.Body.String(), fmt.Sprintf("\"zombie\": %v", tt.zombie), "Testing "+tt.name)
+		mtx.Lock()
+		assert.Equal(t, tt.driverCalled, calls[tt.driverID] > 0, "Testing "+tt.name)
+		mtx.Unlock()
+	}
+	//Fleet report
+	router := setupRouter()
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/fleet/report", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var report FleetReport
+	json.Unmarshal(w.Body.Bytes(), &report)
+	assert.Equal(t, 4, report.Drivers)
+	assert.Equal(t, 3, report.Zombies)
+	assert.Equal(t, 1, report.Alive)
+	if assert.Equal(t, 3, len(report.ZombieList)) {
+		assert.Equal(t, "stored001", report.ZombieList[0].ID)
+		assert.Equal(t, "stored003", report.ZombieList[1].ID)
+		assert.Equal(t, "stored004", report.ZombieList[2].ID)
+		assert.Equal(t, detector.Name(), report.ZombieList[2].Strategy)
+	}
+}
@@ -7,6 +7,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -25,6 +26,16 @@ type IniConfig struct {
 	Port                  int                 `yaml:"port,omitempty"`                    //Gateway listening port
 	Redis                 RedisServiceOptions `yaml:"redis,omitempty"`                   //Redis options
 	DriverLocationService DLSOptions          `yaml:"driver-location-service,omitempty"` //Driver location service options
+	Scanner               ScannerOptions      `yaml:"scanner,omitempty"`                 //Background zombie scanner options
+	Events                EventsOptions       `yaml:"events,omitempty"`                  //Zombie state change events options
+	Detector              DetectorOptions     `yaml:"detector,omitempty"`                //Zombie detection strategy
+	Data                  DataOptions         `yaml:"data,omitempty"`                    //Minimum data needed to judge a driver
+}
+
+//DataOptions describes the minimum data needed to judge a driver. Below it, the verdict is insufficient_data
+type DataOptions struct {
+	MinSamples  int     `yaml:"min-samples,omitempty"`  //Minimum number of locations in the window
+	MinCoverage float64 `yaml:"min-coverage,omitempty"` //Minimum part (0 to 1) of the window between the oldest and the newest location
 }
 
 //RedisServiceOptions describes the options for Redis service
@@ -46,6 +57,12 @@ const ConfigFileName string = "./config.yaml"
 //DefaultMins Default minutes given by getLocations
 const DefaultMins = 5
 
+//DefaultMinSamples Default minimum number of locations needed to judge a driver
+const DefaultMinSamples = 2
+
+//DefaultMinCoverage Default minimum part of the window between the oldest and the newest location needed to judge a driver
+const DefaultMinCoverage = 0.5
+
 //ChannelName Default NSQ channel name
 const ChannelName = "driver-location-service"
 
@@ -60,13 +77,30 @@ const (
 	ZMDCKey = "zombie-mdc"
 )
 
+//Sources of the zombie parameters
+const (
+	//SourceRedis The parameter is set in Redis
+	SourceRedis = "redis"
+	//SourceDefault The parameter is not set in Redis (or can't be read). The default value is used
+	SourceDefault = "default"
+)
+
+//Sources of the distance covered by a driver
+const (
+	//DistanceFromDriverLocation Cumulative distance given by driver-location
+	DistanceFromDriverLocation = "driver-location"
+	//DistanceFromEvaluateDistance Distance computed by zombie-driver (evaluateDistance)
+	DistanceFromEvaluateDistance = "evaluateDistance"
+)
+
 //GLOBAL VARIABLES
 
 //Config is the struct that contains all the settings specified in config file
 var Config IniConfig
 var (
-	pool *redis.Pool    //redis connection pool
-	wg   sync.WaitGroup //Global waitgroup
+	pool     *redis.Pool    //redis connection pool
+	wg       sync.WaitGroup //Global waitgroup
+	detector Detector       //Zombie detection strategy
 )
 
 func init() {
@@ -78,6 +112,12 @@ func init() {
 	log.Printf("Config values: %+v\n", yamlConfig)
 	//Updates Config global variable
 	Config = yamlConfig
+	//Builds the zombie detector. An invalid strategy stops the service: it would change the verdicts silently
+	detector, err = newDetector(Config.Detector)
+	if err != nil {
+		log.Fatalf("Zombie detector can't be initialized: %v. Exiting", err)
+	}
+	log.Printf("Zombie detection strategy: %v", detector.Name())
 	//TODO: Checks for minimal informations in config file and provide default values
 
 }
@@ -111,13 +151,35 @@ func newPool(addr string) *redis.Pool {
 			log.Printf("Connected!")
 			return c, nil
 			*/
-			return redis.Dial("tcp", addr)
+			c, err := redis.Dial("tcp", addr)
+			if err != nil {
+				return nil, err
+			}
+			//Measures the latency of the commands
+			return &instrumentedConn{Conn: c}, nil
 		},
 	}
 	return p
 }
 
-func getZombieParams() (ze, zmdc float64) {
+//minSamples Returns the minimum number of locations, with its default value
+func (opts DataOptions) minSamples() int {
+	if opts.MinSamples <= 0 {
+		return DefaultMinSamples
+	}
+	return opts.MinSamples
+}
+
+//minCoverage Returns the minimum coverage of the window, with its default value
+func (opts DataOptions) minCoverage() float64 {
+	if opts.MinCoverage <= 0 {
+		return DefaultMinCoverage
+	}
+	return opts.MinCoverage
+}
+
+//getZombieParams Returns the zombie definition parameters and where they come from (SourceRedis or SourceDefault)
+func getZombieParams() (ze, zmdc float64, zeSource, zmdcSource string) {
 	//Gets a connection from the Redis connection pool
 	if pool == nil {
 		//Pool not initialized (e.g. in unit tests). Provide a pool initialization
@@ -126,6 +188,7 @@ func getZombieParams() (ze, zmdc float64) {
 	conn := pool.Get()
 	defer conn.Close()
 	//Retrieves dynamic zombie-definition parameters (if they exists)
+	zeSource, zmdcSource = SourceRedis, SourceRedis
 	ze, err := redis.Float64(conn.Do("GET", ZEKey))
 	if err != nil {
 		if err == redis.ErrNil {
@@ -137,6 +200,7 @@ func getZombieParams() (ze, zmdc float64) {
 		}
 		//Assign a default value
 		ze = ZombieElapse
+		zeSource = SourceDefault
 	}
 	zmdc, err = redis.Float64(conn.Do("GET", ZMDCKey))
 	if err != nil {
@@ -149,8 +213,56 @@ func getZombieParams() (ze, zmdc float64) {
 		}
 		//Assign a default value
 		zmdc = ZombieMaxDistanceCovered
+		zmdcSource = SourceDefault
+	}
+	return ze, zmdc, zeSource, zmdcSource
+}
+
+//logMembers Returns the driver:<id>:log members of the locations recorded at tsList (Unix time in ms).
+//Locations stored before millisecond precision was introduced use the Unix time in seconds as member.
+//The candidates to be legacy members (whole seconds) are checked with a single pipeline of ZSCORE requests
+func logMembers(conn redis.Conn, id string, tsList []int64) ([]int64, error) {
+	members := make([]int64, len(tsList))
+	copy(members, tsList)
+	candidates := make([]int, 0)
+	for i, ts := range tsList {
+		if ts%1000 == 0 {
+			candidates = append(candidates, i)
+			conn.Send("ZSCORE", fmt.Sprintf("driver:%v:log", id), ts)
+		}
+	}
+	if len(candidates) == 0 {
+		return members, nil
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+	for _, i := range candidates {
+		_, err := redis.Float64(conn.Receive())
+		if err == redis.ErrNil {
+			//Not stored with millisecond precision. Legacy member
+			members[i] = tsList[i] / 1e3
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return members, nil
+}
+
+//parseUpdatedAt Converts the updated_at value of a location (a RFC3339 string or a Unix time in ms) to Unix time in ms
+func parseUpdatedAt(v interface{}) (int64, error) {
+	switch ts := v.(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, ts)
+		if err != nil {
+			return 0, err
+		}
+		return t.UnixNano() / 1e6, nil
+	case float64:
+		return int64(ts), nil
+	default:
+		return 0, errors.New("updated_at field is neither a string nor a number")
 	}
-	return ze, zmdc
 }
 
 func evaluateDistance(parsedBody []map[string]interface{}, id string) (float64, error) {
@@ -163,92 +275,176 @@ func evaluateDistance(parsedBody []map[string]interface{}, id string) (float64,
 	}
 	conn := pool.Get()
 	defer conn.Close()
-	//Extracts the timestamps in Unix format from all the JSONs in parsedBody
+	//Extracts the timestamps in Unix format (ms) from all the JSONs in parsedBody
 	tsList := make([]int64, 0)
 	for i, jsonEntry := range parsedBody {
+		//GPS outliers flagged by driver-location are not used
+		if rejected, _ := jsonEntry["rejected"].(bool); rejected {
+			continue
+		}
 		//Checks that the timestamp is there
 		v, isThere := jsonEntry["updated_at"]
 		if !isThere {
 			log.Printf("updated_at field is not in JSON object at index %v", i)
-		} else {
-			//timestamp is there
-			//Type assertion
-			ISOts, ok := v.(string)
-			if !ok {
-				//Not a string
-				log.Printf("updated_at field is not a string in JSON object at index %v", i)
-			} else {
-				t, err := time.Parse(time.RFC3339, ISOts)
-				if err != nil {
-					//Something went wrong in time conversion
-					log.Printf("Error in parsing timestamp from JSON. %v", err)
-				} else {
-					//Convert Go timestamp in Unix timestamp and add it to timestamps list
-					ts := t.Unix()
-					tsList = append(tsList, ts)
-				}
-			}
+			continue
+		}
+		//timestamp is there. It can be a RFC3339 string or a Unix time in ms
+		ts, err := parseUpdatedAt(v)
+		if err != nil {
+			log.Printf("Error in parsing timestamp from JSON object at index %v. %v", i, err)
+			continue
 		}
+		tsList = append(tsList, ts)
 	}
 	log.Printf("List of eligible timestamps retrieved for driver ID %v : %v", id, tsList)
-	for j, ts := range tsList {
-		var (
-			delta float64
-			err   error
-		)
-		if j == 0 {
-			delta = 0
-		} else {
-			//Retrieves delta
-			delta, err = redis.Float64(conn.Do("GEODIST", fmt.Sprintf("driver:%v:log", id), ts, tsList[j-1], "m"))
-			if err != nil {
-				//If GEODIST fails, is not possible to evaluate distance. Exits with an error
-				log.Printf("An error occurred in evaluateDistance while calling GEODIST. Exiting evaluateDistance with distance = 0,err. %v ", err)
-				return 0, err
-			}
+	if len(tsList) < 2 {
+		//No delta to evaluate
+		return 0, nil
+	}
+	members, err := logMembers(conn, id, tsList)
+	if err != nil {
+		log.Printf("An error occurred in evaluateDistance while looking for log members. Exiting evaluateDistance with distance = 0,err. %v ", err)
+		return 0, err
+	}
+	//Sends all the GEODIST requests in a single pipeline
+	for j := 1; j < len(members); j++ {
+		conn.Send("GEODIST", fmt.Sprintf("driver:%v:log", id), members[j], members[j-1], "m")
+	}
+	if err = conn.Flush(); err != nil {
+		log.Printf("An error occurred in evaluateDistance while sending GEODIST requests. Exiting evaluateDistance with distance = 0,err. %v ", err)
+		return 0, err
+	}
+	var geodistErr error
+	for j := 1; j < len(members); j++ {
+		//Retrieves delta. Every reply is received, even after an error, to leave the connection clean
+		delta, err := redis.Float64(conn.Receive())
+		if err != nil && geodistErr == nil {
+			geodistErr = err
 		}
-		//Updates cumulative distance (if GEODIST calls gives an error, delta = 0. We'll rise an exception)
+		//Updates cumulative distance
 		cumulativeDistance = cumulativeDistance + delta
 	}
+	if geodistErr != nil {
+		//If GEODIST fails, is not possible to evaluate distance. Exits with an error
+		log.Printf("An error occurred in evaluateDistance while calling GEODIST. Exiting evaluateDistance with distance = 0,err. %v ", geodistErr)
+		return 0, geodistErr
+	}
 	//Distance is cumulativeDistance
 	log.Printf("Computed cumulativeDistance: %v", cumulativeDistance)
 	return cumulativeDistance, nil
 }
 
+//Verdict describes the zombie state of a driver
+type Verdict struct {
+	ID          string       `json:"id"`
+	Zombie      bool         `json:"zombie"`
+	State       string       `json:"state,omitempty"`       //zombie, alive or insufficient_data
+	Distance    float64      `json:"distance"`              //Distance (in meters) covered during the window
+	Window      float64      `json:"window"`                //Window (in minutes) of the evaluation
+	EvaluatedAt int64        `json:"evaluated_at"`          //Time of the evaluation (Unix time in ms)
+	Strategy    string       `json:"strategy"`              //Name of the detection strategy
+	Explanation *Explanation `json:"explanation,omitempty"` //Why the verdict has been given
+}
+
+//Explanation describes the data and the rules behind a verdict
+type Explanation struct {
+	Distance       float64           `json:"distance"`               //Distance (in meters) covered during the window
+	Window         float64           `json:"window"`                 //Window (in minutes) of the evaluation
+	Samples        int               `json:"samples"`                //Number of locations received from driver-location
+	Coverage       float64           `json:"coverage"`               //Part (0 to 1) of the window between the oldest and the newest location
+	FirstSample    int64             `json:"first_sample,omitempty"` //Time of the oldest location (Unix time in ms)
+	LastSample     int64             `json:"last_sample,omitempty"`  //Time of the newest location (Unix time in ms)
+	Thresholds     AppliedThresholds `json:"thresholds"`
+	DistanceSource string            `json:"distance_source"` //driver-location or evaluateDistance
+	Rule           string            `json:"rule,omitempty"`  //Detector rule(s) that flagged the driver (empty if not a zombie)
+}
+
+//AppliedThresholds describes the zombie definition parameters used by an evaluation
+type AppliedThresholds struct {
+	ZombieE   ThresholdValue `json:"zombie-e"`
+	ZombieMDC ThresholdValue `json:"zombie-mdc"`
+}
+
+//ThresholdValue is a zombie definition parameter and where it comes from
+type ThresholdValue struct {
+	Value  float64 `json:"value"`
+	Source string  `json:"source"` //redis or default
+}
+
+//locationsEnvelope describes the response of driver-location to a locations request with stats=true
+type locationsEnvelope struct {
+	Locations []map[string]interface{} `json:"locations"`
+	Stats     *struct {
+		AvgSpeedKmh float64 `json:"avgSpeedKmh"` //Average speed (in km/h) over the locations
+	} `json:"stats"`
+}
+
+//trackPoints Extracts the locations (position and time) from the driver-location response. Invalid elements and GPS outliers are skipped
+func trackPoints(parsedBody []map[string]interface{}) []TrackPoint {
+	points := make([]TrackPoint, 0, len(parsedBody))
+	for _, jsonEntry := range parsedBody {
+		if rejected, _ := jsonEntry["rejected"].(bool); rejected {
+			continue
+		}
+		lat, latOk := jsonEntry["latitude"].(float64)
+		lon, lonOk := jsonEntry["longitude"].(float64)
+		if !latOk || !lonOk {
+			continue
+		}
+		ts, err := parseUpdatedAt(jsonEntry["updated_at"])
+		if err != nil {
+			continue
+		}
+		points = append(points, TrackPoint{Latitude: lat, Longitude: lon, Time: ts})
+	}
+	return points
+}
+
 //isZombie Tells if driver id is a zombie
-func isZombie(id string) (brainHungry bool, statusCode int) {
-	//By default, a driver is NOT a zombie!
-	brainHungry = false
+func isZombie(id string) (verdict Verdict, statusCode int) {
 	//Retrieves parameters to define what is a zombie
-	ze, zmdc := getZombieParams()
-	log.Printf("Params for evaluating zombie status: %v min, %v m", ze, zmdc)
+	ze, zmdc, zeSource, zmdcSource := getZombieParams()
+	log.Printf("Params for evaluating zombie status: %v min (%v), %v m (%v)", ze, zeSource, zmdc, zmdcSource)
+	verdict = Verdict{ID: id, Window: ze, EvaluatedAt: time.Now().UnixNano() / 1e6, Strategy: detector.Name()}
+	explanation := &Explanation{
+		Window: ze,
+		Thresholds: AppliedThresholds{
+			ZombieE:   ThresholdValue{Value: ze, Source: zeSource},
+			ZombieMDC: ThresholdValue{Value: zmdc, Source: zmdcSource},
+		},
+		DistanceSource: DistanceFromDriverLocation,
+	}
 	//Gets positions (and total distances if possible) from driver-location service
 	elapsedTime := strconv.FormatFloat(ze, 'f', -1, 64)
-	url := fmt.Sprintf("http://%v/drivers/%v/locations?minutes=%v&distance=true", Config.DriverLocationService.Host, id, elapsedTime)
+	url := fmt.Sprintf("http://%v/drivers/%v/locations?minutes=%v&distance=true&stats=true", Config.DriverLocationService.Host, id, elapsedTime)
 	resp, err := http.Get(url)
 	if err != nil {
 		//Something went wrong, just exit with default values
 		log.Printf("Error in contacting driver-location. %v", err)
-		return false, http.StatusServiceUnavailable
+		return verdict, http.StatusServiceUnavailable
 	}
 	//Manage the 404 (driver doesn't exists) and similar errors
 	if resp.StatusCode != 200 {
 		log.Printf("Driver-location service answered with a status code != 200: %v", resp.StatusCode)
-		return brainHungry, resp.StatusCode
+		resp.Body.Close()
+		return verdict, resp.StatusCode
 	}
 	//Parse the response body
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		log.Printf("We had a problem in processing the response from driver-location-service. Error returned %v", err)
-		return brainHungry, http.StatusInternalServerError
+		return verdict, http.StatusInternalServerError
 	}
-	//JSON unmarshall (The answer coming from the service is a JSON array)
+	//JSON unmarshall (The answer coming from the service is a JSON object with the locations and their stats,
+	//or a JSON array of locations for versions without stats)
+	var envelope locationsEnvelope
 	parsedBody := make([]map[string]interface{}, 0)
-	err = json.Unmarshal(body, &parsedBody)
-	if err != nil {
+	if err = json.Unmarshal(body, &envelope); err == nil {
+		parsedBody = envelope.Locations
+	} else if err = json.Unmarshal(body, &parsedBody); err != nil {
 		log.Printf("Something went wrong while decoding the JSON body payload. %v", err)
-		return brainHungry, http.StatusInternalServerError
+		return verdict, http.StatusInternalServerError
 	}
 	log.Printf("Parsed body: %v", parsedBody)
 	log.Printf("Number of elements: %v", len(parsedBody))
@@ -270,55 +466,99 @@ func isZombie(id string) (brainHungry bool, statusCode int) {
 			} else {
 				//Assertion went bad. It's needed to evaluate distance
 				log.Printf("cumulativeDistance is not a valid value. Call evaluateDistance")
+				explanation.DistanceSource = DistanceFromEvaluateDistance
 				distance, err = evaluateDistance(parsedBody, id)
 				if err != nil {
 					//EvaluateDistance failed. Return a default FALSE value + 500 status (not a zombie unless proved the contrary)
-					return false, http.StatusInternalServerError
+					return verdict, http.StatusInternalServerError
 				}
 			}
 		} else {
 			//Value is not there. Evaluating distance
 			log.Println("cumulativeDistance field not found in the response from driver-location-service. Evaluate distance")
+			explanation.DistanceSource = DistanceFromEvaluateDistance
 			distance, err = evaluateDistance(parsedBody, id)
 			if err != nil {
 				//EvaluateDistance failed. Return a default FALSE value + 500 status (not a zombie unless proved the contrary)
-				return false, http.StatusInternalServerError
+				return verdict, http.StatusInternalServerError
 			}
 		}
 	}
-	//Checks distance against max distance zombie parameter
-	if distance <= zmdc {
-		brainHungry = true
+	track := Track{Distance: distance, Window: ze, Points: trackPoints(parsedBody)}
+	if envelope.Stats != nil {
+		//Average speed computed by driver-location
+		track.AvgSpeed = &envelope.Stats.AvgSpeedKmh
+	}
+	verdict.Distance = distance
+	verdict.Explanation = explanation
+	explanation.Distance = distance
+	explanation.Samples = len(track.Points)
+	for i, point := range track.Points {
+		if i == 0 || point.Time < explanation.FirstSample {
+			explanation.FirstSample = point.Time
+		}
+		if point.Time > explanation.LastSample {
+			explanation.LastSample = point.Time
+		}
 	}
-	return brainHungry, http.StatusOK
+	explanation.Coverage = float64(explanation.LastSample-explanation.FirstSample) / (ze * 60e3)
+	//A driver that just came online (too few locations, or locations spread over a small part of the window) can't be judged
+	if explanation.Samples < Config.Data.minSamples() || explanation.Coverage < Config.Data.minCoverage() {
+		log.Printf("Not enough data to judge driver %v: %v locations covering %v of the window", id, explanation.Samples, explanation.Coverage)
+		verdict.State = StateInsufficientData
+		return verdict, http.StatusOK
+	}
+	//Asks the detector. By default, a driver is NOT a zombie!
+	brainHungry, fired := detector.Detect(track, Thresholds{Window: ze, MaxDistance: zmdc})
+	if brainHungry {
+		log.Printf("Driver %v flagged as zombie by %v", id, fired)
+	}
+	verdict.Zombie = brainHungry
+	verdict.State = verdictState(verdict)
+	explanation.Rule = fired
+	return verdict, http.StatusOK
 }
 
 //zombieDetector Handler for zombie-service endpoint
 func zombieDetector(c *gin.Context) {
 	//Reads driverId from the path params
 	id := c.Param("id")
+	//Adds the explanation of the verdict if requested
+	explain := c.DefaultQuery("explain", "false") == "true"
 	//Builds the response
 	response := make(map[string]interface{}, 0)
-	zombie, statusCode := isZombie(id)
+	//Uses the verdict of the scanner if it is recent enough, otherwise evaluates the driver
+	verdict, statusCode := lookupVerdict(id)
 	if statusCode != 200 {
 		//Something went bad with the zombie evaluation
 		if statusCode == 404 {
 			//Driver not found
 			response = map[string]interface{}{
-				"id":      id,
-				"message": "Driver not found",
+				"id":       id,
+				"message":  "Driver not found",
+				"strategy": detector.Name(),
 			}
 		} else {
 			response = map[string]interface{}{
-				"id":      id,
-				"message": "An error occurred",
+				"id":       id,
+				"message":  "An error occurred",
+				"strategy": detector.Name(),
 			}
 		}
 	} else {
 		//Everything went good. Prepare the response
 		response = map[string]interface{}{
-			"id":     id,
-			"zombie": zombie,
+			"id":       id,
+			"state":    verdictState(verdict),
+			"strategy": verdict.Strategy,
+			"zombie":   verdict.Zombie,
+		}
+		if verdictState(verdict) == StateInsufficientData {
+			//Neither a zombie nor alive
+			response["zombie"] = nil
+		}
+		if explain && verdict.Explanation != nil {
+			response["explanation"] = verdict.Explanation
 		}
 	}
 	//Sends the response
@@ -328,7 +568,11 @@ func zombieDetector(c *gin.Context) {
 //setupRouter Defines the routes exposed by zombie-dirver service
 func setupRouter() *gin.Engine {
 	router := gin.Default()
+	//Counts the requests and measures their latency
+	router.Use(metricsMiddleware)
 	router.GET("/drivers/:id", zombieDetector)
+	router.GET("/fleet/report", fleetReport)
+	router.GET(MetricsPath, metricsHandler)
 	return router
 }
 
@@ -348,6 +592,10 @@ func main() {
 	//Creates a Redis pool and sets it to a module wide variable
 	pool = newPool(Config.Redis.Host)
 	log.Printf("Redis pool stats: %v", pool.Stats())
+	//Creates the publisher of the zombie state change events
+	events = newEventPublisher(Config.Events)
+	//Evaluates all the active drivers in background
+	go scannerLoop(Config.Scanner)
 	//Sets up the Gin framework router in a separate goroutine
 	wg.Add(1) //Adds 1 to waitgroup
 	go routing()
@@ -7,6 +7,7 @@ Tells if a driver is a zombie or not
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -14,6 +15,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/gomodule/redigo/redis"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -31,20 +33,27 @@ func saveTestDriverData(long, lat float64, timestamp int64, testDriverID string)
 	if err != nil {
 		return fmt.Errorf("An error occurred while test was interacting with REDIS(GEOADD). %v", err)
 	}
-	_, err = conn.Do("SADD", fmt.Sprintf("driver:%v:timestamps", testDriverID), timestamp)
+	//Timeline score is the Unix time in ms (timestamp is in seconds for legacy data)
+	score := timestamp
+	if timestamp < 1e11 {
+		score = timestamp * 1e3
+	}
+	_, err = conn.Do("ZADD", fmt.Sprintf("driver:%v:timeline", testDriverID), score, timestamp)
 	if err != nil {
-		return fmt.Errorf("An error occurred while test was interacting with REDIS(SADD). %v", err)
+		return fmt.Errorf("An error occurred while test was interacting with REDIS(ZADD). %v", err)
 	}
 	return nil
 }
 
 func TestZombieDetectorRoute(t *testing.T) {
 
-	//Prepares data for driver test001
-	errRedis := saveTestDriverData(2.364988, 48.864193, time.Now().Unix(), "test001")
-	if errRedis != nil {
-		t.Error(errRedis)
-		return
+	//Prepares data for driver test001: parked for 4 minutes
+	for _, ts := range []int64{time.Now().Add(-4 * time.Minute).Unix(), time.Now().Unix()} {
+		errRedis := saveTestDriverData(2.364988, 48.864193, ts, "test001")
+		if errRedis != nil {
+			t.Error(errRedis)
+			return
+		}
 	}
 
 	tests := []struct {
@@ -73,6 +82,100 @@ func TestZombieDetectorRoute(t *testing.T) {
 	}
 }
 
+func TestZombieDetectorExplain(t *testing.T) {
+	pool = newPool(Config.Redis.Host)
+	conn := pool.Get()
+	defer conn.Close()
+	//zombie-e comes from Redis, zombie-mdc is the default value
+	conn.Do("SET", ZEKey, 4)
+	conn.Do("DEL", ZMDCKey)
+	conn.Do("HDEL", VerdictsKey, "explain001", "explain002")
+	defer conn.Do("DEL", ZEKey)
+	stubDriverLocation(t, map[string]float64{"explain001": 12.5, "explain002": 12.5})
+	tests := []struct {
+		name     string
+		query    string
+		driverID string
+		explain  bool
+	}{
+		//Test Cases
+		{"Without explanation", "", "explain001", false},
+		{"Explanation", "?explain=true", "explain002", true},
+	}
+	for _, tt := range tests {
+		router := setupRouter()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/drivers/"+tt.driverID+tt.query, nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code, "Testing "+tt.name)
+		var response struct {
+			ID          string       `json:"id"`
+			Zombie      bool         `json:"zombie"`
+			Explanation *Explanation `json:"explanation"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		assert.True(t, response.Zombie, "Testing "+tt.name)
+		if !tt.explain {
+			assert.Nil(t, response.Explanation, "Testing "+tt.name)
+			continue
+		}
+		if !assert.NotNil(t, response.Explanation, "Testing "+tt.name) {
+			continue
+		}
+		explanation := response.Explanation
+		assert.Equal(t, 12.5, explanation.Distance)
+		assert.Equal(t, 4.0, explanation.Window)
+		assert.Equal(t, 2, explanation.Samples)
+		assert.Equal(t, int64(4*60e3), explanation.LastSample-explanation.FirstSample)
+		assert.Equal(t, ThresholdValue{Value: 4, Source: SourceRedis}, explanation.Thresholds.ZombieE)
+		assert.Equal(t, ThresholdValue{Value: ZombieMaxDistanceCovered, Source: SourceDefault}, explanation.Thresholds.ZombieMDC)
+		assert.Equal(t, DistanceFromDriverLocation, explanation.DistanceSource)
+		assert.Equal(t, StrategyDistance, explanation.Rule)
+	}
+}
+
+func TestInsufficientData(t *testing.T) {
+	pool = newPool(Config.Redis.Host)
+	conn := pool.Get()
+	defer conn.Close()
+	conn.Do("DEL", ZEKey, ZMDCKey)
+	data := Config.Data
+	defer func() { Config.Data = data }()
+	//Every driver has 2 locations covering 4 minutes of the 5 minutes window
+	stubDriverLocation(t, map[string]float64{"data001": 0, "data002": 0, "data003": 0})
+	tests := []struct {
+		name          string
+		driverID      string
+		data          DataOptions
+		expectedState string
+		expectedBody  string
+	}{
+		//Test Cases
+		{"Enough data", "data001", DataOptions{MinSamples: 2, MinCoverage: 0.5}, StateZombie, "\"zombie\": true"},
+		{"Too few locations", "data002", DataOptions{MinSamples: 3, MinCoverage: 0.5}, StateInsufficientData, "\"zombie\": null"},
+		{"Small coverage", "data003", DataOptions{MinSamples: 2, MinCoverage: 0.9}, StateInsufficientData, "\"zombie\": null"},
+	}
+	for _, tt := range tests {
+		Config.Data = tt.data
+		conn.Do("HDEL", VerdictsKey, tt.driverID)
+		conn.Do("HDEL", StatesKey, tt.driverID)
+		router := setupRouter()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/drivers/"+tt.driverID, nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code, "Testing "+tt.name)
+		assert.Contains(t, w.Body.String(), fmt.Sprintf("\"state\": %q", tt.expectedState), "Testing "+tt.name)
+		assert.Contains(t, w.Body.String(), tt.expectedBody, "Testing "+tt.name)
+		//Verdicts without enough data don't change the state of the driver
+		state, _ := redis.String(conn.Do("HGET", StatesKey, tt.driverID))
+		if tt.expectedState == StateInsufficientData {
+			assert.Equal(t, "", state, "Testing "+tt.name)
+		} else {
+			assert.Equal(t, tt.expectedState, state, "Testing "+tt.name)
+		}
+	}
+}
+
 func Test_evaluateDistance(t *testing.T) {
 	driverID := "test002"
 	//Prepares data for driver test002
@@ -108,7 +211,8 @@ func Test_evaluateDistance(t *testing.T) {
 		{"Distance computation", args{parsedBody, driverID}, map[string]interface{}{"variation": false}, 73.4, false},
 		{"Missing data", args{parsedBody, driverID}, map[string]interface{}{"longitude": 33}, 0, false},
 		{"Not existing driver", args{parsedBody, "IDONTEXIST"}, map[string]interface{}{"variation": false}, 0, true},
-		{"updated_at not a string", args{parsedBody, driverID}, map[string]interface{}{"longitude": 2.364988, "latitude": 48.864193, "updated_at": 153232}, 0, false},
+		{"updated_at neither a string nor a number", args{parsedBody, driverID}, map[string]interface{}{"longitude": 2.364988, "latitude": 48.864193, "updated_at": true}, 0, false},
+		{"updated_at in Unix ms", args{parsedBody, driverID}, map[string]interface{}{"longitude": 2.364988, "latitude": 48.864193, "updated_at": float64(now * 1e3)}, 73.4, false},
 	}
 	for _, tt := range tests {
 		parsedBody[0] = map[string]interface{}{
@@ -137,3 +241,69 @@ func Test_evaluateDistance(t *testing.T) {
 		})
 	}
 }
+
+func Test_evaluateDistanceMilliseconds(t *testing.T) {
+	driverID := "test003"
+	//Prepares data for driver test003: two locations recorded in the same second
+	now := time.Now().UnixNano() / 1e6
+	before := now - 400
+	errRedis := saveTestDriverData(2.365988, 48.864193, before, driverID)
+	if errRedis != nil {
+		t.Error(errRedis)
+		return
+	}
+	errRedis = saveTestDriverData(2.364988, 48.864193, now, driverID)
+	if errRedis != nil {
+		t.Error(errRedis)
+		return
+	}
+	parsedBody := []map[string]interface{}{
+		{"longitude": 2.365988, "latitude": 48.864193, "updated_at": time.Unix(0, before*1e6).UTC().Format(time.RFC3339Nano)},
+		{"longitude": 2.364988, "latitude": 48.864193, "updated_at": float64(now)},
+	}
+	got, err := evaluateDistance(parsedBody, driverID)
+	assert.Nil(t, err)
+	assert.Equal(t, 73.4, got)
+}
+
+//evaluateDistanceSequential Evaluates the distance covered along tsList with one GEODIST round trip per delta
+//(as before pipelining), to be compared with evaluateDistance
+func evaluateDistanceSequential(tsList []int64, id string) (float64, error) {
+	conn := pool.Get()
+	defer conn.Close()
+	var cumulativeDistance float64
+	for j := 1; j < len(tsList); j++ {
+		delta, err := redis.Float64(conn.Do("GEODIST", fmt.Sprintf("driver:%v:log", id), tsList[j], tsList[j-1], "m"))
+		if err != nil {
+			return 0, err
+		}
+		cumulativeDistance = cumulativeDistance + delta
+	}
+	return cumulativeDistance, nil
+}
+
+func BenchmarkEvaluateDistance(b *testing.B) {
+	//5 minutes at 5 seconds reporting
+	driverID := "test004"
+	now := time.Now().UnixNano() / 1e6
+	parsedBody := make([]map[string]interface{}, 0)
+	tsList := make([]int64, 0)
+	for i := 0; i < 60; i++ {
+		ts := now - int64(60-i)*5e3
+		if err := saveTestDriverData(2.364988+float64(i)*1e-4, 48.864193, ts, driverID); err != nil {
+			b.Fatal(err)
+		}
+		parsedBody = append(parsedBody, map[string]interface{}{"updated_at": float64(ts)})
+		tsList = append(tsList, ts)
+	}
+	b.Run("pipelined", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			evaluateDistance(parsedBody, driverID)
+		}
+	})
+	b.Run("sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			evaluateDistanceSequential(tsList, driverID)
+		}
+	})
+}